@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// AccountSettings configure the emails sent to verify an address and to
+// reset a password, the password policy and the login lockout.
+type AccountSettings struct {
+	// BaseURL is the address of the web app the links in emails point to.
+	BaseURL string
+	// VerificationTTL and ResetTTL are how long the links stay valid.
+	VerificationTTL time.Duration
+	ResetTTL        time.Duration
+	// RequireVerification refuses logins to accounts whose email has not
+	// been verified.
+	RequireVerification bool
+	// MinPasswordLength is the shortest password accepted; bcrypt caps the
+	// longest at 72 bytes.
+	MinPasswordLength int
+	// PasswordBlocklist is a file of breached or common passwords, one per
+	// line, either in plain text or as SHA-1 hashes like the Pwned
+	// Passwords ranges ("HASH:count").
+	PasswordBlocklist string
+	// MaxFailedLogins wrong passwords in a row lock an account for
+	// LockoutDuration.
+	MaxFailedLogins int
+	LockoutDuration time.Duration
+	// InviteTTL is how long a workspace invitation can be accepted.
+	InviteTTL time.Duration
+}
+
+func LoadAccountSettings() AccountSettings {
+	baseURL := os.Getenv("APP_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	return AccountSettings{
+		BaseURL:             strings.TrimSuffix(baseURL, "/"),
+		VerificationTTL:     getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+		ResetTTL:            getEnvDuration("PASSWORD_RESET_TTL", time.Hour),
+		RequireVerification: os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true",
+		MinPasswordLength:   int(getEnvInt64("PASSWORD_MIN_LENGTH", 10)),
+		PasswordBlocklist:   os.Getenv("PASSWORD_BLOCKLIST_FILE"),
+		MaxFailedLogins:     int(getEnvInt64("LOGIN_MAX_FAILURES", 5)),
+		LockoutDuration:     getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		InviteTTL:           getEnvDuration("WORKSPACE_INVITE_TTL", 7*24*time.Hour),
+	}
+}
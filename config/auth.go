@@ -0,0 +1,137 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"real-time-collab/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrForbidden is returned when a principal may not do what it asked for.
+var ErrForbidden = errors.New("forbidden")
+
+// Principal is who a request or a websocket connection is authenticated
+// as. Principals authenticated with an API token or a share link carry its
+// limits.
+type Principal struct {
+	UserID string
+	// TokenID is the API token used, zero for a session token
+	TokenID uint
+	// ShareID is the share link a connection was opened with, if any
+	ShareID uint
+	// Scope and DocID are the limits of the API token or share link, if any
+	Scope string
+	DocID string
+	// ExpiresAt is when the API token or share link stops working, nil if
+	// it does not
+	ExpiresAt *time.Time
+}
+
+// Expired reports whether the API token or share link the principal was
+// opened with has expired.
+func (principal *Principal) Expired(now time.Time) bool {
+	return principal.ExpiresAt != nil && !now.Before(*principal.ExpiresAt)
+}
+
+// CanWrite reports whether the principal may change documents.
+func (principal *Principal) CanWrite() bool {
+	return (principal.TokenID == 0 && principal.ShareID == 0) || principal.Scope == models.TokenScopeReadWrite
+}
+
+// Authorize checks the principal may read, or write, a document. docID is
+// empty for requests that do not name one, which tokens limited to a
+// document may not make.
+func (principal *Principal) Authorize(docID string, write bool) error {
+	if write && !principal.CanWrite() {
+		return fmt.Errorf("%w: token is read-only", ErrForbidden)
+	}
+	if principal.DocID != "" && docID != principal.DocID {
+		return fmt.Errorf("%w: token is limited to document %s", ErrForbidden, principal.DocID)
+	}
+	return nil
+}
+
+// AuthorizeMessage checks a websocket message against the principal and
+// makes its edits carry the principal's user id whatever the client put in
+// them.
+func (principal *Principal) AuthorizeMessage(message *ClientMessage) error {
+	write := writesDocument(message)
+	if err := principal.Authorize(message.DocID, write); err != nil {
+		return err
+	}
+	if message.Event != nil && message.Event.DocID != "" && message.Event.DocID != message.DocID {
+		if err := principal.Authorize(message.Event.DocID, write); err != nil {
+			return err
+		}
+	}
+	message.UserID = principal.UserID
+	if message.Event != nil {
+		message.Event.UserID = principal.UserID
+	}
+	for i := range message.Operations {
+		message.Operations[i].UserID = principal.UserID
+	}
+	return nil
+}
+
+// writesDocument reports whether a message changes its document rather
+// than only reading it.
+func writesDocument(message *ClientMessage) bool {
+	switch message.Type {
+	case ResumeMessageType:
+		return len(message.Operations) > 0
+	case CRDTSyncMessageType:
+		return false
+	}
+	return true
+}
+
+// authorize checks a websocket message against the sender's API token and
+// the sender's permission on the documents it names.
+func (pool *ConnectionPool) authorize(ctx context.Context, message QueuedMessage, clientMessage *ClientMessage, DB *gorm.DB) error {
+	if message.Principal != nil {
+		if err := message.Principal.AuthorizeMessage(clientMessage); err != nil {
+			return err
+		}
+	}
+	write := writesDocument(clientMessage)
+	if err := pool.checkAccess(ctx, message.Sender, clientMessage.DocID, message.Principal, write, DB); err != nil {
+		return err
+	}
+	if clientMessage.Event != nil && clientMessage.Event.DocID != "" && clientMessage.Event.DocID != clientMessage.DocID {
+		return pool.checkAccess(ctx, message.Sender, clientMessage.Event.DocID, message.Principal, write, DB)
+	}
+	return nil
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal an earlier middleware
+// authenticated the request as, if any.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+type documentRouteKey struct{}
+
+// WithDocumentRoute returns a copy of ctx for a route that acts on the
+// document docID, "" when only the handler finds out which document, from
+// the thread, suggestion or branch it loads.
+func WithDocumentRoute(ctx context.Context, docID string) context.Context {
+	return context.WithValue(ctx, documentRouteKey{}, docID)
+}
+
+// DocumentRoute returns the document set by WithDocumentRoute, and false
+// for routes that do not act on a document.
+func DocumentRoute(ctx context.Context) (string, bool) {
+	docID, ok := ctx.Value(documentRouteKey{}).(string)
+	return docID, ok
+}
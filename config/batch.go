@@ -0,0 +1,95 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"real-time-collab/metrics"
+	"real-time-collab/models"
+	"real-time-collab/tracing"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// applyBatch applies an ordered list of operations made against one base
+// version as a single revision. The operations are rebased over whatever
+// was committed since the base version, applied in order, stored with the
+// same version and broadcast as one message. Either all of them are
+// applied or none is.
+func (pool *ConnectionPool) applyBatch(ctx context.Context, sender *websocket.Conn, request ClientMessage, DB *gorm.DB) error {
+	ctx, span := tracing.Tracer.Start(ctx, "batch", trace.WithAttributes(
+		attribute.String("doc.id", request.DocID),
+		attribute.Int("batch.base_version", request.Version),
+		attribute.Int("batch.operations", len(request.Operations)),
+	))
+	defer span.End()
+
+	if len(request.Operations) == 0 {
+		return fmt.Errorf("batch has no operations")
+	}
+	if len(request.Operations) > pool.Settings.MaxBatchOperations {
+		return fmt.Errorf("batch has %d operations, the limit is %d", len(request.Operations), pool.Settings.MaxBatchOperations)
+	}
+	state, err := pool.Store.Acquire(ctx, request.DocID)
+	if err != nil {
+		return err
+	}
+	defer pool.Store.Release(state)
+	defer pool.publishQueued(state)
+	state.Lock()
+	defer state.Unlock()
+	if err := requireMode(state, models.DocumentModeOT); err != nil {
+		return err
+	}
+	if err := requireType(state, models.DocumentTypeText); err != nil {
+		return err
+	}
+
+	committed, err := state.EventsSince(DB.WithContext(ctx), request.Version)
+	if err != nil {
+		return err
+	}
+
+	// applied to a copy so a failing operation leaves the head untouched
+	document := state.Document
+	events := rebaseOperations(request.Operations, committed)
+	version := document.Version + 1
+	for i := range events {
+		event := &events[i]
+		event.ID = 0
+		event.DocID = request.DocID
+		if event.UserID == "" {
+			event.UserID = request.UserID
+		}
+		if err := validateDocumentEvent(event); err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+		if err := applyOperation(&document, event); err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+		event.Version = version
+	}
+	document.Version = version
+	state.commit(document, events)
+
+	for _, event := range events {
+		metrics.EventsProcessed.WithLabelValues(event.Operation).Inc()
+	}
+	span.SetAttributes(attribute.Int("batch.version", document.Version))
+	pool.JoinRoom(sender, request.DocID, request.UserID)
+	state.queueBroadcast(BroadcastMessage{
+		Message: ServerMessage{
+			Type:    BatchMessageType,
+			DocID:   request.DocID,
+			Version: document.Version,
+			Content: document.Content,
+			Events:  events,
+		},
+		DocID:       request.DocID,
+		ExcludeConn: sender,
+		Context:     ctx,
+	})
+	return nil
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"real-time-collab/metrics"
+	"real-time-collab/models"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotBranchable is returned for documents that cannot be forked or
+	// merged: CRDT and rich-text documents, and merges of documents that are
+	// not branches.
+	ErrNotBranchable = errors.New("document cannot be branched")
+	// ErrMergeConflict is returned when edits of the branch and of its
+	// parent overlap and the merge was not forced.
+	ErrMergeConflict = errors.New("merge has conflicts")
+	// ErrMergeRaced is returned when another merge of the branch finished
+	// first.
+	ErrMergeRaced = errors.New("branch was merged concurrently")
+)
+
+// Conflict is a pair of overlapping edits a merge found, both in the
+// context of the document at the point they met.
+type Conflict struct {
+	Branch models.DocumentEvent `json:"branch"`
+	Parent models.DocumentEvent `json:"parent"`
+}
+
+// MergeResult reports what a merge applied to the parent and the conflicts
+// it found.
+type MergeResult struct {
+	Version   int                    `json:"version"`
+	Events    []models.DocumentEvent `json:"events"`
+	Conflicts []Conflict             `json:"conflicts"`
+}
+
+func requireBranchable(document models.Document) error {
+	if document.Mode != models.DocumentModeOT || document.Type != models.DocumentTypeText {
+		return fmt.Errorf("%w: only text documents in ot mode have branches", ErrNotBranchable)
+	}
+	return nil
+}
+
+// Fork creates a branch of a document at a version, its head for
+// HeadVersion. The branch starts at that version with the parent's content
+// and reads earlier versions from the parent. The version is read as
+// branch.CreatedBy.
+func (store *DocumentStore) Fork(ctx context.Context, docID string, version int, branch *models.Document) error {
+	state, err := store.Acquire(ctx, docID)
+	if err != nil {
+		return err
+	}
+	defer store.Release(state)
+	state.Lock()
+	parent := state.Document
+	state.Unlock()
+	if err := requireBranchable(parent); err != nil {
+		return err
+	}
+	snapshot, err := store.contentAt(ctx, state, version, branch.CreatedBy, 0)
+	if err != nil {
+		return err
+	}
+
+	branch.Content = snapshot.Content
+	branch.Version = snapshot.Version
+	branch.Mode = parent.Mode
+	branch.Type = parent.Type
+	branch.ParentID = &parent.ID
+	// a branch is shared like the document it was forked from
+	branch.WorkspaceID = parent.WorkspaceID
+	branch.FolderID = parent.FolderID
+	branch.ForkVersion = snapshot.Version
+	branch.MergeBase = snapshot.Version
+	branch.BranchBase = snapshot.Version
+	if branch.Title == "" {
+		branch.Title = parent.Title
+	}
+	return store.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(branch).Error; err != nil {
+			return fmt.Errorf("failed to save branch: %w", err)
+		}
+		snapshot.ID = 0
+		snapshot.DocID = strconv.FormatUint(uint64(branch.ID), 10)
+		if err := tx.Create(&snapshot).Error; err != nil {
+			return fmt.Errorf("failed to save snapshot: %w", err)
+		}
+		return nil
+	})
+}
+
+// overlaps reports whether two edits in the same context touch the same
+// text: their deleted ranges intersect or one inserts inside text the
+// other deletes. Inserts at the same place are ordered, not conflicting.
+func overlaps(a models.DocumentEvent, b models.DocumentEvent) bool {
+	aStart, aEnd := a.Position, a.Position
+	if a.Operation != "insert" {
+		aEnd += a.Length
+	}
+	bStart, bEnd := b.Position, b.Position
+	if b.Operation != "insert" {
+		bEnd += b.Length
+	}
+	if aStart == aEnd && bStart == bEnd {
+		return false
+	}
+	if aStart == aEnd {
+		return aStart > bStart && aStart < bEnd
+	}
+	if bStart == bEnd {
+		return bStart > aStart && bStart < aEnd
+	}
+	return aStart < bEnd && bStart < aEnd
+}
+
+// rebase transforms the branch's edits over the parent's, both sequences
+// starting from the merge base. The parent's edits are carried along over
+// each branch edit so the next one meets them in its own context; on ties
+// the parent's inserts go first.
+func rebase(branch []models.DocumentEvent, parent []models.DocumentEvent) ([]models.DocumentEvent, []Conflict) {
+	parent = append([]models.DocumentEvent(nil), parent...)
+	rebased := make([]models.DocumentEvent, 0, len(branch))
+	var conflicts []Conflict
+	for _, edit := range branch {
+		for i := range parent {
+			if overlaps(edit, parent[i]) {
+				conflicts = append(conflicts, Conflict{Branch: edit, Parent: parent[i]})
+			}
+			before := edit
+			ProcessTransformation(&edit, parent[i])
+			if !(parent[i].Operation == "insert" && before.Operation == "insert" && parent[i].Position == before.Position) {
+				ProcessTransformation(&parent[i], before)
+			}
+		}
+		rebased = append(rebased, edit)
+	}
+	return rebased, conflicts
+}
+
+// Merge applies the edits a branch made since its merge base to its parent,
+// as one new version of the parent. When edits overlap the merge is
+// refused with ErrMergeConflict unless force is set, in which case the
+// branch's edits are applied over the parent's; the result lists the
+// conflicts either way.
+func (pool *ConnectionPool) Merge(ctx context.Context, branchID string, userID string, force bool) (MergeResult, error) {
+	store := pool.Store
+	tx := store.DB.WithContext(ctx)
+	result := MergeResult{Events: []models.DocumentEvent{}, Conflicts: []Conflict{}}
+	branchState, err := store.Acquire(ctx, branchID)
+	if err != nil {
+		return result, err
+	}
+	defer store.Release(branchState)
+	branchState.Lock()
+	defer branchState.Unlock()
+	branch := branchState.Document
+	if branch.ParentID == nil {
+		return result, fmt.Errorf("%w: document %d is not a branch", ErrNotBranchable, branch.ID)
+	}
+	parentID := strconv.FormatUint(uint64(*branch.ParentID), 10)
+	parentState, err := store.Acquire(ctx, parentID)
+	if err != nil {
+		return result, err
+	}
+	defer store.Release(parentState)
+	defer pool.publishQueued(parentState)
+	parentState.Lock()
+	defer parentState.Unlock()
+	if err := requireBranchable(parentState.Document); err != nil {
+		return result, err
+	}
+
+	branchEvents, err := branchState.EventsSince(tx, branch.BranchBase)
+	if err != nil {
+		return result, err
+	}
+	parentEvents, err := parentState.EventsSince(tx, branch.MergeBase)
+	if err != nil {
+		return result, err
+	}
+	rebased, conflicts := rebase(branchEvents, parentEvents)
+	result.Version = parentState.Document.Version
+	result.Conflicts = append(result.Conflicts, conflicts...)
+	if len(conflicts) > 0 && !force {
+		return result, ErrMergeConflict
+	}
+	if len(rebased) == 0 {
+		return result, nil
+	}
+
+	document := parentState.Document
+	document.Version++
+	now := time.Now()
+	for i := range rebased {
+		rebased[i].ID = 0
+		rebased[i].DocID = parentID
+		rebased[i].Version = document.Version
+		rebased[i].Timestamp = now
+		if rebased[i].UserID == "" {
+			rebased[i].UserID = userID
+		}
+		if err := applyOperation(&document, &rebased[i]); err != nil {
+			return result, fmt.Errorf("failed to apply merged edit: %w", err)
+		}
+	}
+
+	// the new bases are written first so a concurrent merge of the same
+	// branch cannot apply its edits twice
+	update := tx.Model(&models.Document{}).
+		Where("id = ? and merge_base = ? and branch_base = ?", branch.ID, branch.MergeBase, branch.BranchBase).
+		Updates(map[string]interface{}{"merge_base": document.Version, "branch_base": branch.Version})
+	if update.Error != nil {
+		return result, fmt.Errorf("failed to update branch: %w", update.Error)
+	}
+	if update.RowsAffected == 0 {
+		return result, ErrMergeRaced
+	}
+	branchState.Document.MergeBase = document.Version
+	branchState.Document.BranchBase = branch.Version
+	parentState.commit(document, rebased)
+	metrics.EventsProcessed.WithLabelValues("merge").Inc()
+
+	parentState.queueBroadcast(BroadcastMessage{
+		Message: ServerMessage{
+			Type:    BatchMessageType,
+			DocID:   parentID,
+			Version: document.Version,
+			Content: document.Content,
+			Events:  rebased,
+		},
+		DocID:   parentID,
+		Context: ctx,
+	})
+	result.Version = document.Version
+	result.Events = rebased
+	return result, nil
+}
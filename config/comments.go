@@ -0,0 +1,180 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"real-time-collab/models"
+	"real-time-collab/richtext"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidAnchor is returned for a thread whose range does not fit the
+// document or that is anchored to a document comments are not supported on.
+var ErrInvalidAnchor = errors.New("invalid anchor")
+
+// anchor is the range of a thread, kept at the head version of the
+// document while the document is loaded.
+type anchor struct {
+	Start int
+	End   int
+}
+
+// loadAnchors reads the ranges of a document's threads and brings the ones
+// that lag behind up to the document's version.
+func loadAnchors(tx *gorm.DB, document models.Document) (map[uint]*anchor, error) {
+	docID := strconv.FormatUint(uint64(document.ID), 10)
+	var threads []models.Thread
+	err := tx.Select("id", "anchor_start", "anchor_end", "anchor_version").
+		Where("doc_id = ?", docID).
+		Find(&threads).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch threads: %w", err)
+	}
+
+	anchors := make(map[uint]*anchor, len(threads))
+	for _, thread := range threads {
+		current := &anchor{Start: thread.AnchorStart, End: thread.AnchorEnd}
+		if thread.AnchorVersion < document.Version {
+			var events []models.DocumentEvent
+			err := tx.Where("doc_id = ? and version > ? and version <= ?", docID, thread.AnchorVersion, document.Version).
+				Order("version ASC, id ASC").
+				Find(&events).Error
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch document changes: %w", err)
+			}
+			for _, event := range events {
+				shiftAnchors(map[uint]*anchor{thread.ID: current}, event)
+			}
+		}
+		// a thread anchored to edits lost in a crash points past the end
+		current.clamp(documentLength(document))
+		anchors[thread.ID] = current
+	}
+	return anchors, nil
+}
+
+// shiftAnchors moves ranges over a committed event with the same rules the
+// transform uses for concurrent edits: an insert at the start of a range
+// pushes it, an insert at its end does not extend it and a deleted range
+// collapses to where it was. It reports which anchors moved.
+func shiftAnchors(anchors map[uint]*anchor, event models.DocumentEvent) []uint {
+	var moved []uint
+	if event.Operation == DeltaOperation {
+		delta, err := richtext.Parse(event.Delta)
+		if err != nil {
+			return nil
+		}
+		for id, current := range anchors {
+			start := delta.TransformPosition(current.Start, false)
+			end := max(delta.TransformPosition(current.End, true), start)
+			if start != current.Start || end != current.End {
+				current.Start, current.End = start, end
+				moved = append(moved, id)
+			}
+		}
+		return moved
+	}
+	for id, current := range anchors {
+		span := models.DocumentEvent{Operation: "anchor", Position: current.Start, Length: current.End - current.Start}
+		ProcessTransformation(&span, event)
+		if span.Position != current.Start || span.Position+span.Length != current.End {
+			current.Start, current.End = span.Position, span.Position+span.Length
+			moved = append(moved, id)
+		}
+	}
+	return moved
+}
+
+func (current *anchor) clamp(length int) {
+	current.Start = min(max(current.Start, 0), length)
+	current.End = min(max(current.End, current.Start), length)
+}
+
+// documentLength is the length anchors are measured in: bytes of the
+// content of a text document, code points of a rich-text one.
+func documentLength(document models.Document) int {
+	if document.Type == models.DocumentTypeRichText {
+		return len([]rune(document.Content))
+	}
+	return len(document.Content)
+}
+
+// quote returns the text a range of the document covers.
+func quote(document models.Document, current anchor) string {
+	if document.Type == models.DocumentTypeRichText {
+		return string([]rune(document.Content)[current.Start:current.End])
+	}
+	return document.Content[current.Start:current.End]
+}
+
+// AddThread creates a thread with its first comment. The range of the
+// thread is taken relative to thread.AnchorVersion and is moved over the
+// edits made since, so a client can anchor it to what it is showing.
+func (store *DocumentStore) AddThread(ctx context.Context, thread *models.Thread, comment models.Comment) error {
+	state, err := store.Acquire(ctx, thread.DocID)
+	if err != nil {
+		return err
+	}
+	defer store.Release(state)
+	state.Lock()
+	defer state.Unlock()
+
+	if state.CRDT != nil {
+		return fmt.Errorf("%w: comments are not supported on crdt documents", ErrInvalidAnchor)
+	}
+	if thread.AnchorVersion > state.Document.Version {
+		return fmt.Errorf("%w: version %d is ahead of the document (%d)", ErrInvalidAnchor, thread.AnchorVersion, state.Document.Version)
+	}
+	current := anchor{Start: thread.AnchorStart, End: thread.AnchorEnd}
+	if current.Start < 0 || current.End < current.Start {
+		return fmt.Errorf("%w: range %d-%d", ErrInvalidAnchor, current.Start, current.End)
+	}
+	events, err := state.EventsSince(store.DB.WithContext(ctx), thread.AnchorVersion)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		shiftAnchors(map[uint]*anchor{0: &current}, event)
+	}
+	if current.End > documentLength(state.Document) {
+		return fmt.Errorf("%w: range %d-%d is past the end of the document", ErrInvalidAnchor, current.Start, current.End)
+	}
+
+	thread.DocID = strconv.FormatUint(uint64(state.Document.ID), 10)
+	thread.AnchorStart = current.Start
+	thread.AnchorEnd = current.End
+	thread.AnchorVersion = state.Document.Version
+	thread.Quote = quote(state.Document, current)
+	thread.Comments = []models.Comment{comment}
+	// stored relative to the in-memory head, which the document row
+	// catches up with on the next flush
+	if err := store.DB.WithContext(ctx).Create(thread).Error; err != nil {
+		return fmt.Errorf("failed to save thread: %w", err)
+	}
+	state.anchors[thread.ID] = &current
+	return nil
+}
+
+// OverlayThreads replaces the ranges of threads read from the database with
+// the in-memory ones of loaded documents, like Overlay does for content.
+func (store *DocumentStore) OverlayThreads(threads []models.Thread) {
+	for i := range threads {
+		thread := &threads[i]
+		store.mutex.Lock()
+		state, ok := store.documents[thread.DocID]
+		store.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		state.Lock()
+		if current, ok := state.anchors[thread.ID]; ok {
+			thread.AnchorStart = current.Start
+			thread.AnchorEnd = current.End
+			thread.AnchorVersion = state.Document.Version
+		}
+		state.Unlock()
+	}
+}
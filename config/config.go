@@ -1,15 +1,19 @@
 package config
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
 	"os"
+	"real-time-collab/metrics"
 	"real-time-collab/models"
-	"strconv"
+	"real-time-collab/tracing"
 	"sync"
+	"sync/atomic"
+	"time"
     "log/slog"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -29,83 +33,286 @@ func InitDb() *gorm.DB {
 
     db, err := gorm.Open(postgres.Open(connectionDetails), &gorm.Config{})
     if err != nil {
-        log.Fatalf("Error connecting to the database: %v", err)
+        slog.Error("Error connecting to the database", "error", err)
+        os.Exit(1)
     }
 
-    log.Println("Successfully connected to the database")
+    if err := db.Use(tracing.GormPlugin{}); err != nil {
+        slog.Error("Error registering the tracing plugin", "error", err)
+        os.Exit(1)
+    }
+
+    slog.Info("Successfully connected to the database")
     return db
 }
 
 type ConnectionPool struct{
-    Connections map[*websocket.Conn]bool
+    Connections map[*websocket.Conn]*Client
+    // Rooms maps a document id to the connections editing or viewing it
+    Rooms map[string]map[*websocket.Conn]*Client
     sync.Mutex
+    // Broadcast is sent to through send, which stops once Shutdown closes it
     Broadcast chan BroadcastMessage
+    broadcastMutex sync.RWMutex
+    broadcastClosed bool
     MessageQueue chan QueuedMessage
-
+    Settings ConnectionSettings
+    // Store holds the authoritative state of the documents being edited
+    Store *DocumentStore
+
+    // closing is set once Shutdown starts, after which no connection is accepted
+    closing atomic.Bool
+    readers sync.WaitGroup
+    workers sync.WaitGroup
+    aliveWorkers atomic.Int32
+    broadcasterDone chan struct{}
 }
 
 type QueuedMessage struct {
     Data []byte
     Sender *websocket.Conn
+    // Codec decodes Data according to the sender's subprotocol
+    Codec Codec
+    // Logger carries the connection id of the sender
+    Logger *slog.Logger
+    // Context carries the span that follows the message through the workers
+    Context context.Context
+    // Principal is the sender's, nil for anonymous connections
+    Principal *Principal
 }
 
+// BroadcastMessage is encoded once per protocol in use by the recipients.
 type BroadcastMessage struct {
-    Data []byte
+    Message ServerMessage
+    DocID string
     ExcludeConn *websocket.Conn
+    Context context.Context
 }
 
 
 func NewConnectionPool(workers int, DB *gorm.DB) *ConnectionPool{
+    settings := LoadConnectionSettings()
     pool :=  &ConnectionPool{
-        Connections: make(map[*websocket.Conn]bool),
-        Broadcast: make(chan BroadcastMessage),
-        MessageQueue: make(chan QueuedMessage),
+        Connections: make(map[*websocket.Conn]*Client),
+        Rooms: make(map[string]map[*websocket.Conn]*Client),
+        // room for a broadcast per queued message, so a slow client does
+        // not stall the workers right away
+        Broadcast: make(chan BroadcastMessage, settings.QueueSize),
+        MessageQueue: make(chan QueuedMessage, settings.QueueSize),
+        Settings: settings,
+        Store: NewDocumentStore(DB, LoadStoreSettings()),
+        broadcasterDone: make(chan struct{}),
     }
+    metrics.RegisterQueueDepth(func() int { return len(pool.MessageQueue) })
     for i:= 0;i <workers;i++{
+        pool.workers.Add(1)
         go pool.worker(i,DB)
     }
     return pool
 }
 
 func (pool *ConnectionPool) worker(worker int, DB *gorm.DB) {
+    pool.aliveWorkers.Add(1)
+    defer pool.workers.Done()
+    defer pool.aliveWorkers.Add(-1)
     for message := range pool.MessageQueue {
-        var documentEvent models.DocumentEvent
-        var document models.Document
-        var broadcastMessage BroadcastMessage
-        
-        if err := json.Unmarshal(message.Data, &documentEvent); err != nil {
-            log.Printf("worker %d: failed to unmarshal data: %v", worker, err)
-            continue
-        }
-        
-        if err := validateDocumentEvent(&documentEvent); err != nil {
-            log.Printf("worker %d: invalid document event: %v", worker, err)
-            continue
+        logger := message.Logger
+        if logger == nil {
+            logger = slog.Default()
         }
-        
-        if err := transformDocumentEvent(&documentEvent, DB, &document); err != nil {
-            log.Printf("worker %d: transformation failed: %v", worker, err)
-            continue
+        ctx := message.Context
+        if ctx == nil {
+            ctx = context.Background()
         }
-        
-        if err := PersistData(&documentEvent, DB, &document); err != nil {
-            log.Printf("worker %d: failed to persist data: %v", worker, err)
-            continue
+        span := trace.SpanFromContext(ctx)
+        span.AddEvent("dequeued", trace.WithAttributes(attribute.Int("worker", worker)))
+
+        err := pool.safeProcessMessage(ctx, message, logger.With("worker", worker), DB)
+        tracing.EndSpan(span, err)
+    }
+}
+
+// safeProcessMessage keeps a single malformed message from taking the
+// worker, and with it the whole process, down.
+func (pool *ConnectionPool) safeProcessMessage(ctx context.Context, message QueuedMessage, logger *slog.Logger, DB *gorm.DB) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            logger.Error("Recovered from panic while processing message", "panic", r)
+            err = fmt.Errorf("panic: %v", r)
         }
+    }()
+    return pool.processMessage(ctx, message, logger, DB)
+}
 
-        //we need to set the document content newly edited to be the content the client gets. I fucked up
-        documentEvent.Content = document.Content
-        slog.Info("The document event being sent to the server is %v", documentEvent)
-        transformedMsg, err := json.Marshal(documentEvent)
+// processMessage handles a single queued websocket message. The returned
+// error has already been logged and is only recorded on the message span.
+func (pool *ConnectionPool) processMessage(ctx context.Context, message QueuedMessage, logger *slog.Logger, DB *gorm.DB) error {
+    codec := message.Codec
+    if codec == nil {
+        codec = CodecFor("")
+    }
+    clientMessage, err := codec.Decode(message.Data)
+    if err != nil {
+        logger.Warn("failed to unmarshal data", "protocol", codec.Subprotocol(), "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonInvalidMessage).Inc()
+        return err
+    }
+
+    if err := pool.authorize(ctx, message, &clientMessage, DB); err != nil {
+        logger.Warn("message refused", "type", clientMessage.Type, "doc_id", clientMessage.DocID, "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonForbidden).Inc()
+        pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: clientMessage.DocID, Error: err.Error()})
+        return err
+    }
+
+    switch clientMessage.Type {
+    case BatchMessageType:
+        if err := pool.applyBatch(ctx, message.Sender, clientMessage, DB); err != nil {
+            logger.Warn("batch rejected", "doc_id", clientMessage.DocID, "operations", len(clientMessage.Operations), "error", err)
+            metrics.EventsRejected.WithLabelValues(metrics.ReasonBatchFailed).Inc()
+            pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: clientMessage.DocID, Error: err.Error()})
+            return err
+        }
+        return nil
+    case ResumeMessageType:
+        if err := pool.resume(ctx, message.Sender, clientMessage, DB); err != nil {
+            logger.Warn("resume failed", "doc_id", clientMessage.DocID, "error", err)
+            metrics.EventsRejected.WithLabelValues(metrics.ReasonResumeFailed).Inc()
+            pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: clientMessage.DocID, Error: err.Error()})
+            return err
+        }
+        return nil
+    case SuggestMessageType:
+        if err := pool.suggest(ctx, message.Sender, clientMessage, DB); err != nil {
+            logger.Warn("suggestion rejected", "doc_id", clientMessage.DocID, "error", err)
+            metrics.EventsRejected.WithLabelValues(metrics.ReasonSuggestionFailed).Inc()
+            pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: clientMessage.DocID, Error: err.Error()})
+            return err
+        }
+        return nil
+    case DeltaMessageType:
+        if err := pool.applyDelta(ctx, message.Sender, clientMessage, DB); err != nil {
+            logger.Warn("delta rejected", "doc_id", clientMessage.DocID, "error", err)
+            metrics.EventsRejected.WithLabelValues(metrics.ReasonDeltaFailed).Inc()
+            pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: clientMessage.DocID, Error: err.Error()})
+            return err
+        }
+        return nil
+    case CRDTUpdateMessageType, CRDTSyncMessageType:
+        if clientMessage.Type == CRDTUpdateMessageType {
+            err = pool.applyCRDTUpdate(ctx, message.Sender, clientMessage)
+        } else {
+            err = pool.syncCRDT(ctx, message.Sender, clientMessage)
+        }
         if err != nil {
-            log.Printf("worker %d: failed to marshal transformed event: %v", worker, err)
-            continue
+            logger.Warn("crdt message rejected", "type", clientMessage.Type, "doc_id", clientMessage.DocID, "error", err)
+            metrics.EventsRejected.WithLabelValues(metrics.ReasonCRDTFailed).Inc()
+            pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: clientMessage.DocID, Error: err.Error()})
+            return err
         }
-        broadcastMessage.Data = transformedMsg
-        broadcastMessage.ExcludeConn = message.Sender
-        
-        pool.Broadcast <- broadcastMessage
+        return nil
+    case OperationMessageType:
+    default:
+        err := fmt.Errorf("unknown message type %q", clientMessage.Type)
+        logger.Warn("failed to unmarshal data", "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonInvalidMessage).Inc()
+        pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: clientMessage.DocID, Error: err.Error()})
+        return err
+    }
+
+    documentEvent := *clientMessage.Event
+    var broadcastMessage BroadcastMessage
+
+    logger = logger.With("doc_id", documentEvent.DocID, "user_id", documentEvent.UserID)
+    span := trace.SpanFromContext(ctx)
+    span.SetAttributes(
+        attribute.String("doc.id", documentEvent.DocID),
+        attribute.String("user.id", documentEvent.UserID),
+        attribute.String("event.operation", documentEvent.Operation),
+        attribute.Int("event.base_version", documentEvent.Version),
+    )
+
+    if err := validateDocumentEvent(&documentEvent); err != nil {
+        logger.Warn("invalid document event", "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonInvalidEvent).Inc()
+        return err
+    }
+
+    state, err := pool.Store.Acquire(ctx, documentEvent.DocID)
+    if err != nil {
+        logger.Warn("failed to load document", "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonTransformFailed).Inc()
+        return err
+    }
+    defer pool.Store.Release(state)
+    // the broadcast is queued under the lock, which keeps a document's events
+    // in order, and sent once the lock is released
+    defer pool.publishQueued(state)
+    state.Lock()
+    defer state.Unlock()
+    err = requireMode(state, models.DocumentModeOT)
+    if err == nil {
+        err = requireType(state, models.DocumentTypeText)
+    }
+    if err != nil {
+        logger.Warn("operation rejected", "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonWrongMode).Inc()
+        pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: documentEvent.DocID, Error: err.Error()})
+        return err
+    }
+
+    if documentEvent.Version > state.Document.Version {
+        err = fmt.Errorf("base version %d is ahead of the document (%d)", documentEvent.Version, state.Document.Version)
+        logger.Warn("operation rejected", "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonTransformFailed).Inc()
+        pool.SendTo(message.Sender, ServerMessage{Type: ErrorMessageType, DocID: documentEvent.DocID, Error: err.Error()})
+        return err
+    }
+
+    transformStart := time.Now()
+    transformCtx, transformSpan := tracing.Tracer.Start(ctx, "transform")
+    err = transformDocumentEvent(&documentEvent, state, DB.WithContext(transformCtx))
+    tracing.EndSpan(transformSpan, err)
+    if err != nil {
+        logger.Warn("transformation failed", "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonTransformFailed).Inc()
+        return err
+    }
+    metrics.TransformDuration.Observe(time.Since(transformStart).Seconds())
+
+    // the event is committed in memory here and written to the database
+    // by the store's flusher
+    _, applySpan := tracing.Tracer.Start(ctx, "apply")
+    document := state.Document
+    err = applyChangesToDocument(&document, &documentEvent)
+    tracing.EndSpan(applySpan, err)
+    if err != nil {
+        logger.Warn("failed to apply event", "error", err)
+        metrics.EventsRejected.WithLabelValues(metrics.ReasonApplyFailed).Inc()
+        return err
+    }
+    state.commit(document, []models.DocumentEvent{documentEvent})
+    metrics.EventsProcessed.WithLabelValues(documentEvent.Operation).Inc()
+    span.SetAttributes(attribute.Int("event.version", documentEvent.Version))
+
+    pool.JoinRoom(message.Sender, documentEvent.DocID, documentEvent.UserID)
+
+    // legacy clients get the newly edited document content in place of the
+    // operation's content, see legacyCodec
+    logger.Debug("broadcasting document event", "event", documentEvent)
+    broadcastMessage.Message = ServerMessage{
+        Type: OperationMessageType,
+        DocID: documentEvent.DocID,
+        Version: document.Version,
+        Content: document.Content,
+        Events: []models.DocumentEvent{documentEvent},
     }
+    broadcastMessage.DocID = documentEvent.DocID
+    broadcastMessage.ExcludeConn = message.Sender
+    broadcastMessage.Context = ctx
+
+    state.queueBroadcast(broadcastMessage)
+    return nil
 }
 
 func validateDocumentEvent(event *models.DocumentEvent) error {
@@ -118,143 +325,220 @@ func validateDocumentEvent(event *models.DocumentEvent) error {
     return nil
 }
 
-func transformDocumentEvent(CurrentDocumentEvent *models.DocumentEvent, DB *gorm.DB, Document *models.Document) error  {
-    DB.Transaction( func(tx *gorm.DB) error {
-        docID, err := strconv.ParseUint(CurrentDocumentEvent.DocID, 10, 64)
-        if err!= nil{
-            return fmt.Errorf("failed to parse document id")
-        }
-        err= tx.First(Document,"id =?",docID).Error
+// transformDocumentEvent rebases an event made against an older version
+// over the events committed since. The state must be locked.
+func transformDocumentEvent(CurrentDocumentEvent *models.DocumentEvent, state *DocumentState, DB *gorm.DB) error  {
+    if CurrentDocumentEvent.Version < state.Document.Version{
+        prevDocumentChanges, err := state.EventsSince(DB, CurrentDocumentEvent.Version)
         if err!= nil{
-            return fmt.Errorf("failed to fetch document: %w", err)
+            return err
         }
-        if CurrentDocumentEvent.Version < Document.Version{
-            var prevDocumentChanges []models.DocumentEvent
-            err = tx.Where("doc_id = ? and version > ?", CurrentDocumentEvent.DocID, CurrentDocumentEvent.Version).
-            Order("version ASC").
-            Find(&prevDocumentChanges).Error
-            if err!= nil{
-                return fmt.Errorf("failed to fetch previous document changes: %w", err)
-            }
-            for _,DocumentChange:= range prevDocumentChanges{
-                ProcessTransformation(CurrentDocumentEvent,DocumentChange,Document)
-            }
-
+        for _,DocumentChange:= range prevDocumentChanges{
+            ProcessTransformation(CurrentDocumentEvent,DocumentChange)
         }
-        return nil
-    })
+    }
     return nil
 }
 
-func ProcessTransformation(current *models.DocumentEvent, previous models.DocumentEvent, doc *models.Document) {
-    switch {
-    case current.Operation == "insert" && previous.Operation == "insert":
-        slog.Info("current position: %v previous position: %v previous length: %v",current.Position,previous.Position,previous.Length)
-        if current.Position > (previous.Position + len(doc.Content)) {
-            current.Position += previous.Length
-        }
+// ProcessTransformation rewrites current so that it applies on top of
+// previous, an event that was committed after current's base version.
+// When both insert at the same position the committed insert goes first.
+func ProcessTransformation(current *models.DocumentEvent, previous models.DocumentEvent) {
+    switch previous.Operation {
+    case "insert":
+        shiftForInsert(current, previous.Position, len(previous.Content))
+    case "delete":
+        shiftForDelete(current, previous.Position, previous.Length)
+    case "replace":
+        shiftForDelete(current, previous.Position, previous.Length)
+        shiftForInsert(current, previous.Position, len(previous.Content))
+    }
+}
 
-    case current.Operation == "insert" && previous.Operation == "delete":
-        if current.Position >(previous.Position + len(doc.Content)) {
-            current.Position -= previous.Length
+func shiftForInsert(current *models.DocumentEvent, at int, length int) {
+    if current.Operation == "insert" {
+        if at <= current.Position {
+            current.Position += length
         }
-    case current.Operation == "delete" && previous.Operation == "insert":
-        if current.Position > (previous.Position + len(doc.Content)) {
-            current.Position += previous.Length
-        }
-    case current.Operation == "delete" && previous.Operation == "delete":
-        if current.Position > (previous.Position + len(doc.Content)) {
-            current.Position -= previous.Length
+        return
+    }
+    if at <= current.Position {
+        current.Position += length
+    } else if at < current.Position+current.Length {
+        // the insert landed inside the range, so the range grows around it
+        current.Length += length
+    }
+}
+
+func shiftForDelete(current *models.DocumentEvent, at int, length int) {
+    shift := func(position int) int {
+        switch {
+        case position <= at:
+            return position
+        case position < at+length:
+            return at
+        default:
+            return position - length
         }
     }
+    if current.Operation == "insert" {
+        current.Position = shift(current.Position)
+        return
+    }
+    start := shift(current.Position)
+    end := shift(current.Position + current.Length)
+    current.Position = start
+    current.Length = end - start
 }
 
 func (pool *ConnectionPool) StartBroadcasting(){
-    for{
-        log.Printf("started broadcasting messages")
-        message := <-pool.Broadcast
-        log.Printf("message: %v",message)
-        pool.Mutex.Lock()
-        for connection:= range pool.Connections{
-            if connection == message.ExcludeConn{
-                slog.Info("The excluded connection is : {}", connection)
-                continue
+    slog.Info("started broadcasting messages")
+    defer close(pool.broadcasterDone)
+    for message := range pool.Broadcast {
+        ctx := message.Context
+        if ctx == nil {
+            ctx = context.Background()
+        }
+        recipients := pool.recipients(message)
+        _, span := tracing.Tracer.Start(ctx, "broadcast", trace.WithAttributes(
+            attribute.String("doc.id", message.DocID),
+            attribute.Int("broadcast.fanout", len(recipients)),
+        ))
+        metrics.BroadcastFanout.Observe(float64(len(recipients)))
+        encoded := make(map[string][]byte)
+        for _, client := range recipients {
+            data, ok := encoded[client.Codec.Subprotocol()]
+            if !ok {
+                var err error
+                data, err = client.Codec.Encode(message.Message)
+                if err != nil {
+                    client.Logger.Error("failed to encode broadcast", "protocol", client.Codec.Subprotocol(), "error", err)
+                    continue
+                }
+                encoded[client.Codec.Subprotocol()] = data
             }
-
-            slog.Info("Sending the message as : {}", string(message.Data))
-            err:= connection.WriteMessage(websocket.TextMessage,message.Data)
+            err:= client.Write(client.Codec.FrameType(), data, pool.Settings.WriteWait)
             if(err != nil){
-                log.Printf("Error writing message: %v", err)
-                connection.Close()
-                delete(pool.Connections, connection)
+                client.Logger.Warn("Error writing message", "error", err)
+                span.AddEvent("write failed", trace.WithAttributes(attribute.String("conn.id", client.ID)))
+                pool.RemoveConnection(client.Conn)
             }
         }
-        pool.Mutex.Unlock()
+        span.End()
     }
 }
 
+// recipients snapshots the connections a broadcast goes to so that slow
+// writes do not hold the pool lock. Only the connections in the room of
+// the document receive it.
+func (pool *ConnectionPool) recipients(message BroadcastMessage) []*Client {
+    pool.Mutex.Lock()
+    defer pool.Mutex.Unlock()
+    var clients []*Client
+    now := time.Now()
+    for connection, client := range pool.Rooms[message.DocID]{
+        if connection == message.ExcludeConn{
+            continue
+        }
+        //keepAlive closes the connection of an expired token or share link on its next tick
+        if client.Principal != nil && client.Principal.Expired(now){
+            continue
+        }
+        clients = append(clients, client)
+    }
+    return clients
+}
 
-func (pool *ConnectionPool) ReadMessage(connection *websocket.Conn, DB *gorm.DB){
-     defer func() {
+
+// RateLimitedReason is sent with the close frame of a connection over its op budget
+const RateLimitedReason = "rate limit exceeded"
+
+func (pool *ConnectionPool) ReadMessage(client *Client, DB *gorm.DB){
+    connection := client.Conn
+    done := make(chan struct{})
+    defer func() {
         if r := recover(); r != nil {
-            log.Printf("Recovered from panic: %v", r)
-            pool.Mutex.Lock()
-            delete(pool.Connections, connection)
-            pool.Mutex.Unlock()
-            connection.Close()
+            client.Logger.Error("Recovered from panic", "panic", r)
+        }
+        close(done)
+        // during shutdown the connection stays open until it has been sent a close frame
+        if !pool.closing.Load() {
+            pool.RemoveConnection(connection)
         }
+        pool.readers.Done()
     }()
+
+    connection.SetReadLimit(pool.Settings.MaxMessageSize)
+    connection.SetReadDeadline(time.Now().Add(pool.Settings.PongWait))
+    connection.SetPongHandler(func(string) error {
+        return connection.SetReadDeadline(time.Now().Add(pool.Settings.PongWait))
+    })
+    go pool.keepAlive(client, done)
+
     for{
-        log.Printf("trying to read message")
         _,message,err := connection.ReadMessage()
-        slog.Info("Message recieved via websocket: {}", string(message))
         if err != nil {
             if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-                log.Printf("Error reading message: %v", err)
+                client.Logger.Warn("Error reading message", "error", err)
             }
             return
         }
+        connection.SetReadDeadline(time.Now().Add(pool.Settings.PongWait))
+        client.touch()
+        if !client.limiter.Allow() {
+            // the client is expected to back off, reconnect and resume with the
+            // operations it buffered in the meantime
+            client.Logger.Warn("websocket rate limit exceeded, closing connection")
+            metrics.EventsRejected.WithLabelValues(metrics.ReasonRateLimited).Inc()
+            connection.WriteControl(websocket.CloseMessage,
+                websocket.FormatCloseMessage(websocket.ClosePolicyViolation, RateLimitedReason),
+                time.Now().Add(pool.Settings.WriteWait))
+            return
+        }
+        client.Logger.Debug("Message recieved via websocket", "bytes", len(message))
+        // every message starts its own trace, linked to the upgrade request
+        ctx, _ := tracing.Tracer.Start(context.Background(), "ws.message",
+            trace.WithNewRoot(),
+            trace.WithLinks(trace.Link{SpanContext: client.SpanContext}),
+            trace.WithAttributes(
+                attribute.String("conn.id", client.ID),
+                attribute.Int("message.size", len(message)),
+            ),
+        )
+        trace.SpanFromContext(ctx).AddEvent("queued", trace.WithAttributes(attribute.Int("queue.depth", len(pool.MessageQueue))))
         pool.MessageQueue <- QueuedMessage{
             Data: message,
             Sender: connection,
+            Codec: client.Codec,
+            Logger: client.Logger,
+            Context: ctx,
+            Principal: client.Principal,
         }
     }
 }
 
 
-func PersistData(DocumentEvent *models.DocumentEvent, db *gorm.DB, Document *models.Document) error {
-    return db.Transaction(func(tx *gorm.DB) error {
-        if err := PersistDocumentSnapshot(DocumentEvent, tx, Document); err != nil {
-            return fmt.Errorf("failed to update document: %w", err)
-        }
-        if err := tx.Create(&DocumentEvent).Error; err != nil {
-            return fmt.Errorf("failed to save event: %w", err)
-        }
-        return nil
-    })
-}
-
-
-func PersistDocumentSnapshot(event *models.DocumentEvent, db *gorm.DB, Doc *models.Document) error {
-    if err := applyChangesToDocument(Doc, event); err != nil {
-        return fmt.Errorf("failed to apply changes: %w", err)
-    }
-    return db.Save(Doc).Error
-}
-
 func applyChangesToDocument(doc *models.Document, event *models.DocumentEvent) error {
     if event.Position < 0 || event.Position > len(doc.Content) {
         return fmt.Errorf("invalid position for character : %v position: %d (content length: %d)",event.Content, event.Position, len(doc.Content))
     }
 
-    
-    if(event.Version>doc.Version){
-        doc.Version = event.Version
-    }else{
-        doc.Version = doc.Version+1
-        event.Version = doc.Version
+    // the event was rebased onto the head, clients do not pick its version
+    if event.Version > doc.Version{
+        return fmt.Errorf("base version %d is ahead of the document (%d)", event.Version, doc.Version)
     }
+    doc.Version = doc.Version+1
+    event.Version = doc.Version
+
+    return applyOperation(doc, event)
+}
 
+// applyOperation applies the edit of event to the content of doc without
+// touching its version.
+func applyOperation(doc *models.Document, event *models.DocumentEvent) error {
+    if event.Position < 0 || event.Position > len(doc.Content) {
+        return fmt.Errorf("invalid position %d (content length: %d)", event.Position, len(doc.Content))
+    }
     switch event.Operation {
     case "insert":
         return applyInsert(doc, event)
@@ -0,0 +1,341 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"real-time-collab/logging"
+	"real-time-collab/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// ConnectionSettings controls how long a websocket connection may stay silent
+// before the server considers it dead and evicts it from the pool.
+type ConnectionSettings struct {
+	// PingInterval is how often the server sends a ping frame.
+	PingInterval time.Duration
+	// PongWait is how long the server waits for any frame (pong included)
+	// before the read deadline expires.
+	PongWait time.Duration
+	// WriteWait bounds a single write to the peer.
+	WriteWait time.Duration
+	// MaxMessageSize is the largest message in bytes a client may send.
+	MaxMessageSize int64
+	// IdleTimeout evicts connections that keep answering pings but have not
+	// sent an application message for this long. Zero disables it.
+	IdleTimeout time.Duration
+	// MaxCatchUpEvents is how many missed events a resuming client is sent
+	// before the server falls back to a full snapshot.
+	MaxCatchUpEvents int
+	// QueueSize is how many messages may wait for a worker before readers block.
+	QueueSize int
+	// ShutdownTimeout bounds how long draining may take on shutdown.
+	ShutdownTimeout time.Duration
+	// OpsPerSecond and OpsBurst limit how many messages a single connection
+	// may send. A connection over budget is closed with ClosePolicyViolation.
+	OpsPerSecond float64
+	OpsBurst     int
+	// MaxBatchOperations is the most operations a single batch may carry.
+	MaxBatchOperations int
+}
+
+// LoadConnectionSettings reads the websocket settings from the environment,
+// falling back to defaults for anything that is unset or malformed.
+func LoadConnectionSettings() ConnectionSettings {
+	settings := ConnectionSettings{
+		PingInterval:       getEnvDuration("WS_PING_INTERVAL", 30*time.Second),
+		PongWait:           getEnvDuration("WS_PONG_WAIT", 60*time.Second),
+		WriteWait:          getEnvDuration("WS_WRITE_WAIT", 10*time.Second),
+		MaxMessageSize:     getEnvInt64("WS_MAX_MESSAGE_SIZE", 64*1024),
+		IdleTimeout:        getEnvDuration("WS_IDLE_TIMEOUT", 30*time.Minute),
+		MaxCatchUpEvents:   int(getEnvInt64("WS_MAX_CATCHUP_EVENTS", 500)),
+		QueueSize:          int(getEnvInt64("MESSAGE_QUEUE_SIZE", 1024)),
+		ShutdownTimeout:    getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		OpsPerSecond:       getEnvFloat("WS_OPS_PER_SECOND", 30),
+		OpsBurst:           int(getEnvInt64("WS_OPS_BURST", 120)),
+		MaxBatchOperations: int(getEnvInt64("WS_MAX_BATCH_OPERATIONS", 500)),
+	}
+	// a ping has to go out before the read deadline it is meant to extend
+	if settings.PingInterval >= settings.PongWait {
+		settings.PingInterval = settings.PongWait * 9 / 10
+		slog.Warn("WS_PING_INTERVAL must be shorter than WS_PONG_WAIT", "using", settings.PingInterval)
+	}
+	return settings
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		slog.Warn("invalid duration", "key", key, "value", value, "using", fallback)
+		return fallback
+	}
+	return duration
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number <= 0 {
+		slog.Warn("invalid number", "key", key, "value", value, "using", fallback)
+		return fallback
+	}
+	return number
+}
+
+// Client is the server side state of a single websocket connection.
+type Client struct {
+	// ID correlates the log lines of one connection
+	ID   string
+	Conn *websocket.Conn
+	// Logger carries the connection and upgrade request ids
+	Logger *slog.Logger
+	// Codec encodes and decodes messages for the negotiated subprotocol
+	Codec Codec
+	// SpanContext is the span of the upgrade request, linked from message spans
+	SpanContext trace.SpanContext
+	// UserID is the user the connection last edited as, used for presence
+	UserID string
+	// Rooms holds the document ids the connection has joined
+	Rooms map[string]bool
+	// Principal is who the connection authenticated as, nil for anonymous
+	// connections; its messages are checked against it
+	Principal *Principal
+
+	// limiter enforces the per connection op rate
+	limiter *rate.Limiter
+	// access caches the connection's permission on the documents it used
+	access      map[string]documentAccess
+	accessMutex sync.Mutex
+
+	writeMutex sync.Mutex
+	// lastActivity is the unix nano time of the last application message
+	lastActivity atomic.Int64
+}
+
+func NewClient(connection *websocket.Conn, logger *slog.Logger) *Client {
+	id := logging.NewID()
+	client := &Client{
+		ID:     id,
+		Conn:   connection,
+		Logger: logger.With("conn_id", id, "protocol", connection.Subprotocol()),
+		Codec:  CodecFor(connection.Subprotocol()),
+		Rooms:  make(map[string]bool),
+		access: make(map[string]documentAccess),
+	}
+	client.touch()
+	return client
+}
+
+// Write sends a single message to the client. Gorilla allows only one
+// concurrent writer per connection so all data frames go through here.
+func (client *Client) Write(messageType int, data []byte, writeWait time.Duration) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+	client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return client.Conn.WriteMessage(messageType, data)
+}
+
+// AddConnection registers a freshly upgraded connection, authenticated as
+// principal, with the pool and optionally joins it to a document room right
+// away. It returns nil once the pool is shutting down.
+func (pool *ConnectionPool) AddConnection(connection *websocket.Conn, docID string, principal *Principal, logger *slog.Logger) *Client {
+	client := NewClient(connection, logger)
+	client.Principal = principal
+	client.limiter = rate.NewLimiter(rate.Limit(pool.Settings.OpsPerSecond), pool.Settings.OpsBurst)
+	pool.Mutex.Lock()
+	if pool.closing.Load() {
+		pool.Mutex.Unlock()
+		return nil
+	}
+	// every registered connection gets a ReadMessage loop that Shutdown waits for
+	pool.readers.Add(1)
+	pool.Connections[connection] = client
+	metrics.ActiveConnections.Inc()
+	if docID != "" {
+		pool.joinRoomLocked(client, docID, "")
+	}
+	pool.Mutex.Unlock()
+	return client
+}
+
+// JoinRoom adds the connection to the room of a document so it receives the
+// document's broadcasts and shows up in its presence list.
+func (pool *ConnectionPool) JoinRoom(connection *websocket.Conn, docID string, userID string) {
+	pool.Mutex.Lock()
+	defer pool.Mutex.Unlock()
+	client, ok := pool.Connections[connection]
+	if !ok {
+		// the connection was evicted while its message was in the queue
+		return
+	}
+	pool.joinRoomLocked(client, docID, userID)
+}
+
+func (pool *ConnectionPool) joinRoomLocked(client *Client, docID string, userID string) {
+	if userID != "" {
+		client.UserID = userID
+	}
+	room, ok := pool.Rooms[docID]
+	if !ok {
+		room = make(map[*websocket.Conn]*Client)
+		pool.Rooms[docID] = room
+	}
+	if _, joined := room[client.Conn]; !joined {
+		metrics.DocumentConnections.WithLabelValues(docID).Inc()
+	}
+	room[client.Conn] = client
+	client.Rooms[docID] = true
+}
+
+// RemoveConnection drops the connection from the pool, from every room it
+// joined and closes it. It is safe to call more than once.
+func (pool *ConnectionPool) RemoveConnection(connection *websocket.Conn) {
+	pool.Mutex.Lock()
+	client, ok := pool.Connections[connection]
+	if ok {
+		for docID := range client.Rooms {
+			delete(pool.Rooms[docID], connection)
+			if len(pool.Rooms[docID]) == 0 {
+				delete(pool.Rooms, docID)
+				metrics.DocumentConnections.DeleteLabelValues(docID)
+			} else {
+				metrics.DocumentConnections.WithLabelValues(docID).Dec()
+			}
+		}
+		delete(pool.Connections, connection)
+		metrics.ActiveConnections.Dec()
+	}
+	pool.Mutex.Unlock()
+	connection.Close()
+}
+
+// ShareClosedReason is sent with the close frame of connections whose share
+// link was revoked or expired.
+const ShareClosedReason = "share link revoked or expired"
+
+// TokenClosedReason is sent with the close frame of connections whose API
+// token was revoked or expired.
+const TokenClosedReason = "api token revoked or expired"
+
+// closedReason is the close reason for a connection whose API token or share
+// link stopped working.
+func closedReason(principal *Principal) string {
+	if principal.TokenID != 0 {
+		return TokenClosedReason
+	}
+	return ShareClosedReason
+}
+
+// CloseToken closes the connections opened with an API token, once it has
+// been revoked. It returns how many were closed.
+func (pool *ConnectionPool) CloseToken(tokenID uint) int {
+	return pool.closeMatching(websocket.ClosePolicyViolation, TokenClosedReason, func(client *Client) bool {
+		return client.Principal != nil && client.Principal.TokenID == tokenID
+	})
+}
+
+// CloseShare closes the connections opened with a share link, once it has
+// been revoked. It returns how many were closed.
+func (pool *ConnectionPool) CloseShare(shareID uint) int {
+	return pool.closeMatching(websocket.ClosePolicyViolation, ShareClosedReason, func(client *Client) bool {
+		return client.Principal != nil && client.Principal.ShareID == shareID
+	})
+}
+
+// closeMatching sends the connections match picks a close frame and closes
+// them.
+func (pool *ConnectionPool) closeMatching(code int, reason string, match func(client *Client) bool) int {
+	pool.Mutex.Lock()
+	connections := make([]*websocket.Conn, 0)
+	for connection, client := range pool.Connections {
+		if match(client) {
+			connections = append(connections, connection)
+		}
+	}
+	pool.Mutex.Unlock()
+
+	message := websocket.FormatCloseMessage(code, reason)
+	for _, connection := range connections {
+		err := connection.WriteControl(websocket.CloseMessage, message, time.Now().Add(pool.Settings.WriteWait))
+		if err != nil {
+			slog.Debug("failed to send close frame", "error", err)
+		}
+		pool.RemoveConnection(connection)
+	}
+	return len(connections)
+}
+
+// Presence returns the distinct users currently connected to a document.
+func (pool *ConnectionPool) Presence(docID string) []string {
+	pool.Mutex.Lock()
+	defer pool.Mutex.Unlock()
+	seen := make(map[string]bool)
+	users := []string{}
+	for _, client := range pool.Rooms[docID] {
+		if client.UserID == "" || seen[client.UserID] {
+			continue
+		}
+		seen[client.UserID] = true
+		users = append(users, client.UserID)
+	}
+	return users
+}
+
+// keepAlive pings the client until done is closed. It closes the connection
+// when a ping cannot be written or the client has been idle for too long,
+// which makes the blocked ReadMessage return and clean up.
+func (pool *ConnectionPool) keepAlive(client *Client, done <-chan struct{}) {
+	ticker := time.NewTicker(pool.Settings.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// WriteControl may be called concurrently with WriteMessage
+			err := client.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pool.Settings.WriteWait))
+			if err != nil {
+				client.Logger.Info("ping failed, closing connection", "error", err)
+				client.Conn.Close()
+				return
+			}
+			if client.Principal != nil && client.Principal.Expired(time.Now()) {
+				client.Logger.Info("closing connection of expired credential", "share_id", client.Principal.ShareID, "api_token_id", client.Principal.TokenID)
+				client.Conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, closedReason(client.Principal)),
+					time.Now().Add(pool.Settings.WriteWait))
+				client.Conn.Close()
+				return
+			}
+			if pool.Settings.IdleTimeout > 0 && client.idleFor() > pool.Settings.IdleTimeout {
+				client.Logger.Info("closing idle connection", "idle", client.idleFor())
+				client.Conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout"),
+					time.Now().Add(pool.Settings.WriteWait))
+				client.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (client *Client) touch() {
+	client.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (client *Client) idleFor() time.Duration {
+	return time.Since(time.Unix(0, client.lastActivity.Load()))
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"real-time-collab/metrics"
+	"real-time-collab/models"
+	"real-time-collab/tracing"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requireMode rejects a message meant for the other editing mode. The
+// state must be locked.
+func requireMode(state *DocumentState, mode string) error {
+	current := state.Document.Mode
+	if current == "" {
+		current = models.DocumentModeOT
+	}
+	if current != mode {
+		return fmt.Errorf("document %d is in %s mode", state.Document.ID, current)
+	}
+	return nil
+}
+
+// applyCRDTUpdate merges an update from a replica into the server's replica
+// and relays it to the room. Updates are idempotent and commutative, so
+// there is nothing to transform; parts whose origin has not arrived yet are
+// held back by the replica until it does.
+func (pool *ConnectionPool) applyCRDTUpdate(ctx context.Context, sender *websocket.Conn, request ClientMessage) error {
+	if request.Update == nil || request.Update.Empty() {
+		return fmt.Errorf("crdt_update without update")
+	}
+	ctx, span := tracing.Tracer.Start(ctx, "crdt.update", trace.WithAttributes(
+		attribute.String("doc.id", request.DocID),
+		attribute.Int("crdt.inserts", len(request.Update.Inserts)),
+		attribute.Int("crdt.deletes", len(request.Update.Deletes)),
+	))
+	defer span.End()
+
+	state, err := pool.Store.Acquire(ctx, request.DocID)
+	if err != nil {
+		return err
+	}
+	defer pool.Store.Release(state)
+	defer pool.publishQueued(state)
+	state.Lock()
+	defer state.Unlock()
+	if err := requireMode(state, models.DocumentModeCRDT); err != nil {
+		return err
+	}
+
+	changed, err := state.CRDT.Apply(*request.Update)
+	if err != nil {
+		return err
+	}
+	if changed {
+		state.commitCRDT()
+	}
+	span.SetAttributes(attribute.Bool("crdt.changed", changed), attribute.Int("crdt.pending", state.CRDT.Pending()))
+	metrics.EventsProcessed.WithLabelValues(CRDTUpdateMessageType).Inc()
+
+	pool.JoinRoom(sender, request.DocID, request.UserID)
+	// relayed even when it changed nothing here: peers may lack the origins
+	// the server already had and apply it anyway
+	state.queueBroadcast(BroadcastMessage{
+		Message: ServerMessage{
+			Type:    CRDTUpdateMessageType,
+			DocID:   request.DocID,
+			Version: state.Document.Version,
+			Update:  request.Update,
+		},
+		DocID:       request.DocID,
+		ExcludeConn: sender,
+		Context:     ctx,
+	})
+	return nil
+}
+
+// syncCRDT answers a replica coming online with the update it is missing
+// according to its state vector, along with the server's state vector.
+func (pool *ConnectionPool) syncCRDT(ctx context.Context, sender *websocket.Conn, request ClientMessage) error {
+	_, span := tracing.Tracer.Start(ctx, "crdt.sync", trace.WithAttributes(
+		attribute.String("doc.id", request.DocID),
+		attribute.Int("crdt.clients", len(request.StateVector)),
+	))
+	defer span.End()
+
+	state, err := pool.Store.Acquire(ctx, request.DocID)
+	if err != nil {
+		return err
+	}
+	defer pool.Store.Release(state)
+	state.Lock()
+	if err := requireMode(state, models.DocumentModeCRDT); err != nil {
+		state.Unlock()
+		return err
+	}
+	missing := state.CRDT.Diff(request.StateVector)
+	response := ServerMessage{
+		Type:        CRDTSyncMessageType,
+		DocID:       request.DocID,
+		Version:     state.Document.Version,
+		Title:       state.Document.Title,
+		Update:      &missing,
+		StateVector: state.CRDT.StateVector(),
+	}
+	state.Unlock()
+
+	span.SetAttributes(attribute.Int("crdt.inserts", len(missing.Inserts)))
+	pool.JoinRoom(sender, request.DocID, request.UserID)
+	pool.SendTo(sender, response)
+	return nil
+}
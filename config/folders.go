@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"real-time-collab/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrFolderCycle    = errors.New("a folder cannot be moved into itself")
+	ErrFolderMismatch = errors.New("the folder belongs to another workspace or user")
+)
+
+// maxFolderDepth bounds walks up the tree, which also keeps a cycle left by
+// two racing moves from looping forever.
+const maxFolderDepth = 64
+
+// ValidFolderPermission reports whether permission can be set on a folder,
+// "" clearing it so the folder inherits again.
+func ValidFolderPermission(permission string) bool {
+	return permission == "" || permission == models.PermissionNone || permission == models.PermissionView || permission == models.PermissionEdit
+}
+
+// InheritedPermission is the permission set on folderID or on its nearest
+// ancestor that has one, "" when none has.
+func InheritedPermission(DB *gorm.DB, folderID *uint) (string, error) {
+	for depth := 0; folderID != nil && depth < maxFolderDepth; depth++ {
+		var folder models.Folder
+		if err := DB.Select("id", "parent_id", "permission").First(&folder, "id = ?", *folderID).Error; err != nil {
+			return "", fmt.Errorf("failed to fetch folder: %w", err)
+		}
+		if folder.Permission != "" {
+			return folder.Permission, nil
+		}
+		folderID = folder.ParentID
+	}
+	return "", nil
+}
+
+// FolderPermission is what a user may do in a folder: add, move and rename
+// things with edit, list it with view. Personal folders are their owner's
+// alone.
+func FolderPermission(DB *gorm.DB, folder models.Folder, userID string) (string, error) {
+	if folder.WorkspaceID == nil {
+		if folder.OwnerID != "" && folder.OwnerID == userID {
+			return models.PermissionEdit, nil
+		}
+		return models.PermissionNone, nil
+	}
+	return workspacePermission(DB, *folder.WorkspaceID, &folder.ID, userID)
+}
+
+// SameTree reports whether an item of workspaceID, owned by ownerID when
+// outside of a workspace, can be filed in folder.
+func SameTree(folder models.Folder, workspaceID *uint, ownerID string) bool {
+	if folder.WorkspaceID == nil || workspaceID == nil {
+		return folder.WorkspaceID == nil && workspaceID == nil && folder.OwnerID == ownerID
+	}
+	return *folder.WorkspaceID == *workspaceID
+}
+
+// MoveFolder files folder in parent, nil for the top of its tree.
+func MoveFolder(DB *gorm.DB, folder *models.Folder, parent *models.Folder) error {
+	var parentID *uint
+	if parent != nil {
+		if !SameTree(*parent, folder.WorkspaceID, folder.OwnerID) {
+			return ErrFolderMismatch
+		}
+		// the new parent must not be the folder or one of its descendants
+		ancestor := &parent.ID
+		for depth := 0; ancestor != nil && depth < maxFolderDepth; depth++ {
+			if *ancestor == folder.ID {
+				return ErrFolderCycle
+			}
+			var next models.Folder
+			if err := DB.Select("id", "parent_id").First(&next, "id = ?", *ancestor).Error; err != nil {
+				return fmt.Errorf("failed to fetch folder: %w", err)
+			}
+			ancestor = next.ParentID
+		}
+		parentID = &parent.ID
+	}
+	if err := DB.Model(&models.Folder{}).Where("id = ?", folder.ID).Update("parent_id", parentID).Error; err != nil {
+		return err
+	}
+	folder.ParentID = parentID
+	return nil
+}
+
+// DeleteFolder deletes a folder with the folders below it. Documents are
+// never deleted with a folder, they move up to the folder's parent.
+func DeleteFolder(DB *gorm.DB, folder models.Folder) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		ids := []uint{folder.ID}
+		for level := []uint{folder.ID}; len(level) > 0; {
+			var children []uint
+			if err := tx.Model(&models.Folder{}).Where("parent_id IN ?", level).Pluck("id", &children).Error; err != nil {
+				return err
+			}
+			ids = append(ids, children...)
+			level = children
+			if len(ids) > 100000 {
+				return fmt.Errorf("folder %d has too many descendants", folder.ID)
+			}
+		}
+		if err := tx.Model(&models.Document{}).Where("folder_id IN ?", ids).Update("folder_id", folder.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.Folder{}).Error
+	})
+}
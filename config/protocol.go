@@ -0,0 +1,407 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"real-time-collab/crdt"
+	"real-time-collab/models"
+	"real-time-collab/richtext"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Websocket subprotocols, negotiated through Sec-WebSocket-Protocol. A
+// client that asks for none speaks the legacy protocol, where every
+// message is a full models.DocumentEvent in JSON.
+const (
+	JSONProtocolV1    = "collab.v1.json"
+	MsgpackProtocolV1 = "collab.v1.msgpack"
+)
+
+// SupportedSubprotocols are offered to clients on upgrade. The first one in
+// the client's list that the server supports wins.
+var SupportedSubprotocols = []string{JSONProtocolV1, MsgpackProtocolV1}
+
+const (
+	// OperationMessageType is a single edit, sent by clients and broadcast to a room
+	OperationMessageType = "op"
+	// BatchMessageType is an ordered list of edits against one base version,
+	// applied and broadcast as a single revision
+	BatchMessageType = "batch"
+	// ResumeMessageType is sent by a client after reconnecting
+	ResumeMessageType = "resume"
+	// CatchUpMessageType carries the events a resuming client missed
+	CatchUpMessageType = "catchup"
+	// SnapshotMessageType replaces catch up when the client is too far behind
+	SnapshotMessageType = "snapshot"
+	// ResumedMessageType acknowledges the client's buffered operations
+	ResumedMessageType = "resumed"
+	// CRDTUpdateMessageType carries a crdt.Update of a document in CRDT
+	// mode, from a client to the server and relayed to the room
+	CRDTUpdateMessageType = "crdt_update"
+	// CRDTSyncMessageType is sent by a client with its state vector when it
+	// comes online; the server answers with the same type, the update the
+	// client is missing and the server's state vector so the client can
+	// send back what the server is missing
+	CRDTSyncMessageType = "crdt_sync"
+	// DeltaMessageType is a richtext.Delta against a base version of a
+	// rich-text document, sent by clients and broadcast to a room
+	DeltaMessageType = "delta"
+	// ThreadMessageType is broadcast when a comment thread of the document
+	// is started, replied to, resolved or reopened
+	ThreadMessageType = "thread"
+	// SuggestMessageType is an edit a client proposes instead of making it,
+	// carried like the edit of an OperationMessageType message
+	SuggestMessageType = "suggest"
+	// SuggestionMessageType is broadcast when a suggestion is made, accepted
+	// or rejected
+	SuggestionMessageType = "suggestion"
+	ErrorMessageType      = "error"
+)
+
+// ClientMessage is a decoded message from a client, whatever its protocol.
+type ClientMessage struct {
+	Type   string `json:"type"`
+	DocID  string `json:"doc_id"`
+	UserID string `json:"user_id"`
+	// Version is the last document version the client has acknowledged
+	Version int `json:"doc_version"`
+	// Operations are edits the client made locally on top of Version that
+	// the server has not acknowledged yet, oldest first.
+	Operations []models.DocumentEvent `json:"operations,omitempty"`
+	// Event is the edit of an OperationMessageType message
+	Event *models.DocumentEvent `json:"-"`
+	// Update and StateVector are used by documents in CRDT mode
+	Update      *crdt.Update     `json:"update,omitempty"`
+	StateVector crdt.StateVector `json:"state_vector,omitempty"`
+	// Delta is the change of a DeltaMessageType message
+	Delta *richtext.Delta `json:"delta,omitempty"`
+}
+
+// ServerMessage is a message to one client or a room, before encoding.
+type ServerMessage struct {
+	Type    string `json:"type"`
+	DocID   string `json:"doc_id"`
+	Version int    `json:"doc_version"`
+	// Content is the whole document after the message was applied
+	Content    string                 `json:"content,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	Events     []models.DocumentEvent `json:"events,omitempty"`
+	Operations []models.DocumentEvent `json:"operations,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	// Update and StateVector are used by documents in CRDT mode
+	Update      *crdt.Update     `json:"update,omitempty"`
+	StateVector crdt.StateVector `json:"state_vector,omitempty"`
+	// Delta is the change of a DeltaMessageType message, or the whole
+	// content of a rich-text document in a snapshot
+	Delta *richtext.Delta `json:"delta,omitempty"`
+	// Thread is the thread of a ThreadMessageType message, with its comments
+	Thread *models.Thread `json:"thread,omitempty"`
+	// Suggestion is the suggestion of a SuggestionMessageType message
+	Suggestion *models.Suggestion `json:"suggestion,omitempty"`
+}
+
+// Codec turns raw websocket frames into ClientMessages and ServerMessages
+// into frames for one protocol.
+type Codec interface {
+	Subprotocol() string
+	// FrameType is websocket.TextMessage or websocket.BinaryMessage
+	FrameType() int
+	Decode(data []byte) (ClientMessage, error)
+	Encode(message ServerMessage) ([]byte, error)
+}
+
+// CodecFor returns the codec of a negotiated subprotocol.
+func CodecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case JSONProtocolV1:
+		return v1Codec{name: JSONProtocolV1, frameType: websocket.TextMessage, marshal: json.Marshal, unmarshal: json.Unmarshal}
+	case MsgpackProtocolV1:
+		return v1Codec{name: MsgpackProtocolV1, frameType: websocket.BinaryMessage, marshal: msgpack.Marshal, unmarshal: msgpack.Unmarshal}
+	default:
+		return legacyCodec{}
+	}
+}
+
+// legacyCodec speaks the original protocol: clients send bare
+// DocumentEvents and receive them back with Content holding the whole
+// document, gorm.Model fields included.
+type legacyCodec struct{}
+
+func (legacyCodec) Subprotocol() string { return "" }
+
+func (legacyCodec) FrameType() int { return websocket.TextMessage }
+
+func (legacyCodec) Decode(data []byte) (ClientMessage, error) {
+	var message ClientMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return message, err
+	}
+	// a suggestion is a bare event with its type next to the event's fields
+	if message.Type != "" && message.Type != SuggestMessageType {
+		return message, nil
+	}
+	var event models.DocumentEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return message, err
+	}
+	if message.Type == "" {
+		message.Type = OperationMessageType
+	}
+	message.Event = &event
+	return message, nil
+}
+
+func (legacyCodec) Encode(message ServerMessage) ([]byte, error) {
+	// legacy clients replace their copy with the content of each event they
+	// receive, so a batch reaches them as its last operation
+	if (message.Type == OperationMessageType || message.Type == BatchMessageType) && len(message.Events) > 0 {
+		event := message.Events[len(message.Events)-1]
+		event.Content = message.Content
+		return json.Marshal(event)
+	}
+	return json.Marshal(message)
+}
+
+// WireOp is an edit in the v1 protocols. It carries only what a client
+// needs to apply it; the document text is never repeated.
+type WireOp struct {
+	Operation string `json:"o" msgpack:"o"`
+	Position  int    `json:"p" msgpack:"p"`
+	Length    int    `json:"l,omitempty" msgpack:"l,omitempty"`
+	Content   string `json:"c,omitempty" msgpack:"c,omitempty"`
+	UserID    string `json:"u,omitempty" msgpack:"u,omitempty"`
+	// Version is the base version sent by a client, or the version an
+	// event produced when sent by the server
+	Version int `json:"v,omitempty" msgpack:"v,omitempty"`
+	// Timestamp is in unix milliseconds
+	Timestamp int64 `json:"ts,omitempty" msgpack:"ts,omitempty"`
+	// Delta is the change of a delta event
+	Delta *richtext.Delta `json:"dl,omitempty" msgpack:"dl,omitempty"`
+}
+
+// WireMessage is the envelope of every v1 message in both directions.
+type WireMessage struct {
+	Type    string   `json:"t" msgpack:"t"`
+	DocID   string   `json:"d" msgpack:"d"`
+	UserID  string   `json:"u,omitempty" msgpack:"u,omitempty"`
+	Version int      `json:"v,omitempty" msgpack:"v,omitempty"`
+	Op      *WireOp  `json:"op,omitempty" msgpack:"op,omitempty"`
+	Ops     []WireOp `json:"ops,omitempty" msgpack:"ops,omitempty"`
+	Content string   `json:"c,omitempty" msgpack:"c,omitempty"`
+	Title   string   `json:"ti,omitempty" msgpack:"ti,omitempty"`
+	Error   string   `json:"e,omitempty" msgpack:"e,omitempty"`
+	// Update and StateVector are used by documents in CRDT mode
+	Update      *crdt.Update       `json:"cu,omitempty" msgpack:"cu,omitempty"`
+	StateVector crdt.StateVector   `json:"sv,omitempty" msgpack:"sv,omitempty"`
+	Delta       *richtext.Delta    `json:"dl,omitempty" msgpack:"dl,omitempty"`
+	Thread      *models.Thread     `json:"th,omitempty" msgpack:"th,omitempty"`
+	Suggestion  *models.Suggestion `json:"sg,omitempty" msgpack:"sg,omitempty"`
+}
+
+type v1Codec struct {
+	name      string
+	frameType int
+	marshal   func(interface{}) ([]byte, error)
+	unmarshal func([]byte, interface{}) error
+}
+
+func (codec v1Codec) Subprotocol() string { return codec.name }
+
+func (codec v1Codec) FrameType() int { return codec.frameType }
+
+func (codec v1Codec) Decode(data []byte) (ClientMessage, error) {
+	var wire WireMessage
+	if err := codec.unmarshal(data, &wire); err != nil {
+		return ClientMessage{}, err
+	}
+	message := ClientMessage{
+		Type:        wire.Type,
+		DocID:       wire.DocID,
+		UserID:      wire.UserID,
+		Version:     wire.Version,
+		Operations:  fromWireOps(wire.DocID, wire.Ops),
+		Update:      wire.Update,
+		StateVector: wire.StateVector,
+		Delta:       wire.Delta,
+	}
+	if wire.Type == OperationMessageType || wire.Type == SuggestMessageType {
+		if wire.Op == nil {
+			return message, fmt.Errorf("op message without op")
+		}
+		event := fromWireOp(wire.DocID, *wire.Op)
+		if event.UserID == "" {
+			event.UserID = wire.UserID
+		}
+		message.Event = &event
+	}
+	return message, nil
+}
+
+func (codec v1Codec) Encode(message ServerMessage) ([]byte, error) {
+	wire := WireMessage{
+		Type:    message.Type,
+		DocID:   message.DocID,
+		Version: message.Version,
+		Title:   message.Title,
+		Error:   message.Error,
+	}
+	switch message.Type {
+	case OperationMessageType:
+		if len(message.Events) == 1 {
+			op := toWireOp(message.Events[0])
+			wire.Op = &op
+		}
+	case SnapshotMessageType, CatchUpMessageType:
+		// a catch up applies its ops onto the client's copy, the content is
+		// only needed when the client has to start over from a snapshot
+		if message.Type == SnapshotMessageType {
+			wire.Content = message.Content
+			wire.Delta = message.Delta
+		}
+		wire.Ops = toWireOps(message.Events)
+	case ResumedMessageType:
+		wire.Ops = toWireOps(message.Operations)
+	case BatchMessageType:
+		wire.Ops = toWireOps(message.Events)
+	case CRDTUpdateMessageType, CRDTSyncMessageType:
+		wire.Update = message.Update
+		wire.StateVector = message.StateVector
+	case DeltaMessageType:
+		wire.Delta = message.Delta
+		wire.Ops = toWireOps(message.Events)
+	case ThreadMessageType:
+		wire.Thread = message.Thread
+	case SuggestionMessageType:
+		wire.Suggestion = message.Suggestion
+	default:
+		wire.Content = message.Content
+		wire.Ops = toWireOps(message.Events)
+	}
+	return codec.marshal(wire)
+}
+
+func toWireOp(event models.DocumentEvent) WireOp {
+	op := WireOp{
+		Operation: event.Operation,
+		Position:  event.Position,
+		Length:    event.Length,
+		Content:   event.Content,
+		UserID:    event.UserID,
+		Version:   event.Version,
+	}
+	if !event.Timestamp.IsZero() {
+		op.Timestamp = event.Timestamp.UnixMilli()
+	}
+	if len(event.Delta) > 0 {
+		if delta, err := richtext.Parse(event.Delta); err == nil {
+			op.Delta = &delta
+		}
+	}
+	return op
+}
+
+func toWireOps(events []models.DocumentEvent) []WireOp {
+	if len(events) == 0 {
+		return nil
+	}
+	ops := make([]WireOp, len(events))
+	for i, event := range events {
+		ops[i] = toWireOp(event)
+	}
+	return ops
+}
+
+func fromWireOp(docID string, op WireOp) models.DocumentEvent {
+	event := models.DocumentEvent{
+		DocID:     docID,
+		UserID:    op.UserID,
+		Operation: op.Operation,
+		Position:  op.Position,
+		Length:    op.Length,
+		Content:   op.Content,
+		Version:   op.Version,
+	}
+	if op.Timestamp != 0 {
+		event.Timestamp = time.UnixMilli(op.Timestamp)
+	}
+	if op.Delta != nil {
+		event.Delta, _ = json.Marshal(op.Delta)
+	}
+	return event
+}
+
+func fromWireOps(docID string, ops []WireOp) []models.DocumentEvent {
+	if len(ops) == 0 {
+		return nil
+	}
+	events := make([]models.DocumentEvent, len(ops))
+	for i, op := range ops {
+		events[i] = fromWireOp(docID, op)
+	}
+	return events
+}
+
+// Publish broadcasts a change that did not come in over a websocket, such
+// as one made through the REST API, to the room of a document.
+func (pool *ConnectionPool) Publish(ctx context.Context, docID string, message ServerMessage) {
+	if pool.ShuttingDown() {
+		return
+	}
+	pool.send(BroadcastMessage{Message: message, DocID: docID, Context: ctx})
+}
+
+// queueBroadcast adds a broadcast to the outbox of a document. The state
+// must be locked, so edits are queued in the order they were committed;
+// publishQueued sends them once the lock is released.
+func (state *DocumentState) queueBroadcast(message BroadcastMessage) {
+	state.outbox = append(state.outbox, message)
+}
+
+// publishQueued sends the broadcasts queued on a document, in order. It is
+// called after the state is unlocked, so a broadcaster that is behind holds
+// up the callers publishing to this document but not its edits.
+func (pool *ConnectionPool) publishQueued(state *DocumentState) {
+	state.publishing.Lock()
+	defer state.publishing.Unlock()
+	state.Lock()
+	messages := state.outbox
+	state.outbox = nil
+	state.Unlock()
+	for _, message := range messages {
+		pool.send(message)
+	}
+}
+
+// send hands a message to the broadcaster, or drops it once Shutdown has
+// stopped the broadcaster.
+func (pool *ConnectionPool) send(message BroadcastMessage) {
+	pool.broadcastMutex.RLock()
+	defer pool.broadcastMutex.RUnlock()
+	if pool.broadcastClosed {
+		return
+	}
+	pool.Broadcast <- message
+}
+
+// SendTo encodes a message with the connection's codec and writes it.
+func (pool *ConnectionPool) SendTo(connection *websocket.Conn, message ServerMessage) {
+	pool.Mutex.Lock()
+	client, ok := pool.Connections[connection]
+	pool.Mutex.Unlock()
+	if !ok {
+		return
+	}
+	data, err := client.Codec.Encode(message)
+	if err != nil {
+		client.Logger.Error("failed to encode message", "type", message.Type, "error", err)
+		return
+	}
+	if err := client.Write(client.Codec.FrameType(), data, pool.Settings.WriteWait); err != nil {
+		client.Logger.Warn("Error writing message", "error", err)
+		pool.RemoveConnection(connection)
+	}
+}
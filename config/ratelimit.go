@@ -0,0 +1,83 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RateLimitSettings are the HTTP request budgets, per client IP and per user.
+type RateLimitSettings struct {
+	// AuthPerMinute and AuthBurst limit /login, /register and the account
+	// recovery endpoints, the ones open to password and token guessing.
+	AuthPerMinute float64
+	AuthBurst     int
+	// APIPerMinute and APIBurst limit every other application route.
+	APIPerMinute float64
+	APIBurst     int
+	// TrustProxy takes the client IP from X-Forwarded-For.
+	TrustProxy bool
+}
+
+func LoadRateLimitSettings() RateLimitSettings {
+	return RateLimitSettings{
+		AuthPerMinute: getEnvFloat("RATE_LIMIT_AUTH_PER_MINUTE", 10),
+		AuthBurst:     int(getEnvInt64("RATE_LIMIT_AUTH_BURST", 5)),
+		APIPerMinute:  getEnvFloat("RATE_LIMIT_API_PER_MINUTE", 600),
+		APIBurst:      int(getEnvInt64("RATE_LIMIT_API_BURST", 100)),
+		TrustProxy:    os.Getenv("TRUST_PROXY") == "true",
+	}
+}
+
+// ClientIP is the address a request came from. With trustProxy it is the
+// right most X-Forwarded-For address, the one the proxy in front of the
+// server appended; the entries before it come from the client and can be
+// anything. This is only safe behind a single proxy that sets the header.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+			if address := strings.TrimSpace(addresses[len(addresses)-1]); address != "" {
+				return address
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type clientIPKey struct{}
+
+// WithClientIP returns a copy of ctx carrying the client address the rate
+// limiter resolved, so later consumers agree with it on TRUST_PROXY.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIPFromContext returns the address stored by WithClientIP, "" when
+// none was.
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number <= 0 {
+		slog.Warn("invalid number", "key", key, "value", value, "using", fallback)
+		return fallback
+	}
+	return number
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"real-time-collab/metrics"
+	"real-time-collab/models"
+	"real-time-collab/tracing"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// resume brings a reconnecting client up to date. It streams the events
+// committed after the client's last acknowledged version (or a snapshot when
+// there are more than MaxCatchUpEvents of them), then rebases the client's
+// buffered operations over those events and applies them.
+func (pool *ConnectionPool) resume(ctx context.Context, sender *websocket.Conn, request ClientMessage, DB *gorm.DB) error {
+	ctx, span := tracing.Tracer.Start(ctx, "resume", trace.WithAttributes(
+		attribute.String("doc.id", request.DocID),
+		attribute.Int("resume.base_version", request.Version),
+		attribute.Int("resume.operations", len(request.Operations)),
+	))
+	defer span.End()
+
+	pool.JoinRoom(sender, request.DocID, request.UserID)
+
+	state, err := pool.Store.Acquire(ctx, request.DocID)
+	if err != nil {
+		return err
+	}
+	defer pool.Store.Release(state)
+	defer pool.publishQueued(state)
+	// held until the broadcasts are queued so no other edit lands in between
+	state.Lock()
+	defer state.Unlock()
+	if err := requireMode(state, models.DocumentModeOT); err != nil {
+		return err
+	}
+	// rich-text clients catch up here too but resend their edits as deltas
+	if len(request.Operations) > 0 {
+		if err := requireType(state, models.DocumentTypeText); err != nil {
+			return err
+		}
+	}
+
+	if request.Version > state.Document.Version {
+		// the client saw edits the server lost before they were flushed, its
+		// buffered operations have no base to be rebased on
+		pool.SendTo(sender, ServerMessage{
+			Type:    SnapshotMessageType,
+			DocID:   request.DocID,
+			Version: state.Document.Version,
+			Content: state.Document.Content,
+			Title:   state.Document.Title,
+			Delta:   state.RichText,
+		})
+		return fmt.Errorf("client version %d is ahead of the document (%d)", request.Version, state.Document.Version)
+	}
+	missed, err := state.EventsSince(DB.WithContext(ctx), request.Version)
+	if err != nil {
+		return err
+	}
+
+	catchUp := ServerMessage{
+		Type:    CatchUpMessageType,
+		DocID:   request.DocID,
+		Version: state.Document.Version,
+		Content: state.Document.Content,
+		Title:   state.Document.Title,
+		Events:  missed,
+	}
+	if len(missed) > pool.Settings.MaxCatchUpEvents {
+		catchUp.Type = SnapshotMessageType
+		catchUp.Events = nil
+		catchUp.Delta = state.RichText
+	}
+
+	// applied to a copy and committed together so a rejected operation
+	// leaves the head untouched
+	document := state.Document
+	var applied []models.DocumentEvent
+	var broadcasts []ServerMessage
+	for _, event := range rebaseOperations(request.Operations, missed) {
+		event.ID = 0
+		event.DocID = request.DocID
+		if event.UserID == "" {
+			event.UserID = request.UserID
+		}
+		if err := validateDocumentEvent(&event); err != nil {
+			return err
+		}
+		// already rebased onto the head, so it must not be transformed again
+		event.Version = document.Version
+		if err := applyChangesToDocument(&document, &event); err != nil {
+			return fmt.Errorf("failed to apply changes: %w", err)
+		}
+		applied = append(applied, event)
+		broadcasts = append(broadcasts, ServerMessage{
+			Type:    OperationMessageType,
+			DocID:   request.DocID,
+			Version: document.Version,
+			Content: document.Content,
+			Events:  []models.DocumentEvent{event},
+		})
+	}
+	state.commit(document, applied)
+
+	pool.SendTo(sender, catchUp)
+	pool.SendTo(sender, ServerMessage{
+		Type:       ResumedMessageType,
+		DocID:      request.DocID,
+		Version:    document.Version,
+		Content:    document.Content,
+		Operations: applied,
+	})
+	for _, broadcast := range broadcasts {
+		metrics.EventsProcessed.WithLabelValues(broadcast.Events[0].Operation).Inc()
+		state.queueBroadcast(BroadcastMessage{Message: broadcast, DocID: request.DocID, ExcludeConn: sender, Context: ctx})
+	}
+	return nil
+}
+
+// rebaseOperations transforms a client's sequence of buffered operations
+// over the events the server committed since the client's base version.
+// Each committed event is in turn transformed over the buffered operations
+// it passes so that later operations see it at the right position.
+func rebaseOperations(pending []models.DocumentEvent, committed []models.DocumentEvent) []models.DocumentEvent {
+	rebased := make([]models.DocumentEvent, len(pending))
+	copy(rebased, pending)
+	for _, event := range committed {
+		for i := range rebased {
+			original := rebased[i]
+			ProcessTransformation(&rebased[i], event)
+			ProcessTransformation(&event, original)
+		}
+	}
+	return rebased
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"real-time-collab/metrics"
+	"real-time-collab/models"
+	"real-time-collab/richtext"
+	"real-time-collab/tracing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// DeltaOperation is the Operation of the events of rich-text documents.
+const DeltaOperation = "delta"
+
+// requireType rejects a message meant for another type of document. The
+// state must be locked.
+func requireType(state *DocumentState, documentType string) error {
+	current := state.Document.Type
+	if current == "" {
+		current = models.DocumentTypeText
+	}
+	if current != documentType {
+		return fmt.Errorf("document %d is a %s document", state.Document.ID, current)
+	}
+	return nil
+}
+
+// applyDelta applies a change to a rich-text document. The change is made
+// against request.Version and is transformed over the deltas committed
+// since, then composed into the document and stored in the event log like
+// any other event.
+func (pool *ConnectionPool) applyDelta(ctx context.Context, sender *websocket.Conn, request ClientMessage, DB *gorm.DB) error {
+	if request.Delta == nil || len(request.Delta.Ops) == 0 {
+		return fmt.Errorf("delta message without delta")
+	}
+	ctx, span := tracing.Tracer.Start(ctx, "delta", trace.WithAttributes(
+		attribute.String("doc.id", request.DocID),
+		attribute.Int("delta.base_version", request.Version),
+		attribute.Int("delta.ops", len(request.Delta.Ops)),
+	))
+	defer span.End()
+
+	change := *request.Delta
+	if err := change.Validate(); err != nil {
+		return err
+	}
+
+	state, err := pool.Store.Acquire(ctx, request.DocID)
+	if err != nil {
+		return err
+	}
+	defer pool.Store.Release(state)
+	defer pool.publishQueued(state)
+	state.Lock()
+	defer state.Unlock()
+	if err := requireType(state, models.DocumentTypeRichText); err != nil {
+		return err
+	}
+	if request.Version > state.Document.Version {
+		return fmt.Errorf("base version %d is ahead of the document (%d)", request.Version, state.Document.Version)
+	}
+
+	transformStart := time.Now()
+	committed, err := state.EventsSince(DB.WithContext(ctx), request.Version)
+	if err != nil {
+		return err
+	}
+	for _, event := range committed {
+		applied, err := richtext.Parse(event.Delta)
+		if err != nil {
+			return fmt.Errorf("event %d of version %d: %w", event.ID, event.Version, err)
+		}
+		// the committed change was first, its inserts win ties
+		change = richtext.Transform(applied, change, true)
+	}
+	metrics.TransformDuration.Observe(time.Since(transformStart).Seconds())
+
+	content, err := richtext.Apply(*state.RichText, change)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("failed to encode delta: %w", err)
+	}
+	document := state.Document
+	document.Version++
+	document.Content = content.Text()
+	event := models.DocumentEvent{
+		DocID:     request.DocID,
+		UserID:    request.UserID,
+		Operation: DeltaOperation,
+		Timestamp: time.Now(),
+		Version:   document.Version,
+		Delta:     encoded,
+	}
+	state.RichText = &content
+	state.commit(document, []models.DocumentEvent{event})
+	metrics.EventsProcessed.WithLabelValues(DeltaOperation).Inc()
+	span.SetAttributes(attribute.Int("delta.version", document.Version))
+
+	pool.JoinRoom(sender, request.DocID, request.UserID)
+	state.queueBroadcast(BroadcastMessage{
+		Message: ServerMessage{
+			Type:    DeltaMessageType,
+			DocID:   request.DocID,
+			Version: document.Version,
+			Delta:   &change,
+		},
+		DocID:       request.DocID,
+		ExcludeConn: sender,
+		Context:     ctx,
+	})
+	return nil
+}
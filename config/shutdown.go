@@ -0,0 +1,94 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ServiceRestartReason is sent with the close frame on shutdown so clients
+// know to reconnect and resume instead of treating it as an error.
+const ServiceRestartReason = "server restarting, reconnect"
+
+// Shutdown drains the pool. It stops accepting connections and reading
+// from the open ones, lets the workers finish every queued message
+// (applying it as they go), flushes the resulting broadcasts, sends each
+// client a close frame with websocket.CloseServiceRestart and finally writes
+// every pending edit to the database. If ctx expires first the remaining
+// connections are closed right away and the messages still in the queue are
+// lost, but the edits already applied are still flushed.
+func (pool *ConnectionPool) Shutdown(ctx context.Context) error {
+	pool.Mutex.Lock()
+	pool.closing.Store(true)
+	for connection := range pool.Connections {
+		// unblocks ReadMessage so the reader loop exits
+		connection.SetReadDeadline(time.Now())
+	}
+	pool.Mutex.Unlock()
+
+	if err := waitGroupWithContext(ctx, &pool.readers); err != nil {
+		pool.closeConnections(websocket.CloseServiceRestart, ServiceRestartReason)
+		pool.flushStore()
+		return fmt.Errorf("timed out waiting for readers to stop: %w", err)
+	}
+
+	slog.Info("draining queued messages", "queued", len(pool.MessageQueue))
+	close(pool.MessageQueue)
+	if err := waitGroupWithContext(ctx, &pool.workers); err != nil {
+		pool.closeConnections(websocket.CloseServiceRestart, ServiceRestartReason)
+		pool.flushStore()
+		return fmt.Errorf("timed out draining the message queue (%d left): %w", len(pool.MessageQueue), err)
+	}
+
+	// the broadcaster finishes what the workers left; messages published
+	// from the REST API from now on are dropped
+	pool.broadcastMutex.Lock()
+	pool.broadcastClosed = true
+	close(pool.Broadcast)
+	pool.broadcastMutex.Unlock()
+	select {
+	case <-pool.broadcasterDone:
+	case <-ctx.Done():
+	}
+
+	pool.closeConnections(websocket.CloseServiceRestart, ServiceRestartReason)
+	if err := ctx.Err(); err != nil {
+		pool.flushStore()
+		return err
+	}
+	return pool.Store.Close(ctx)
+}
+
+// flushStore writes the pending edits after ctx ran out. Workers that are
+// still running may commit more edits afterwards; those are lost. The flush
+// gets its own short deadline so a dead database cannot hang the exit.
+func (pool *ConnectionPool) flushStore() {
+	ctx, cancel := context.WithTimeout(context.Background(), pool.Settings.WriteWait)
+	defer cancel()
+	if err := pool.Store.Close(ctx); err != nil {
+		slog.Error("failed to flush documents", "error", err)
+	}
+}
+
+// closeConnections sends every connection a close frame and closes it.
+func (pool *ConnectionPool) closeConnections(code int, reason string) {
+	pool.closeMatching(code, reason, func(*Client) bool { return true })
+}
+
+func waitGroupWithContext(ctx context.Context, group *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
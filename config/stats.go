@@ -0,0 +1,94 @@
+package config
+
+import "sort"
+
+// QueueSaturationThreshold is the fill ratio of MessageQueue above which the
+// pool reports itself as not ready for more traffic.
+const QueueSaturationThreshold = 0.9
+
+// PoolStats is a point in time view of the connection pool.
+type PoolStats struct {
+	Connections   int  `json:"connections"`
+	QueueDepth    int  `json:"queueDepth"`
+	QueueCapacity int  `json:"queueCapacity"`
+	Workers       int  `json:"workers"`
+	Broadcasting  bool `json:"broadcasting"`
+	ShuttingDown  bool `json:"shuttingDown"`
+	// PendingEvents are edits applied in memory but not flushed yet
+	PendingEvents int             `json:"pendingEvents"`
+	Documents     []DocumentStats `json:"documents"`
+}
+
+// DocumentStats describes one open document room.
+type DocumentStats struct {
+	DocID       string   `json:"docId"`
+	Connections int      `json:"connections"`
+	Users       []string `json:"users"`
+}
+
+// AliveWorkers is the number of worker goroutines still consuming MessageQueue.
+func (pool *ConnectionPool) AliveWorkers() int {
+	return int(pool.aliveWorkers.Load())
+}
+
+// QueueSaturated reports whether MessageQueue is close to full, meaning
+// readers are about to block on it.
+func (pool *ConnectionPool) QueueSaturated() bool {
+	capacity := cap(pool.MessageQueue)
+	if capacity == 0 {
+		return false
+	}
+	return float64(len(pool.MessageQueue)) >= float64(capacity)*QueueSaturationThreshold
+}
+
+// Broadcasting reports whether StartBroadcasting is still running.
+func (pool *ConnectionPool) Broadcasting() bool {
+	select {
+	case <-pool.broadcasterDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// ShuttingDown reports whether Shutdown has been called.
+func (pool *ConnectionPool) ShuttingDown() bool {
+	return pool.closing.Load()
+}
+
+// Stats collects the open documents, their users and the queue state.
+func (pool *ConnectionPool) Stats() PoolStats {
+	pool.Mutex.Lock()
+	stats := PoolStats{
+		Connections:   len(pool.Connections),
+		QueueDepth:    len(pool.MessageQueue),
+		QueueCapacity: cap(pool.MessageQueue),
+		Workers:       pool.AliveWorkers(),
+		Broadcasting:  pool.Broadcasting(),
+		ShuttingDown:  pool.ShuttingDown(),
+		Documents:     make([]DocumentStats, 0, len(pool.Rooms)),
+	}
+	for docID, room := range pool.Rooms {
+		seen := make(map[string]bool)
+		users := []string{}
+		for _, client := range room {
+			if client.UserID != "" && !seen[client.UserID] {
+				seen[client.UserID] = true
+				users = append(users, client.UserID)
+			}
+		}
+		sort.Strings(users)
+		stats.Documents = append(stats.Documents, DocumentStats{
+			DocID:       docID,
+			Connections: len(room),
+			Users:       users,
+		})
+	}
+	pool.Mutex.Unlock()
+	stats.PendingEvents = pool.Store.PendingEvents()
+
+	sort.Slice(stats.Documents, func(i, j int) bool {
+		return stats.Documents[i].DocID < stats.Documents[j].DocID
+	})
+	return stats
+}
@@ -0,0 +1,509 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"real-time-collab/crdt"
+	"real-time-collab/metrics"
+	"real-time-collab/models"
+	"real-time-collab/richtext"
+	"real-time-collab/tracing"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// DocumentStore holds the authoritative state of every document that is
+// being edited and writes it back to the database behind the editors.
+//
+// Edits are applied to the in-memory DocumentState under its lock and
+// broadcast right away. A single flusher goroutine later appends the
+// pending events to the event log and saves the document snapshot, both in
+// one transaction, once a document has been quiet for FlushQuiescence,
+// FlushInterval has passed since its last flush or MaxPendingEvents have
+// piled up.
+//
+// Crash safety:
+//   - every flush is atomic, so the database always holds a prefix of the
+//     history: the snapshot's version is the version of the last event in
+//     the log and replaying the log gives the snapshot's content.
+//   - edits that were broadcast but not flushed yet are lost if the process
+//     dies. That window is bounded by FlushInterval and MaxPendingEvents.
+//     Clients that saw those edits resume with a version ahead of the
+//     database and are sent a snapshot to start over from.
+//   - a failed flush keeps the events pending and is retried on the next
+//     tick; nothing is dropped while the process is alive.
+//   - Shutdown flushes every document before the process exits.
+//
+// The store assumes it is the only writer of documents being edited, i.e.
+// a single server instance.
+type DocumentStore struct {
+	DB       *gorm.DB
+	Settings StoreSettings
+
+	mutex     sync.Mutex
+	documents map[string]*DocumentState
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StoreSettings control when pending edits are written to the database.
+type StoreSettings struct {
+	// FlushInterval is the longest a document with pending edits waits for a flush
+	FlushInterval time.Duration
+	// FlushQuiescence flushes a document once it has had no edit for this long
+	FlushQuiescence time.Duration
+	// MaxPendingEvents flushes a document as soon as it has this many pending edits
+	MaxPendingEvents int
+	// RecentEvents is how many already flushed events stay in memory for
+	// transforms and catch up before the event log has to be queried
+	RecentEvents int
+	// EvictAfter unloads documents that nobody touched for this long
+	EvictAfter time.Duration
+}
+
+func LoadStoreSettings() StoreSettings {
+	return StoreSettings{
+		FlushInterval:    getEnvDuration("DOC_FLUSH_INTERVAL", time.Second),
+		FlushQuiescence:  getEnvDuration("DOC_FLUSH_QUIESCENCE", 200*time.Millisecond),
+		MaxPendingEvents: int(getEnvInt64("DOC_MAX_PENDING_EVENTS", 200)),
+		RecentEvents:     int(getEnvInt64("DOC_RECENT_EVENTS", 1000)),
+		EvictAfter:       getEnvDuration("DOC_EVICT_AFTER", 10*time.Minute),
+	}
+}
+
+// DocumentState is the in-memory head of one document. Everything but the
+// bookkeeping of the store must be accessed with the state locked.
+type DocumentState struct {
+	sync.Mutex
+	Document models.Document
+	// CRDT is the replica of a document in CRDT mode, nil otherwise
+	CRDT *crdt.Doc
+	// RichText is the content of a rich-text document, nil otherwise.
+	// Document.RichText is only brought up to date on flush.
+	RichText *richtext.Delta
+
+	// pending are committed events that are not in the database yet
+	pending []models.DocumentEvent
+	// recent is the tail of the event log, pending events included, and
+	// holds every event with a version above recentBase
+	recent           []models.DocumentEvent
+	recentBase       int
+	persistedVersion int
+	// anchors are the ranges of the document's threads at the head version,
+	// movedAnchors the ones that changed since the last flush
+	anchors      map[uint]*anchor
+	movedAnchors map[uint]bool
+	// crdtChanges counts CRDT updates applied since the last flush
+	crdtChanges int
+	lastChange  time.Time
+	lastFlush   time.Time
+
+	// outbox holds the broadcasts queued under the lock, publishing keeps
+	// publishQueued calls from overtaking each other
+	outbox     []BroadcastMessage
+	publishing sync.Mutex
+
+	// guarded by the store mutex
+	references int
+	lastAccess time.Time
+}
+
+func NewDocumentStore(DB *gorm.DB, settings StoreSettings) *DocumentStore {
+	store := &DocumentStore{
+		DB:        DB,
+		Settings:  settings,
+		documents: make(map[string]*DocumentState),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	metrics.RegisterPendingEvents(store.PendingEvents)
+	go store.runFlusher()
+	return store
+}
+
+// Acquire returns the state of a document, loading it from the database if
+// it is not in memory. Every Acquire must be paired with a Release.
+func (store *DocumentStore) Acquire(ctx context.Context, docID string) (*DocumentState, error) {
+	id, err := strconv.ParseUint(docID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse document id")
+	}
+	key := strconv.FormatUint(id, 10)
+
+	store.mutex.Lock()
+	if state, ok := store.documents[key]; ok {
+		state.references++
+		state.lastAccess = time.Now()
+		store.mutex.Unlock()
+		return state, nil
+	}
+	store.mutex.Unlock()
+
+	var document models.Document
+	if err := store.DB.WithContext(ctx).First(&document, "id = ?", id).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch document: %w", err)
+	}
+	var replica *crdt.Doc
+	if document.Mode == models.DocumentModeCRDT {
+		if replica, err = loadReplica(document); err != nil {
+			return nil, err
+		}
+	}
+	var rich *richtext.Delta
+	if document.Type == models.DocumentTypeRichText {
+		if rich, err = loadRichText(document); err != nil {
+			return nil, err
+		}
+	}
+	anchors, err := loadAnchors(store.DB.WithContext(ctx), document)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	// another worker may have loaded it in the meantime
+	state, ok := store.documents[key]
+	if !ok {
+		state = &DocumentState{
+			Document:         document,
+			CRDT:             replica,
+			RichText:         rich,
+			anchors:          anchors,
+			movedAnchors:     make(map[uint]bool),
+			recentBase:       document.Version,
+			persistedVersion: document.Version,
+			lastFlush:        time.Now(),
+		}
+		store.documents[key] = state
+	}
+	state.references++
+	state.lastAccess = time.Now()
+	return state, nil
+}
+
+func (store *DocumentStore) Release(state *DocumentState) {
+	store.mutex.Lock()
+	state.references--
+	state.lastAccess = time.Now()
+	store.mutex.Unlock()
+}
+
+// Head returns the in-memory version of a document if it is loaded, so
+// REST readers do not see a snapshot that lags behind the editors.
+func (store *DocumentStore) Head(docID uint) (models.Document, bool) {
+	store.mutex.Lock()
+	state, ok := store.documents[strconv.FormatUint(uint64(docID), 10)]
+	store.mutex.Unlock()
+	if !ok {
+		return models.Document{}, false
+	}
+	state.Lock()
+	defer state.Unlock()
+	document := state.Document
+	if state.RichText != nil {
+		if encoded, err := json.Marshal(state.RichText); err == nil {
+			document.RichText = encoded
+		}
+	}
+	return document, true
+}
+
+// Overlay replaces the content and version of a document read from the
+// database with the in-memory head, if there is one.
+func (store *DocumentStore) Overlay(document *models.Document) {
+	if head, ok := store.Head(document.ID); ok {
+		document.Content = head.Content
+		document.Version = head.Version
+		document.RichText = head.RichText
+	}
+}
+
+// PendingEvents is the number of committed events and CRDT updates not yet
+// in the database.
+func (store *DocumentStore) PendingEvents() int {
+	total := 0
+	for _, state := range store.states() {
+		state.Lock()
+		total += state.dirty()
+		state.Unlock()
+	}
+	return total
+}
+
+// EventsSince returns the events committed after version, oldest first,
+// from memory when possible and from the event log otherwise.
+func (state *DocumentState) EventsSince(tx *gorm.DB, version int) ([]models.DocumentEvent, error) {
+	var events []models.DocumentEvent
+	if version < state.recentBase {
+		// everything up to recentBase has been flushed already
+		err := tx.Where("doc_id = ? and version > ? and version <= ?", strconv.FormatUint(uint64(state.Document.ID), 10), version, state.recentBase).
+			Order("version ASC, id ASC").
+			Find(&events).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch previous document changes: %w", err)
+		}
+	}
+	for _, event := range state.recent {
+		if event.Version > version {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// loadReplica restores the CRDT replica of a document, seeding it from the
+// content when the document has never been edited in CRDT mode.
+func loadReplica(document models.Document) (*crdt.Doc, error) {
+	if len(document.CRDTState) == 0 {
+		return crdt.FromText(document.Content), nil
+	}
+	replica, err := crdt.Decode(document.CRDTState)
+	if err != nil {
+		return nil, fmt.Errorf("document %d: %w", document.ID, err)
+	}
+	return replica, nil
+}
+
+// loadRichText parses the delta of a rich-text document, starting from the
+// plain content when it has none yet.
+func loadRichText(document models.Document) (*richtext.Delta, error) {
+	if len(document.RichText) == 0 {
+		delta := richtext.FromText(document.Content)
+		return &delta, nil
+	}
+	delta, err := richtext.Parse(document.RichText)
+	if err != nil {
+		return nil, fmt.Errorf("document %d: %w", document.ID, err)
+	}
+	return &delta, nil
+}
+
+// commitCRDT makes the replica's text the new content after an update was
+// applied to it.
+func (state *DocumentState) commitCRDT() {
+	state.Document.Content = state.CRDT.Text()
+	state.Document.Version++
+	state.crdtChanges++
+	state.lastChange = time.Now()
+}
+
+// dirty is the number of changes waiting for a flush.
+func (state *DocumentState) dirty() int {
+	return len(state.pending) + state.crdtChanges
+}
+
+// commit makes document the new head and queues events for the flusher.
+func (state *DocumentState) commit(document models.Document, events []models.DocumentEvent) {
+	state.Document = document
+	for _, event := range events {
+		for _, id := range shiftAnchors(state.anchors, event) {
+			state.movedAnchors[id] = true
+		}
+	}
+	state.pending = append(state.pending, events...)
+	state.recent = append(state.recent, events...)
+	state.lastChange = time.Now()
+}
+
+// trimRecent drops flushed events beyond the newest keep, without splitting
+// the events of one version.
+func (state *DocumentState) trimRecent(keep int) {
+	cut := len(state.recent) - keep
+	for cut > 0 && (state.recent[cut-1].Version > state.persistedVersion ||
+		(cut < len(state.recent) && state.recent[cut].Version == state.recent[cut-1].Version)) {
+		cut--
+	}
+	if cut <= 0 {
+		return
+	}
+	state.recentBase = state.recent[cut-1].Version
+	state.recent = append([]models.DocumentEvent(nil), state.recent[cut:]...)
+}
+
+func (store *DocumentStore) states() []*DocumentState {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	states := make([]*DocumentState, 0, len(store.documents))
+	for _, state := range store.documents {
+		states = append(states, state)
+	}
+	return states
+}
+
+func (store *DocumentStore) runFlusher() {
+	defer close(store.done)
+	tick := store.Settings.FlushQuiescence / 2
+	if tick <= 0 || tick > store.Settings.FlushInterval {
+		tick = store.Settings.FlushInterval
+	}
+	if tick <= 0 {
+		tick = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.stop:
+			return
+		case <-ticker.C:
+			for _, state := range store.states() {
+				if store.shouldFlush(state) {
+					if err := store.flush(context.Background(), state); err != nil {
+						slog.Error("failed to flush document", "doc_id", state.Document.ID, "error", err)
+					}
+				}
+			}
+			store.evictIdle()
+		}
+	}
+}
+
+func (store *DocumentStore) shouldFlush(state *DocumentState) bool {
+	state.Lock()
+	defer state.Unlock()
+	if state.dirty() == 0 {
+		return false
+	}
+	return state.dirty() >= store.Settings.MaxPendingEvents ||
+		time.Since(state.lastChange) >= store.Settings.FlushQuiescence ||
+		time.Since(state.lastFlush) >= store.Settings.FlushInterval
+}
+
+// flush writes the pending events of a document and its snapshot in one
+// transaction. Edits keep being applied while it runs; only the events that
+// were written are taken off the pending list afterwards.
+func (store *DocumentStore) flush(ctx context.Context, state *DocumentState) error {
+	state.Lock()
+	if state.dirty() == 0 {
+		state.Unlock()
+		return nil
+	}
+	events := append([]models.DocumentEvent(nil), state.pending...)
+	snapshot := state.Document
+	changes := map[string]interface{}{
+		"content": snapshot.Content,
+		"version": snapshot.Version,
+	}
+	crdtChanges := state.crdtChanges
+	anchors := make(map[uint]anchor, len(state.movedAnchors))
+	for id := range state.movedAnchors {
+		anchors[id] = *state.anchors[id]
+	}
+	if state.CRDT != nil {
+		encoded, err := state.CRDT.Encode()
+		if err != nil {
+			state.Unlock()
+			return fmt.Errorf("failed to encode crdt state: %w", err)
+		}
+		changes["crdt_state"] = encoded
+	}
+	if state.RichText != nil {
+		encoded, err := json.Marshal(state.RichText)
+		if err != nil {
+			state.Unlock()
+			return fmt.Errorf("failed to encode rich text: %w", err)
+		}
+		changes["rich_text"] = encoded
+	}
+	state.Unlock()
+
+	ctx, span := tracing.Tracer.Start(ctx, "flush", trace.WithAttributes(
+		attribute.Int("doc.id", int(snapshot.ID)),
+		attribute.Int("flush.events", len(events)),
+		attribute.Int("flush.version", snapshot.Version),
+	))
+	start := time.Now()
+	err := store.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(events) > 0 {
+			if err := tx.Create(&events).Error; err != nil {
+				return fmt.Errorf("failed to save events: %w", err)
+			}
+		}
+		err := tx.Model(&models.Document{}).Where("id = ?", snapshot.ID).Updates(changes).Error
+		if err != nil {
+			return fmt.Errorf("failed to update document: %w", err)
+		}
+		for id, current := range anchors {
+			err := tx.Model(&models.Thread{}).Where("id = ?", id).Updates(map[string]interface{}{
+				"anchor_start":   current.Start,
+				"anchor_end":     current.End,
+				"anchor_version": snapshot.Version,
+			}).Error
+			if err != nil {
+				return fmt.Errorf("failed to update thread %d: %w", id, err)
+			}
+		}
+		return nil
+	})
+	tracing.EndSpan(span, err)
+	if err != nil {
+		metrics.FlushFailures.Inc()
+		return err
+	}
+	metrics.PersistDuration.Observe(time.Since(start).Seconds())
+
+	state.Lock()
+	state.pending = state.pending[len(events):]
+	state.crdtChanges -= crdtChanges
+	for id, flushed := range anchors {
+		// moved again while the flush ran, the next one writes it
+		if *state.anchors[id] == flushed {
+			delete(state.movedAnchors, id)
+		}
+	}
+	state.persistedVersion = snapshot.Version
+	state.lastFlush = time.Now()
+	state.trimRecent(store.Settings.RecentEvents)
+	state.Unlock()
+	return nil
+}
+
+// evictIdle unloads documents that are fully flushed, not in use and have
+// not been touched for EvictAfter.
+func (store *DocumentStore) evictIdle() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for key, state := range store.documents {
+		if state.references > 0 || time.Since(state.lastAccess) < store.Settings.EvictAfter {
+			continue
+		}
+		state.Lock()
+		flushed := state.dirty() == 0
+		state.Unlock()
+		if flushed {
+			delete(store.documents, key)
+		}
+	}
+}
+
+// Close stops the flusher and flushes every document with pending edits.
+func (store *DocumentStore) Close(ctx context.Context) error {
+	select {
+	case <-store.stop:
+	default:
+		close(store.stop)
+	}
+	select {
+	case <-store.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var failed error
+	for _, state := range store.states() {
+		if err := store.flush(ctx, state); err != nil {
+			slog.Error("failed to flush document on shutdown", "doc_id", state.Document.ID, "error", err)
+			failed = err
+		}
+	}
+	return failed
+}
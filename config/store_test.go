@@ -0,0 +1,346 @@
+//go:build sqlite
+
+package config
+
+import (
+	"context"
+	"errors"
+	"real-time-collab/internal/testdb"
+	"real-time-collab/models"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// quiet settings never flush on their own, tests call flush themselves
+var quietStoreSettings = StoreSettings{
+	FlushInterval:    time.Hour,
+	FlushQuiescence:  time.Hour,
+	MaxPendingEvents: 1000,
+	RecentEvents:     1000,
+	EvictAfter:       time.Hour,
+}
+
+// newTestStore starts a store like NewDocumentStore does, without
+// registering its metrics again.
+func newTestStore(t *testing.T, DB *gorm.DB, settings StoreSettings) *DocumentStore {
+	store := &DocumentStore{
+		DB:        DB,
+		Settings:  settings,
+		documents: make(map[string]*DocumentState),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go store.runFlusher()
+	t.Cleanup(func() {
+		select {
+		case <-store.stop:
+		default:
+			close(store.stop)
+		}
+		<-store.done
+	})
+	return store
+}
+
+// writeHook runs a function before every create and update made through a
+// database, in the order they are made. An error it returns fails the write.
+type writeHook struct {
+	mutex sync.Mutex
+	hook  func(operation string, table string) error
+}
+
+func (writes *writeHook) set(hook func(operation string, table string) error) {
+	writes.mutex.Lock()
+	defer writes.mutex.Unlock()
+	writes.hook = hook
+}
+
+func (writes *writeHook) run(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		writes.mutex.Lock()
+		hook := writes.hook
+		writes.mutex.Unlock()
+		if hook == nil {
+			return
+		}
+		if err := hook(operation, tx.Statement.Table); err != nil {
+			tx.AddError(err)
+		}
+	}
+}
+
+func newTestDocument(t *testing.T) (*gorm.DB, *writeHook, models.Document) {
+	DB := testdb.Open(t)
+	writes := &writeHook{}
+	if err := DB.Callback().Create().Before("gorm:create").Register("test:write_hook", writes.run("create")); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Callback().Update().Before("gorm:update").Register("test:write_hook", writes.run("update")); err != nil {
+		t.Fatal(err)
+	}
+	document := models.Document{Title: "notes", Content: "", Mode: models.DocumentModeOT, Type: models.DocumentTypeText}
+	if err := DB.Create(&document).Error; err != nil {
+		t.Fatal(err)
+	}
+	return DB, writes, document
+}
+
+// insert commits an insert of text at the end of the document as the next
+// version.
+func insert(state *DocumentState, text string) {
+	state.Lock()
+	defer state.Unlock()
+	document := state.Document
+	event := models.DocumentEvent{
+		DocID:     strconv.FormatUint(uint64(document.ID), 10),
+		Operation: "insert",
+		Position:  len(document.Content),
+		Content:   text,
+		Version:   document.Version + 1,
+		Timestamp: time.Now(),
+	}
+	document.Content += text
+	document.Version++
+	state.commit(document, []models.DocumentEvent{event})
+}
+
+func storedDocument(t *testing.T, DB *gorm.DB, id uint) models.Document {
+	var document models.Document
+	if err := DB.First(&document, "id = ?", id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return document
+}
+
+func storedEvents(t *testing.T, DB *gorm.DB, id uint) []models.DocumentEvent {
+	var events []models.DocumentEvent
+	err := DB.Where("doc_id = ?", strconv.FormatUint(uint64(id), 10)).Order("version ASC, id ASC").Find(&events).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func acquire(t *testing.T, store *DocumentStore, id uint) *DocumentState {
+	state, err := store.Acquire(context.Background(), strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Release(state) })
+	return state
+}
+
+func TestFlushWritesEventsThenSnapshotInOneTransaction(t *testing.T) {
+	DB, writes, document := newTestDocument(t)
+	store := newTestStore(t, DB, quietStoreSettings)
+	state := acquire(t, store, document.ID)
+	insert(state, "a")
+	insert(state, "b")
+
+	var made []string
+	writes.set(func(operation string, table string) error {
+		made = append(made, operation+" "+table)
+		return nil
+	})
+	if err := store.flush(context.Background(), state); err != nil {
+		t.Fatal(err)
+	}
+	if len(made) != 2 || made[0] != "create document_events" || made[1] != "update documents" {
+		t.Errorf("flush wrote %v, want the events before the snapshot", made)
+	}
+
+	stored := storedDocument(t, DB, document.ID)
+	if stored.Content != "ab" || stored.Version != 2 {
+		t.Errorf("snapshot is %q at version %d, want \"ab\" at 2", stored.Content, stored.Version)
+	}
+	events := storedEvents(t, DB, document.ID)
+	if len(events) != 2 || events[0].Version != 1 || events[1].Version != 2 {
+		t.Fatalf("event log is %+v, want versions 1 and 2", events)
+	}
+	state.Lock()
+	defer state.Unlock()
+	if state.dirty() != 0 || state.persistedVersion != 2 {
+		t.Errorf("after flush dirty = %d, persisted version = %d", state.dirty(), state.persistedVersion)
+	}
+}
+
+func TestFlushKeepsEditsCommittedWhileItRuns(t *testing.T) {
+	DB, writes, document := newTestDocument(t)
+	store := newTestStore(t, DB, quietStoreSettings)
+	state := acquire(t, store, document.ID)
+	insert(state, "a")
+	insert(state, "b")
+
+	// an editor commits while the flush transaction is open
+	var once sync.Once
+	writes.set(func(operation string, table string) error {
+		once.Do(func() { insert(state, "c") })
+		return nil
+	})
+	if err := store.flush(context.Background(), state); err != nil {
+		t.Fatal(err)
+	}
+	if stored := storedDocument(t, DB, document.ID); stored.Version != 2 {
+		t.Fatalf("flushed version %d, want the 2 the flush started with", stored.Version)
+	}
+	state.Lock()
+	pending := append([]models.DocumentEvent(nil), state.pending...)
+	state.Unlock()
+	if len(pending) != 1 || pending[0].Version != 3 {
+		t.Fatalf("pending after flush is %+v, want only version 3", pending)
+	}
+
+	writes.set(nil)
+	if err := store.flush(context.Background(), state); err != nil {
+		t.Fatal(err)
+	}
+	if stored := storedDocument(t, DB, document.ID); stored.Content != "abc" || stored.Version != 3 {
+		t.Errorf("snapshot is %q at version %d, want \"abc\" at 3", stored.Content, stored.Version)
+	}
+	if events := storedEvents(t, DB, document.ID); len(events) != 3 {
+		t.Errorf("event log has %d events, want 3", len(events))
+	}
+}
+
+func TestFailedFlushKeepsEventsAndWritesNothing(t *testing.T) {
+	DB, writes, document := newTestDocument(t)
+	store := newTestStore(t, DB, quietStoreSettings)
+	state := acquire(t, store, document.ID)
+	insert(state, "a")
+	insert(state, "b")
+
+	// the events are written, then the snapshot fails
+	down := errors.New("database is down")
+	writes.set(func(operation string, table string) error {
+		if table == "documents" {
+			return down
+		}
+		return nil
+	})
+	if err := store.flush(context.Background(), state); !errors.Is(err, down) {
+		t.Fatalf("flush returned %v, want %v", err, down)
+	}
+	if events := storedEvents(t, DB, document.ID); len(events) != 0 {
+		t.Errorf("a failed flush left %d events in the log", len(events))
+	}
+	if stored := storedDocument(t, DB, document.ID); stored.Version != 0 {
+		t.Errorf("a failed flush left the snapshot at version %d", stored.Version)
+	}
+	state.Lock()
+	dirty := state.dirty()
+	state.Unlock()
+	if dirty != 2 {
+		t.Fatalf("%d events pending after a failed flush, want 2", dirty)
+	}
+
+	writes.set(nil)
+	if err := store.flush(context.Background(), state); err != nil {
+		t.Fatal(err)
+	}
+	if stored := storedDocument(t, DB, document.ID); stored.Content != "ab" || stored.Version != 2 {
+		t.Errorf("retried flush stored %q at version %d", stored.Content, stored.Version)
+	}
+}
+
+func TestFlusherWritesQuietDocuments(t *testing.T) {
+	DB, _, document := newTestDocument(t)
+	settings := quietStoreSettings
+	settings.FlushQuiescence = 20 * time.Millisecond
+	store := newTestStore(t, DB, settings)
+	state := acquire(t, store, document.ID)
+	insert(state, "a")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for storedDocument(t, DB, document.ID).Version != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the flusher did not write the quiet document")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShouldFlush(t *testing.T) {
+	store := &DocumentStore{Settings: StoreSettings{
+		FlushInterval:    time.Second,
+		FlushQuiescence:  100 * time.Millisecond,
+		MaxPendingEvents: 3,
+	}}
+	now := time.Now()
+	tests := []struct {
+		name       string
+		pending    int
+		lastChange time.Time
+		lastFlush  time.Time
+		want       bool
+	}{
+		{"nothing pending", 0, now.Add(-time.Hour), now.Add(-time.Hour), false},
+		{"still editing", 1, now, now, false},
+		{"quiet", 1, now.Add(-200 * time.Millisecond), now, true},
+		{"batch full", 3, now, now, true},
+		{"interval passed", 1, now, now.Add(-2 * time.Second), true},
+	}
+	for _, test := range tests {
+		state := &DocumentState{pending: make([]models.DocumentEvent, test.pending), lastChange: test.lastChange, lastFlush: test.lastFlush}
+		if got := store.shouldFlush(state); got != test.want {
+			t.Errorf("%s: shouldFlush = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCloseFlushesPendingEdits(t *testing.T) {
+	DB, _, document := newTestDocument(t)
+	store := newTestStore(t, DB, quietStoreSettings)
+	state := acquire(t, store, document.ID)
+	insert(state, "a")
+	insert(state, "b")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := store.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stored := storedDocument(t, DB, document.ID); stored.Content != "ab" || stored.Version != 2 {
+		t.Errorf("after Close the snapshot is %q at version %d, want \"ab\" at 2", stored.Content, stored.Version)
+	}
+	select {
+	case <-store.done:
+	default:
+		t.Error("Close did not stop the flusher")
+	}
+}
+
+func TestRestartRecoversFlushedHistory(t *testing.T) {
+	DB, _, document := newTestDocument(t)
+	store := newTestStore(t, DB, quietStoreSettings)
+	state := acquire(t, store, document.ID)
+	insert(state, "a")
+	insert(state, "b")
+	if err := store.flush(context.Background(), state); err != nil {
+		t.Fatal(err)
+	}
+	// committed and broadcast, then the process dies before the next flush
+	insert(state, "c")
+
+	restarted := newTestStore(t, DB, quietStoreSettings)
+	recovered := acquire(t, restarted, document.ID)
+	recovered.Lock()
+	defer recovered.Unlock()
+	if recovered.Document.Content != "ab" || recovered.Document.Version != 2 {
+		t.Fatalf("recovered %q at version %d, want the flushed \"ab\" at 2", recovered.Document.Content, recovered.Document.Version)
+	}
+	// a client that saw version 1 catches up from the event log
+	events, err := recovered.EventsSince(DB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Version != 2 || events[0].Content != "b" {
+		t.Errorf("events since 1 are %+v, want the insert of b at version 2", events)
+	}
+	if recovered.dirty() != 0 {
+		t.Errorf("the recovered state has %d pending events", recovered.dirty())
+	}
+}
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"real-time-collab/metrics"
+	"real-time-collab/models"
+	"real-time-collab/tracing"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrSuggestionDecided is returned when a suggestion was accepted or
+	// rejected already.
+	ErrSuggestionDecided = errors.New("suggestion was already decided")
+	// ErrSuggestionConflict is returned when the text a suggestion deletes
+	// or replaces has been deleted since it was made.
+	ErrSuggestionConflict = errors.New("the suggested text has been changed since")
+)
+
+func suggestionEvent(suggestion models.Suggestion) models.DocumentEvent {
+	return models.DocumentEvent{
+		DocID:     suggestion.DocID,
+		UserID:    suggestion.UserID,
+		Operation: suggestion.Operation,
+		Position:  suggestion.Position,
+		Length:    suggestion.Length,
+		Content:   suggestion.Content,
+		Version:   suggestion.BaseVersion,
+	}
+}
+
+// suggest stores an edit a client proposes instead of applying it and
+// shows it to the room, the sender included so it learns the id.
+func (pool *ConnectionPool) suggest(ctx context.Context, sender *websocket.Conn, request ClientMessage, DB *gorm.DB) error {
+	if request.Event == nil {
+		return fmt.Errorf("suggest message without an edit")
+	}
+	event := *request.Event
+	event.DocID = request.DocID
+	if event.UserID == "" {
+		event.UserID = request.UserID
+	}
+	if err := validateDocumentEvent(&event); err != nil {
+		return err
+	}
+	ctx, span := tracing.Tracer.Start(ctx, "suggest", trace.WithAttributes(
+		attribute.String("doc.id", event.DocID),
+		attribute.String("event.operation", event.Operation),
+	))
+	defer span.End()
+
+	state, err := pool.Store.Acquire(ctx, event.DocID)
+	if err != nil {
+		return err
+	}
+	defer pool.Store.Release(state)
+	state.Lock()
+	suggestion, err := pool.Store.saveSuggestion(ctx, state, event, DB)
+	version := state.Document.Version
+	state.Unlock()
+	if err != nil {
+		return err
+	}
+	metrics.EventsProcessed.WithLabelValues(SuggestMessageType).Inc()
+
+	pool.JoinRoom(sender, event.DocID, event.UserID)
+	pool.Publish(ctx, event.DocID, ServerMessage{Type: SuggestionMessageType, DocID: event.DocID, Version: version, Suggestion: &suggestion})
+	return nil
+}
+
+// saveSuggestion rebases a suggested edit to the head version and stores
+// it, so a suggestion that cannot be rebased is never saved. The state must
+// be locked.
+func (store *DocumentStore) saveSuggestion(ctx context.Context, state *DocumentState, event models.DocumentEvent, DB *gorm.DB) (models.Suggestion, error) {
+	suggestion := models.Suggestion{
+		DocID:       strconv.FormatUint(uint64(state.Document.ID), 10),
+		UserID:      event.UserID,
+		Operation:   event.Operation,
+		Position:    event.Position,
+		Length:      event.Length,
+		Content:     event.Content,
+		BaseVersion: event.Version,
+		Status:      models.SuggestionPending,
+	}
+	if err := requireMode(state, models.DocumentModeOT); err != nil {
+		return suggestion, err
+	}
+	if err := requireType(state, models.DocumentTypeText); err != nil {
+		return suggestion, err
+	}
+	if event.Version > state.Document.Version {
+		return suggestion, fmt.Errorf("base version %d is ahead of the document (%d)", event.Version, state.Document.Version)
+	}
+	if err := store.rebaseSuggestion(ctx, state, &suggestion); err != nil {
+		return suggestion, err
+	}
+	if err := DB.WithContext(ctx).Create(&suggestion).Error; err != nil {
+		return suggestion, fmt.Errorf("failed to save suggestion: %w", err)
+	}
+	return suggestion, nil
+}
+
+// RebaseSuggestions moves pending suggestions to the head version of their
+// document so collaborators see them where they apply now. The stored
+// suggestions keep their base version.
+func (store *DocumentStore) RebaseSuggestions(ctx context.Context, suggestions []models.Suggestion) error {
+	for i := range suggestions {
+		if suggestions[i].Status != models.SuggestionPending {
+			continue
+		}
+		state, err := store.Acquire(ctx, suggestions[i].DocID)
+		if err != nil {
+			return err
+		}
+		state.Lock()
+		err = store.rebaseSuggestion(ctx, state, &suggestions[i])
+		state.Unlock()
+		store.Release(state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebaseSuggestion transforms a suggestion over the events committed since
+// its base version. The state must be locked.
+func (store *DocumentStore) rebaseSuggestion(ctx context.Context, state *DocumentState, suggestion *models.Suggestion) error {
+	event := suggestionEvent(*suggestion)
+	if err := transformDocumentEvent(&event, state, store.DB.WithContext(ctx)); err != nil {
+		return err
+	}
+	suggestion.Position = event.Position
+	suggestion.Length = event.Length
+	suggestion.BaseVersion = state.Document.Version
+	return nil
+}
+
+// AcceptSuggestion applies a pending suggestion on behalf of decidedBy. It
+// is transformed over the edits made since its base version, applied with
+// applyChangesToDocument and broadcast like an edit made by its author.
+func (pool *ConnectionPool) AcceptSuggestion(ctx context.Context, suggestion *models.Suggestion, decidedBy string) error {
+	state, err := pool.Store.Acquire(ctx, suggestion.DocID)
+	if err != nil {
+		return err
+	}
+	defer pool.Store.Release(state)
+	defer pool.publishQueued(state)
+	state.Lock()
+	defer state.Unlock()
+	if err := requireMode(state, models.DocumentModeOT); err != nil {
+		return err
+	}
+
+	event := suggestionEvent(*suggestion)
+	if err := transformDocumentEvent(&event, state, pool.Store.DB.WithContext(ctx)); err != nil {
+		return err
+	}
+	if event.Operation != "insert" && suggestion.Length > 0 && event.Length == 0 {
+		return ErrSuggestionConflict
+	}
+	document := state.Document
+	if err := applyChangesToDocument(&document, &event); err != nil {
+		return fmt.Errorf("%w: %v", ErrSuggestionConflict, err)
+	}
+	event.Timestamp = time.Now()
+
+	// decided in the database first so two owners cannot both accept it
+	if err := decideSuggestion(pool.Store.DB.WithContext(ctx), suggestion, models.SuggestionAccepted, decidedBy, document.Version); err != nil {
+		return err
+	}
+	state.commit(document, []models.DocumentEvent{event})
+	metrics.EventsProcessed.WithLabelValues(event.Operation).Inc()
+
+	// queued under the lock so the edit reaches the room in version order
+	state.queueBroadcast(BroadcastMessage{
+		Message: ServerMessage{
+			Type:    OperationMessageType,
+			DocID:   event.DocID,
+			Version: document.Version,
+			Content: document.Content,
+			Events:  []models.DocumentEvent{event},
+		},
+		DocID:   event.DocID,
+		Context: ctx,
+	})
+	state.queueBroadcast(BroadcastMessage{
+		Message: ServerMessage{Type: SuggestionMessageType, DocID: event.DocID, Version: document.Version, Suggestion: suggestion},
+		DocID:   event.DocID,
+		Context: ctx,
+	})
+	return nil
+}
+
+// RejectSuggestion discards a pending suggestion and tells the room.
+func (pool *ConnectionPool) RejectSuggestion(ctx context.Context, suggestion *models.Suggestion, decidedBy string) error {
+	if err := decideSuggestion(pool.Store.DB.WithContext(ctx), suggestion, models.SuggestionRejected, decidedBy, 0); err != nil {
+		return err
+	}
+	pool.Publish(ctx, suggestion.DocID, ServerMessage{Type: SuggestionMessageType, DocID: suggestion.DocID, Suggestion: suggestion})
+	return nil
+}
+
+func decideSuggestion(tx *gorm.DB, suggestion *models.Suggestion, status string, decidedBy string, version int) error {
+	now := time.Now()
+	result := tx.Model(&models.Suggestion{}).
+		Where("id = ? and status = ?", suggestion.ID, models.SuggestionPending).
+		Updates(map[string]interface{}{
+			"status":          status,
+			"decided_by":      decidedBy,
+			"decided_at":      now,
+			"applied_version": version,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update suggestion: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrSuggestionDecided
+	}
+	suggestion.Status = status
+	suggestion.DecidedBy = decidedBy
+	suggestion.DecidedAt = &now
+	suggestion.AppliedVersion = version
+	return nil
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"real-time-collab/models"
+	"real-time-collab/richtext"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrVersionUnavailable is returned for a version a document never had
+	// or whose content cannot be rebuilt.
+	ErrVersionUnavailable = errors.New("version is not available")
+	// ErrTagExists is returned when a document already has a tag by a name.
+	ErrTagExists = errors.New("a tag with this name already exists")
+)
+
+// HeadVersion asks ContentAt for the current version of a document.
+const HeadVersion = -1
+
+// maxBranchDepth bounds the walk from a branch up through its parents, so a
+// ParentID cycle cannot recurse forever.
+const maxBranchDepth = 32
+
+// ContentAt returns a snapshot of a document at a version, or at its head
+// for HeadVersion, with the version it resolved to. Past versions are
+// rebuilt from the nearest snapshot at or before them by replaying the event
+// log; CRDT documents keep no event log, so only their snapshots are
+// available. Versions a branch shares with its parent are read from the
+// parent, which userID must be able to read.
+func (store *DocumentStore) ContentAt(ctx context.Context, docID string, version int, userID string) (models.DocumentSnapshot, error) {
+	state, err := store.Acquire(ctx, docID)
+	if err != nil {
+		return models.DocumentSnapshot{}, err
+	}
+	defer store.Release(state)
+	return store.contentAt(ctx, state, version, userID, 0)
+}
+
+func (store *DocumentStore) contentAt(ctx context.Context, state *DocumentState, version int, userID string, depth int) (models.DocumentSnapshot, error) {
+	tx := store.DB.WithContext(ctx)
+	key := strconv.FormatUint(uint64(state.Document.ID), 10)
+
+	state.Lock()
+	head := state.Document
+	if state.RichText != nil {
+		head.RichText, _ = json.Marshal(*state.RichText)
+	}
+	if version == HeadVersion || version == head.Version {
+		state.Unlock()
+		return models.DocumentSnapshot{DocID: key, Version: head.Version, Content: head.Content, RichText: head.RichText}, nil
+	}
+	if version < 0 || version > head.Version {
+		state.Unlock()
+		return models.DocumentSnapshot{}, fmt.Errorf("%w: %d (head is %d)", ErrVersionUnavailable, version, head.Version)
+	}
+	if head.ParentID != nil && version < head.ForkVersion {
+		// a branch shares the history of its parent up to the fork
+		state.Unlock()
+		snapshot, err := store.parentContentAt(ctx, *head.ParentID, version, userID, depth)
+		snapshot.DocID = key
+		return snapshot, err
+	}
+
+	// documents created before snapshots were kept started out empty
+	base := models.DocumentSnapshot{DocID: key}
+	err := tx.Where("doc_id = ? and version <= ?", key, version).
+		Order("version DESC").
+		Limit(1).
+		Find(&base).Error
+	if err != nil {
+		state.Unlock()
+		return models.DocumentSnapshot{}, fmt.Errorf("failed to fetch snapshot: %w", err)
+	}
+	if base.Version == version {
+		state.Unlock()
+		return base, nil
+	}
+	if head.Mode == models.DocumentModeCRDT {
+		state.Unlock()
+		return models.DocumentSnapshot{}, fmt.Errorf("%w: crdt documents only keep tagged versions", ErrVersionUnavailable)
+	}
+	events, err := state.EventsSince(tx, base.Version)
+	state.Unlock()
+	if err != nil {
+		return models.DocumentSnapshot{}, err
+	}
+	return replay(base, events, version, head.Type)
+}
+
+// parentContentAt reads a version a branch shares with its parent from the
+// parent, when userID may read it.
+func (store *DocumentStore) parentContentAt(ctx context.Context, parentID uint, version int, userID string, depth int) (models.DocumentSnapshot, error) {
+	if depth >= maxBranchDepth {
+		return models.DocumentSnapshot{}, fmt.Errorf("%w: branches nest deeper than %d", ErrVersionUnavailable, maxBranchDepth)
+	}
+	state, err := store.Acquire(ctx, strconv.FormatUint(uint64(parentID), 10))
+	if err != nil {
+		return models.DocumentSnapshot{}, err
+	}
+	defer store.Release(state)
+	state.Lock()
+	parent := state.Document
+	state.Unlock()
+	permission, err := DocumentPermission(store.DB.WithContext(ctx), parent, userID)
+	if err != nil {
+		return models.DocumentSnapshot{}, err
+	}
+	if permission == models.PermissionNone {
+		return models.DocumentSnapshot{}, fmt.Errorf("%w: %d is shared with a document you cannot read", ErrVersionUnavailable, version)
+	}
+	return store.contentAt(ctx, state, version, userID, depth+1)
+}
+
+// replay applies the events after a snapshot up to and including version.
+func replay(base models.DocumentSnapshot, events []models.DocumentEvent, version int, documentType string) (models.DocumentSnapshot, error) {
+	document := models.Document{Content: base.Content}
+	var rich richtext.Delta
+	if documentType == models.DocumentTypeRichText {
+		loaded, err := loadRichText(models.Document{Content: base.Content, RichText: base.RichText})
+		if err != nil {
+			return models.DocumentSnapshot{}, err
+		}
+		rich = *loaded
+	}
+	for _, event := range events {
+		if event.Version > version {
+			break
+		}
+		if event.Operation == DeltaOperation {
+			change, err := richtext.Parse(event.Delta)
+			if err == nil {
+				rich, err = richtext.Apply(rich, change)
+			}
+			if err != nil {
+				return models.DocumentSnapshot{}, fmt.Errorf("%w: replaying version %d: %v", ErrVersionUnavailable, event.Version, err)
+			}
+			continue
+		}
+		if err := applyOperation(&document, &event); err != nil {
+			return models.DocumentSnapshot{}, fmt.Errorf("%w: replaying version %d: %v", ErrVersionUnavailable, event.Version, err)
+		}
+	}
+
+	snapshot := models.DocumentSnapshot{DocID: base.DocID, Version: version, Content: document.Content}
+	if documentType == models.DocumentTypeRichText {
+		snapshot.Content = rich.Text()
+		snapshot.RichText, _ = json.Marshal(rich)
+	}
+	return snapshot, nil
+}
+
+// TagVersion names a version of a document, its head when tag.Version is
+// HeadVersion, and keeps a snapshot of it so it can be diffed cheaply. The
+// version is read as tag.CreatedBy.
+func (store *DocumentStore) TagVersion(ctx context.Context, tag *models.VersionTag) error {
+	state, err := store.Acquire(ctx, tag.DocID)
+	if err != nil {
+		return err
+	}
+	defer store.Release(state)
+	snapshot, err := store.contentAt(ctx, state, tag.Version, tag.CreatedBy, 0)
+	if err != nil {
+		return err
+	}
+	tag.DocID = snapshot.DocID
+	tag.Version = snapshot.Version
+
+	return store.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&models.VersionTag{}).Where("doc_id = ? and name = ?", tag.DocID, tag.Name).Count(&existing).Error; err != nil {
+			return fmt.Errorf("failed to check tags: %w", err)
+		}
+		if existing > 0 {
+			return ErrTagExists
+		}
+		if err := tx.Create(tag).Error; err != nil {
+			return fmt.Errorf("failed to save tag: %w", err)
+		}
+		var snapshots int64
+		if err := tx.Model(&models.DocumentSnapshot{}).Where("doc_id = ? and version = ?", snapshot.DocID, snapshot.Version).Count(&snapshots).Error; err != nil {
+			return fmt.Errorf("failed to check snapshots: %w", err)
+		}
+		if snapshots == 0 {
+			if err := tx.Create(&snapshot).Error; err != nil {
+				return fmt.Errorf("failed to save snapshot: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,253 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"real-time-collab/models"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotMember  = errors.New("not a member of the workspace")
+	ErrLastAdmin  = errors.New("a workspace needs at least one admin")
+	ErrInviteUsed = errors.New("invite already accepted")
+)
+
+// accessTTL is how long a connection trusts the permission it looked up on
+// a document, bounding how long a removed member can keep editing.
+const accessTTL = 30 * time.Second
+
+type documentAccess struct {
+	permission string
+	checkedAt  time.Time
+}
+
+func ValidRole(role string) bool {
+	return role == models.WorkspaceRoleAdmin || role == models.WorkspaceRoleMember || role == models.WorkspaceRoleGuest
+}
+
+// ValidDefaultPermission reports whether permission can be a workspace's
+// default for its members.
+func ValidDefaultPermission(permission string) bool {
+	return permission == models.PermissionView || permission == models.PermissionEdit
+}
+
+// PermissionAllows reports whether permission lets a user read a document,
+// or change it when write is set.
+func PermissionAllows(permission string, write bool) bool {
+	if write {
+		return permission == models.PermissionEdit
+	}
+	return permission == models.PermissionView || permission == models.PermissionEdit
+}
+
+// MemberRole returns the role of a user in a workspace, or "" when the user
+// is not a member.
+func MemberRole(DB *gorm.DB, workspaceID uint, userID string) (string, error) {
+	if userID == "" {
+		return "", nil
+	}
+	var membership models.Membership
+	err := DB.Where("workspace_id = ? and user_id = ?", workspaceID, userID).First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch membership: %w", err)
+	}
+	return membership.Role, nil
+}
+
+// RolePermission is what a role gets on documents members get permission
+// on. Guests never get more than view.
+func RolePermission(role string, permission string) string {
+	switch role {
+	case models.WorkspaceRoleAdmin:
+		return models.PermissionEdit
+	case models.WorkspaceRoleMember:
+		return permission
+	case models.WorkspaceRoleGuest:
+		if permission == models.PermissionNone {
+			return models.PermissionNone
+		}
+		return models.PermissionView
+	}
+	return models.PermissionNone
+}
+
+// DocumentPermission is what a user may do with a document. Documents
+// outside of a workspace stay editable by everyone, unless filed in a
+// personal folder, which makes them their creator's alone.
+func DocumentPermission(DB *gorm.DB, document models.Document, userID string) (string, error) {
+	if document.WorkspaceID == nil {
+		if document.FolderID == nil {
+			return models.PermissionEdit, nil
+		}
+		if document.CreatedBy != "" && document.CreatedBy == userID {
+			return models.PermissionEdit, nil
+		}
+		return models.PermissionNone, nil
+	}
+	return workspacePermission(DB, *document.WorkspaceID, document.FolderID, userID)
+}
+
+// workspacePermission is what a user gets on the items of a workspace in
+// folderID, nil for the top of the workspace.
+func workspacePermission(DB *gorm.DB, workspaceID uint, folderID *uint, userID string) (string, error) {
+	role, err := MemberRole(DB, workspaceID, userID)
+	if err != nil || role == "" {
+		return models.PermissionNone, err
+	}
+	if role == models.WorkspaceRoleAdmin {
+		return models.PermissionEdit, nil
+	}
+	permission, err := InheritedPermission(DB, folderID)
+	if err != nil {
+		return models.PermissionNone, err
+	}
+	if permission == "" {
+		var workspace models.Workspace
+		if err := DB.First(&workspace, "id = ?", workspaceID).Error; err != nil {
+			return models.PermissionNone, fmt.Errorf("failed to fetch workspace: %w", err)
+		}
+		permission = workspace.DefaultPermission
+	}
+	return RolePermission(role, permission), nil
+}
+
+// CreateWorkspace saves a workspace with its creator as the first admin.
+func CreateWorkspace(DB *gorm.DB, workspace *models.Workspace) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(workspace).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.Membership{WorkspaceID: workspace.ID, UserID: workspace.CreatedBy, Role: models.WorkspaceRoleAdmin}).Error
+	})
+}
+
+// SetMemberRole changes the role of a member, or removes the member when
+// role is empty. The last admin can neither leave nor be demoted.
+func SetMemberRole(DB *gorm.DB, workspaceID uint, userID string, role string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var membership models.Membership
+		// locked so two admins demoting each other cannot both succeed
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("workspace_id = ? and user_id = ?", workspaceID, userID).First(&membership).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotMember
+		}
+		if err != nil {
+			return err
+		}
+		if membership.Role == models.WorkspaceRoleAdmin && role != models.WorkspaceRoleAdmin {
+			var admins []models.Membership
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("workspace_id = ? and role = ?", workspaceID, models.WorkspaceRoleAdmin).Find(&admins).Error
+			if err != nil {
+				return err
+			}
+			if len(admins) <= 1 {
+				return ErrLastAdmin
+			}
+		}
+		if role == "" {
+			return tx.Unscoped().Delete(&membership).Error
+		}
+		return tx.Model(&membership).Update("role", role).Error
+	})
+}
+
+// AcceptInvite makes userID a member with the role of the invite. Users
+// who already are members keep their role.
+func AcceptInvite(DB *gorm.DB, invite *models.WorkspaceInvite, userID string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&models.WorkspaceInvite{}).
+			Where("id = ? and accepted_at is null", invite.ID).
+			Updates(map[string]interface{}{"accepted_at": now, "accepted_by": userID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInviteUsed
+		}
+		invite.AcceptedAt = &now
+		invite.AcceptedBy = userID
+		role, err := MemberRole(tx, invite.WorkspaceID, userID)
+		if err != nil || role != "" {
+			return err
+		}
+		return tx.Create(&models.Membership{WorkspaceID: invite.WorkspaceID, UserID: userID, Role: invite.Role}).Error
+	})
+}
+
+// SharePermission is what a share link still grants on its document.
+func SharePermission(DB *gorm.DB, shareID uint) (string, error) {
+	var link models.ShareLink
+	if err := DB.First(&link, "id = ?", shareID).Error; err != nil {
+		return models.PermissionNone, fmt.Errorf("failed to fetch share link: %w", err)
+	}
+	if !link.Active(time.Now()) {
+		return models.PermissionNone, nil
+	}
+	return link.Permission, nil
+}
+
+// checkAccess checks the sender of a websocket message may read, or
+// write, a document. Permissions are cached on the connection for
+// accessTTL; anonymous connections have no access to workspace documents
+// and connections opened with a share link only what the link grants.
+// Messages from connections that already left, or naming a document that
+// does not exist, are refused.
+func (pool *ConnectionPool) checkAccess(ctx context.Context, sender *websocket.Conn, docID string, principal *Principal, write bool, DB *gorm.DB) error {
+	pool.Mutex.Lock()
+	client, ok := pool.Connections[sender]
+	pool.Mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: the connection is closed", ErrForbidden)
+	}
+
+	client.accessMutex.Lock()
+	access, cached := client.access[docID]
+	client.accessMutex.Unlock()
+	if !cached || time.Since(access.checkedAt) > accessTTL {
+		id, err := strconv.ParseUint(docID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid document id %q", ErrForbidden, docID)
+		}
+		var document models.Document
+		err = DB.WithContext(ctx).Select("id", "workspace_id", "folder_id", "created_by").First(&document, "id = ?", id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: document %s not found", ErrForbidden, docID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch document: %w", err)
+		}
+		var permission string
+		switch {
+		case principal == nil:
+			permission, err = DocumentPermission(DB.WithContext(ctx), document, "")
+		case principal.ShareID != 0:
+			permission, err = SharePermission(DB.WithContext(ctx), principal.ShareID)
+		default:
+			permission, err = DocumentPermission(DB.WithContext(ctx), document, principal.UserID)
+		}
+		if err != nil {
+			return err
+		}
+		access = documentAccess{permission: permission, checkedAt: time.Now()}
+		client.accessMutex.Lock()
+		client.access[docID] = access
+		client.accessMutex.Unlock()
+	}
+	if !PermissionAllows(access.permission, write) {
+		return fmt.Errorf("%w: %s access to document %s", ErrForbidden, access.permission, docID)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"real-time-collab/audit"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/mailer"
+	"real-time-collab/models"
+	"real-time-collab/services"
+	"real-time-collab/utils"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// mailTimeout bounds how long a background send may take.
+const mailTimeout = 30 * time.Second
+
+type EmailRequest struct {
+	Email string `json:"email"`
+}
+
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// sendMail delivers a message in the background, so how long a request
+// takes does not tell whether an account exists.
+func sendMail(r *http.Request, mail mailer.Mailer, message mailer.Message) {
+	logger := logging.FromContext(r.Context())
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		if err := mail.Send(ctx, message); err != nil {
+			logger.Error("failed to send mail", "subject", message.Subject, "error", err)
+		}
+	}()
+}
+
+// sendVerificationEmail mails a user a link that verifies their address.
+// The link is bound to the address, so it stops working if it changes.
+func sendVerificationEmail(r *http.Request, mail mailer.Mailer, settings config.AccountSettings, user models.User) error {
+	token, err := utils.GenerateActionToken(user.ID, utils.VerifyEmailPurpose, utils.Fingerprint(user.Email), settings.VerificationTTL)
+	if err != nil {
+		return err
+	}
+	sendMail(r, mail, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: "Hi " + user.Username + ",\n\nconfirm your email address by opening this link:\n\n" +
+			settings.BaseURL + "/verify-email?token=" + url.QueryEscape(token) +
+			"\n\nThe link expires in " + settings.VerificationTTL.String() + ".\n",
+	})
+	return nil
+}
+
+// RequestEmailVerification sends a new verification link. It answers the
+// same whether or not the address belongs to an account.
+func RequestEmailVerification(w http.ResponseWriter, r *http.Request, DB *gorm.DB, mail mailer.Mailer, settings config.AccountSettings) {
+	var request EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Email == "" {
+		SendErrorResponse(w, http.StatusBadRequest, "email is required")
+		return
+	}
+	var user models.User
+	exists, err := services.FindUserByEmailId(&user, DB, request.Email)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return
+	}
+	if exists && !user.EmailVerified {
+		if err := sendVerificationEmail(r, mail, settings, user); err != nil {
+			logging.FromContext(r.Context()).Error("failed to create verification token", "user_id", user.ID, "error", err)
+		}
+	}
+	SendJSONResponse(w, http.StatusAccepted, "if the address needs verifying, an email is on its way")
+}
+
+// VerifyEmail marks the address of an account as verified. The token comes
+// from the token query parameter of the emailed link or from the body.
+func VerifyEmail(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		var request TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err == nil {
+			token = request.Token
+		}
+	}
+	userId, fingerprint, err := utils.ParseActionToken(token, utils.VerifyEmailPurpose)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+	var user models.User
+	exists, err := services.FindUserById(&user, DB, userId)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return
+	}
+	if !exists || fingerprint != utils.Fingerprint(user.Email) {
+		SendErrorResponse(w, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+	if !user.EmailVerified {
+		err := DB.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"email_verified":    true,
+			"email_verified_at": time.Now(),
+		}).Error
+		if err != nil {
+			SendErrorResponse(w, http.StatusInternalServerError, "failed to update user")
+			return
+		}
+		logging.FromContext(r.Context()).Info("Email verified", "user_id", user.ID)
+		audit.Record(r, DB, audit.Entry{Action: audit.ActionEmailVerified, ActorID: userId, TargetType: audit.TargetUser, TargetID: userId, Details: map[string]interface{}{"email": user.Email}})
+	}
+	SendJSONResponse(w, http.StatusOK, "email verified")
+}
+
+// RequestPasswordReset mails a password reset link. It answers the same
+// whether or not the address belongs to an account.
+func RequestPasswordReset(w http.ResponseWriter, r *http.Request, DB *gorm.DB, mail mailer.Mailer, settings config.AccountSettings) {
+	var request EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Email == "" {
+		SendErrorResponse(w, http.StatusBadRequest, "email is required")
+		return
+	}
+	var user models.User
+	exists, err := services.FindUserByEmailId(&user, DB, request.Email)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return
+	}
+	if exists {
+		// bound to the current hash, so the link works once
+		token, err := utils.GenerateActionToken(user.ID, utils.ResetPasswordPurpose, utils.Fingerprint(user.Password), settings.ResetTTL)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to create reset token", "user_id", user.ID, "error", err)
+		} else {
+			sendMail(r, mail, mailer.Message{
+				To:      user.Email,
+				Subject: "Reset your password",
+				Body: "Hi " + user.Username + ",\n\nchoose a new password by opening this link:\n\n" +
+					settings.BaseURL + "/reset-password?token=" + url.QueryEscape(token) +
+					"\n\nThe link expires in " + settings.ResetTTL.String() + ". If you did not ask for it, ignore this email.\n",
+			})
+		}
+	}
+	SendJSONResponse(w, http.StatusAccepted, "if the address belongs to an account, an email is on its way")
+}
+
+// ResetPassword sets a new password with the token of a reset email.
+func ResetPassword(w http.ResponseWriter, r *http.Request, DB *gorm.DB, passwords *services.PasswordPolicy) {
+	var request ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Password == "" {
+		SendErrorResponse(w, http.StatusBadRequest, "token and password are required")
+		return
+	}
+	userId, fingerprint, err := utils.ParseActionToken(request.Token, utils.ResetPasswordPurpose)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+	var user models.User
+	exists, err := services.FindUserById(&user, DB, userId)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return
+	}
+	if !exists || fingerprint != utils.Fingerprint(user.Password) {
+		SendErrorResponse(w, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+	if err := passwords.Check(request.Password, user.Email, user.Username); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to hash password")
+		return
+	}
+	// conditional on the old hash so the same link cannot be used twice;
+	// following it also proves the address is the user's
+	result := DB.Model(&models.User{}).
+		Where("id = ? and password = ?", user.ID, user.Password).
+		Updates(map[string]interface{}{
+			"password":              string(hashedPassword),
+			"email_verified":        true,
+			"failed_login_attempts": 0,
+			"locked_until":          nil,
+		})
+	if result.Error != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to update user")
+		return
+	}
+	if result.RowsAffected == 0 {
+		SendErrorResponse(w, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+	logging.FromContext(r.Context()).Info("Password reset", "user_id", user.ID)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionPasswordReset, ActorID: userId, TargetType: audit.TargetUser, TargetID: userId})
+	SendJSONResponse(w, http.StatusOK, "password updated")
+}
+
+// ChangePassword replaces the password of the signed-in user, who has to
+// give the current one. Wrong current passwords count towards the lockout.
+// Every session, the caller's included, ends with the old password.
+func ChangePassword(w http.ResponseWriter, r *http.Request, DB *gorm.DB, settings config.AccountSettings, passwords *services.PasswordPolicy) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var request ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.CurrentPassword == "" || request.NewPassword == "" {
+		SendErrorResponse(w, http.StatusBadRequest, "current_password and new_password are required")
+		return
+	}
+	var user models.User
+	exists, err := services.FindUserById(&user, DB, userId)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return
+	}
+	if !exists {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	if services.IsLocked(&user) {
+		SendErrorResponse(w, http.StatusForbidden, "the account is temporarily locked")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(request.CurrentPassword)) != nil {
+		if err := services.RecordFailedLogin(DB, &user, settings.MaxFailedLogins, settings.LockoutDuration); err != nil {
+			logging.FromContext(r.Context()).Error("failed to record failed login", "user_id", user.ID, "error", err)
+		}
+		audit.Record(r, DB, audit.Entry{Action: audit.ActionPasswordChange, Outcome: audit.OutcomeFailure, ActorID: userId, TargetType: audit.TargetUser, TargetID: userId, Details: map[string]interface{}{"reason": "wrong_password"}})
+		SendErrorResponse(w, http.StatusForbidden, "current password is wrong")
+		return
+	}
+	if err := passwords.Check(request.NewPassword, user.Email, user.Username); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to hash password")
+		return
+	}
+	err = DB.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"password":              string(hashedPassword),
+		"failed_login_attempts": 0,
+	}).Error
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to update user")
+		return
+	}
+	logging.FromContext(r.Context()).Info("Password changed", "user_id", user.ID)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionPasswordChange, ActorID: userId, TargetType: audit.TargetUser, TargetID: userId})
+	SendJSONResponse(w, http.StatusOK, "password updated")
+}
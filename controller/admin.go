@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"real-time-collab/config"
+	"real-time-collab/models"
+	"real-time-collab/services"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Healthz is the liveness probe, it only tells that the process serves HTTP.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	SendJSONResponse(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// Readyz is the readiness probe. The server is ready when the database
+// answers, workers and the broadcaster are running and the message queue
+// has room left.
+func Readyz(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	checks := map[string]string{}
+	ready := true
+	fail := func(check string, reason string) {
+		checks[check] = reason
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if sqlDB, err := DB.DB(); err != nil {
+		fail("database", err.Error())
+	} else if err := sqlDB.PingContext(ctx); err != nil {
+		fail("database", err.Error())
+	} else {
+		checks["database"] = "ok"
+	}
+
+	if pool.AliveWorkers() == 0 {
+		fail("workers", "no worker running")
+	} else {
+		checks["workers"] = "ok"
+	}
+
+	if !pool.Broadcasting() {
+		fail("broadcaster", "not running")
+	} else {
+		checks["broadcaster"] = "ok"
+	}
+
+	if pool.QueueSaturated() {
+		fail("queue", "saturated")
+	} else {
+		checks["queue"] = "ok"
+	}
+
+	if pool.ShuttingDown() {
+		fail("server", "shutting down")
+	}
+
+	if !ready {
+		SendJSONResponse(w, http.StatusServiceUnavailable, HealthResponse{Status: "unavailable", Checks: checks})
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, HealthResponse{Status: "ok", Checks: checks})
+}
+
+// authenticateAdmin validates the JWT and checks that its user is an admin.
+// It writes the error response itself and returns false on failure.
+func authenticateAdmin(w http.ResponseWriter, r *http.Request, DB *gorm.DB) (models.User, bool) {
+	var user models.User
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return user, false
+	}
+	exists, err := services.FindUserById(&user, DB, userId)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return user, false
+	}
+	if !exists || !services.IsAdmin(&user) {
+		SendErrorResponse(w, http.StatusForbidden, "admin access required")
+		return user, false
+	}
+	return user, true
+}
+
+// GetPoolStats lists the open documents, the users connected to each of
+// them and the state of the worker queue.
+func GetPoolStats(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	if _, ok := authenticateAdmin(w, r, DB); !ok {
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[config.PoolStats]{
+		Status:  "success",
+		Message: "connection pool stats",
+		Data:    pool.Stats(),
+	})
+}
@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"real-time-collab/audit"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/models"
+	"real-time-collab/services"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// API tokens expire after DefaultTokenDays unless asked otherwise, and
+// after MaxTokenDays at the latest.
+const (
+	DefaultTokenDays = 30
+	MaxTokenDays     = 365
+)
+
+type CreateAPITokenRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+	// DocID limits the token to one document
+	DocID         string `json:"doc_id"`
+	ExpiresInDays int    `json:"expires_in_days"`
+}
+
+type CreatedAPIToken struct {
+	models.APIToken
+	// Token is the secret itself, shown only in this response
+	Token string `json:"token"`
+}
+
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// authorizeToken checks an API token may act on the document docID. It
+// writes the error response itself and returns false on failure.
+func authorizeToken(w http.ResponseWriter, r *http.Request, docID string, write bool) bool {
+	principal := config.PrincipalFromContext(r.Context())
+	if principal == nil {
+		return true
+	}
+	if err := principal.Authorize(docID, write); err != nil {
+		logging.FromContext(r.Context()).Info("api token refused", "error", err)
+		SendErrorResponse(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// authenticateWebSocket returns who a websocket upgrade request is from:
+// the API token principal, or the user of a session token sent in the
+// Authorization header or the access_token query parameter. It returns
+// nil without credentials.
+func authenticateWebSocket(r *http.Request, DB *gorm.DB) (*config.Principal, error) {
+	if principal := config.PrincipalFromContext(r.Context()); principal != nil {
+		return principal, nil
+	}
+	credential, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if credential == "" {
+		credential = r.URL.Query().Get("access_token")
+	}
+	if credential == "" {
+		return nil, nil
+	}
+	userId, err := userIdFromJwt(r, DB, credential)
+	if err != nil {
+		return nil, err
+	}
+	return &config.Principal{UserID: userId}, nil
+}
+
+// requireSession refuses requests made with an API token, so a leaked
+// token cannot be used to mint or manage others.
+func requireSession(w http.ResponseWriter, r *http.Request) bool {
+	if principal := config.PrincipalFromContext(r.Context()); principal != nil && principal.TokenID != 0 {
+		SendErrorResponse(w, http.StatusForbidden, "api tokens are managed with a session token")
+		return false
+	}
+	return true
+}
+
+// CreateAPIToken issues a named token for the caller. The secret is in the
+// response and cannot be retrieved again.
+func CreateAPIToken(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	if !requireSession(w, r) {
+		return
+	}
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var request CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 100 {
+		SendErrorResponse(w, http.StatusBadRequest, "a name of at most 100 bytes is required")
+		return
+	}
+	if request.Scope == "" {
+		request.Scope = models.TokenScopeRead
+	}
+	if request.Scope != models.TokenScopeRead && request.Scope != models.TokenScopeReadWrite {
+		SendErrorResponse(w, http.StatusBadRequest, "scope must be read or read_write")
+		return
+	}
+	if request.ExpiresInDays == 0 {
+		request.ExpiresInDays = DefaultTokenDays
+	}
+	if request.ExpiresInDays < 0 || request.ExpiresInDays > MaxTokenDays {
+		SendErrorResponse(w, http.StatusBadRequest, "expires_in_days must be between 1 and 365")
+		return
+	}
+	if request.DocID != "" {
+		docID, err := strconv.ParseUint(request.DocID, 10, 64)
+		if err != nil || DB.First(&models.Document{}, "id = ?", docID).Error != nil {
+			SendErrorResponse(w, http.StatusBadRequest, "document not found")
+			return
+		}
+		request.DocID = strconv.FormatUint(docID, 10)
+	}
+
+	expiresAt := time.Now().AddDate(0, 0, request.ExpiresInDays)
+	token, raw, err := services.NewAPIToken(userId, request.Name, request.Scope, request.DocID, &expiresAt)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+	if err := DB.Create(&token).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to save token")
+		return
+	}
+	logging.FromContext(r.Context()).Info("API token created", "user_id", userId, "api_token_id", token.ID, "scope", token.Scope)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionAPITokenCreate, ActorID: userId, TargetType: audit.TargetAPIToken, TargetID: strconv.FormatUint(uint64(token.ID), 10), Details: map[string]interface{}{"name": token.Name, "scope": token.Scope, "expires_at": token.ExpiresAt}})
+	SendJSONResponse(w, http.StatusCreated, SuccessResponse[CreatedAPIToken]{Status: "success", Message: "token created, it will not be shown again", Data: CreatedAPIToken{APIToken: token, Token: raw}})
+}
+
+// GetAPITokens lists the caller's tokens, newest first, without secrets.
+func GetAPITokens(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	if !requireSession(w, r) {
+		return
+	}
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var tokens []models.APIToken
+	if err := DB.Where("user_id = ?", userId).Order("created_at DESC").Find(&tokens).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]models.APIToken]{Status: "success", Message: "tokens", Data: tokens})
+}
+
+// RevokeAPIToken stops one of the caller's tokens from working and closes
+// the websocket connections opened with it.
+func RevokeAPIToken(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, TokenId string) {
+	if !requireSession(w, r) {
+		return
+	}
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	id, err := strconv.ParseUint(TokenId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the token id")
+		return
+	}
+	result := DB.Model(&models.APIToken{}).
+		Where("id = ? and user_id = ? and revoked_at is null", id, userId).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to revoke token")
+		return
+	}
+	if result.RowsAffected == 0 {
+		err = errors.New("token not found")
+		SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	closed := pool.CloseToken(uint(id))
+	logging.FromContext(r.Context()).Info("API token revoked", "user_id", userId, "api_token_id", id, "closed_connections", closed)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionAPITokenRevoke, ActorID: userId, TargetType: audit.TargetAPIToken, TargetID: strconv.FormatUint(id, 10)})
+	SendJSONResponse(w, http.StatusOK, "token revoked")
+}
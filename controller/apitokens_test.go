@@ -0,0 +1,110 @@
+//go:build sqlite
+
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"real-time-collab/config"
+	"real-time-collab/internal/testdb"
+	"real-time-collab/models"
+	"real-time-collab/utils"
+	"strconv"
+	"testing"
+)
+
+// tokenRequest is a request made with an API token, to a route that acts
+// on routeDocID when declared is set.
+func tokenRequest(method string, principal *config.Principal, routeDocID string, declared bool) *http.Request {
+	r := httptest.NewRequest(method, "/", nil)
+	ctx := config.WithPrincipal(r.Context(), principal)
+	if declared {
+		ctx = config.WithDocumentRoute(ctx, routeDocID)
+	}
+	return r.WithContext(ctx)
+}
+
+func TestValidateJwtTokenChecksTheRouteDocument(t *testing.T) {
+	limited := &config.Principal{UserID: "1", TokenID: 1, Scope: models.TokenScopeReadWrite, DocID: "7"}
+	readOnly := &config.Principal{UserID: "1", TokenID: 2, Scope: models.TokenScopeRead}
+	tests := []struct {
+		name       string
+		method     string
+		principal  *config.Principal
+		routeDocID string
+		declared   bool
+		allowed    bool
+	}{
+		{"its document", http.MethodGet, limited, "7", true, true},
+		{"another document", http.MethodGet, limited, "8", true, false},
+		{"a route without a document", http.MethodGet, limited, "", false, false},
+		{"a document the handler resolves", http.MethodPost, limited, "", true, true},
+		{"read-only token reading", http.MethodGet, readOnly, "8", true, true},
+		{"read-only token writing", http.MethodPost, readOnly, "", true, false},
+		{"unlimited token off documents", http.MethodGet, readOnly, "", false, true},
+	}
+	for _, test := range tests {
+		r := tokenRequest(test.method, test.principal, test.routeDocID, test.declared)
+		_, err := ValidateJwtToken(httptest.NewRecorder(), r, nil)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: allowed = %v, want %v (%v)", test.name, allowed, test.allowed, err)
+		}
+	}
+}
+
+func TestAuthorizeDocumentChecksTheResolvedDocument(t *testing.T) {
+	DB := testdb.Open(t)
+	documents := []models.Document{{Title: "allowed"}, {Title: "other"}}
+	if err := DB.Create(&documents).Error; err != nil {
+		t.Fatal(err)
+	}
+	allowed := strconv.FormatUint(uint64(documents[0].ID), 10)
+	other := strconv.FormatUint(uint64(documents[1].ID), 10)
+	principal := &config.Principal{UserID: "1", TokenID: 1, Scope: models.TokenScopeReadWrite, DocID: allowed}
+
+	// a thread or suggestion route passes ValidateJwtToken, its handler
+	// then checks the document it loaded
+	r := tokenRequest(http.MethodPost, principal, "", true)
+	if _, err := ValidateJwtToken(httptest.NewRecorder(), r, DB); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	if _, ok := authorizeDocument(recorder, r, DB, principal.UserID, other, true); ok || recorder.Code != http.StatusForbidden {
+		t.Errorf("the token reached another document: %d", recorder.Code)
+	}
+	if _, ok := authorizeDocument(httptest.NewRecorder(), r, DB, principal.UserID, allowed, true); !ok {
+		t.Error("the token was refused its own document")
+	}
+}
+
+func TestValidateJwtTokenEndsSessionsWhenThePasswordChanges(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-session-secret-of-at-least-32-bytes")
+	t.Setenv("ACTION_TOKEN_SECRET", "test-action-secret-of-at-least-32-bytes")
+	if err := utils.LoadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	DB := testdb.Open(t)
+	user := models.User{Username: "carol", Email: "carol@example.com", Password: "old hash"}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	token, err := utils.GenerateJWT(user.ID, user.Email, utils.Fingerprint(user.Password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	if _, err := ValidateJwtToken(httptest.NewRecorder(), request(), DB); err != nil {
+		t.Fatalf("the session was refused: %v", err)
+	}
+	if err := DB.Model(&user).Update("password", "new hash").Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateJwtToken(httptest.NewRecorder(), request(), DB); err == nil {
+		t.Error("the session outlived the password change")
+	}
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"real-time-collab/audit"
+	"real-time-collab/logging"
+	"real-time-collab/models"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultAuditLimit = 100
+	MaxAuditLimit     = 1000
+	auditExportBatch  = 500
+)
+
+// auditFilter narrows the audit log with the action, outcome, actor_id,
+// target_type and target_id query parameters, and with since and until
+// as RFC 3339 times.
+func auditFilter(r *http.Request, DB *gorm.DB) (*gorm.DB, error) {
+	query := r.URL.Query()
+	tx := DB.Model(&models.AuditEvent{})
+	for _, column := range []string{"action", "outcome", "actor_id", "target_type", "target_id"} {
+		if value := query.Get(column); value != "" {
+			tx = tx.Where(column+" = ?", value)
+		}
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("since must be an RFC 3339 time")
+		}
+		tx = tx.Where("created_at >= ?", since)
+	}
+	if value := query.Get("until"); value != "" {
+		until, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("until must be an RFC 3339 time")
+		}
+		tx = tx.Where("created_at < ?", until)
+	}
+	return tx, nil
+}
+
+// GetAuditEvents lists audit events to admins, newest first. Pages are
+// walked with before_id, the id of the last event of the previous page.
+func GetAuditEvents(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	if _, ok := authenticateAdmin(w, r, DB); !ok {
+		return
+	}
+	tx, err := auditFilter(r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := DefaultAuditLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaxAuditLimit {
+			SendErrorResponse(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+	}
+	if value := r.URL.Query().Get("before_id"); value != "" {
+		beforeID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the before_id")
+			return
+		}
+		tx = tx.Where("id < ?", beforeID)
+	}
+	var events []models.AuditEvent
+	if err := tx.Order("id DESC").Limit(limit).Find(&events).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]models.AuditEvent]{Status: "success", Message: "audit events", Data: events})
+}
+
+// ExportAuditEvents streams the audit events matching the same filters as
+// GetAuditEvents to admins as JSON Lines, oldest first. Exports are
+// audited themselves.
+func ExportAuditEvents(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	admin, ok := authenticateAdmin(w, r, DB)
+	if !ok {
+		return
+	}
+	tx, err := auditFilter(r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	adminId := strconv.FormatUint(uint64(admin.ID), 10)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionAuditExport, ActorID: adminId, Details: map[string]interface{}{"query": r.URL.RawQuery}})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-`+time.Now().UTC().Format("20060102T150405Z")+`.jsonl"`)
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var batch []models.AuditEvent
+	err = tx.FindInBatches(&batch, auditExportBatch, func(tx *gorm.DB, _ int) error {
+		for _, event := range batch {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}).Error
+	if err != nil {
+		// the status line is already sent, the export ends short
+		logging.FromContext(r.Context()).Error("failed to export audit events", "error", err)
+	}
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/models"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+type CreateBranchRequest struct {
+	DocID string `json:"doc_id"`
+	Title string `json:"title"`
+	// Version is the version to fork at, the head when it is left out
+	Version *int `json:"doc_version"`
+}
+
+type MergeRequest struct {
+	// Force applies the branch's edits even when they conflict
+	Force bool `json:"force"`
+}
+
+// CreateBranch forks a document into a new document owned by the caller.
+func CreateBranch(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var request CreateBranchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.DocID == "" {
+		SendErrorResponse(w, http.StatusBadRequest, "doc_id is required")
+		return
+	}
+	// the branch joins the parent's workspace, so forking takes edit access
+	if _, ok := authorizeDocument(w, r, DB, userId, request.DocID, true); !ok {
+		return
+	}
+	version := config.HeadVersion
+	if request.Version != nil {
+		version = *request.Version
+	}
+
+	branch := models.Document{Title: request.Title, CreatedBy: userId}
+	err = pool.Store.Fork(r.Context(), request.DocID, version, &branch)
+	switch {
+	case errors.Is(err, config.ErrNotBranchable), errors.Is(err, config.ErrVersionUnavailable):
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		logging.FromContext(r.Context()).Error("failed to fork document", "doc_id", request.DocID, "error", err)
+		SendErrorResponse(w, http.StatusNotFound, "document not found")
+	default:
+		SendJSONResponse(w, http.StatusCreated, SuccessResponse[models.Document]{Status: "success", Message: "branch created", Data: branch})
+	}
+}
+
+// GetBranches lists the branches forked from a document.
+func GetBranches(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	docID, err := strconv.ParseUint(r.URL.Query().Get("doc_id"), 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "doc_id is required")
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, strconv.FormatUint(docID, 10), false); !ok {
+		return
+	}
+	var branches []models.Document
+	if err := DB.Where("parent_id = ?", docID).Order("created_at ASC").Find(&branches).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	for i := range branches {
+		pool.Store.Overlay(&branches[i])
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]models.Document]{Status: "success", Message: "branches", Data: branches})
+}
+
+// MergeBranch merges a branch back into its parent. Only the owner of the
+// parent may merge; conflicts are reported with 409 unless forced.
+func MergeBranch(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, BranchId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	id, err := strconv.ParseUint(BranchId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the branch id")
+		return
+	}
+	var request MergeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+			return
+		}
+	}
+	var branch models.Document
+	if err := DB.First(&branch, "id = ?", id).Error; err != nil || branch.ParentID == nil {
+		SendErrorResponse(w, http.StatusNotFound, "branch not found")
+		return
+	}
+	var parent models.Document
+	if err := DB.First(&parent, "id = ?", *branch.ParentID).Error; err != nil {
+		SendErrorResponse(w, http.StatusNotFound, "parent document not found")
+		return
+	}
+	// a merge reads the branch and writes its parent
+	if !authorizeToken(w, r, strconv.FormatUint(uint64(branch.ID), 10), false) || !authorizeToken(w, r, strconv.FormatUint(uint64(parent.ID), 10), true) {
+		return
+	}
+	if parent.CreatedBy != userId {
+		SendErrorResponse(w, http.StatusForbidden, "only the owner of the parent document can merge into it")
+		return
+	}
+
+	result, err := pool.Merge(r.Context(), BranchId, userId, request.Force)
+	switch {
+	case errors.Is(err, config.ErrMergeConflict):
+		SendJSONResponse(w, http.StatusConflict, SuccessResponse[config.MergeResult]{Status: "error", Message: err.Error(), Data: result})
+	case errors.Is(err, config.ErrMergeRaced):
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+	case errors.Is(err, config.ErrNotBranchable):
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		logging.FromContext(r.Context()).Error("failed to merge branch", "branch_id", id, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to merge branch")
+	default:
+		SendJSONResponse(w, http.StatusOK, SuccessResponse[config.MergeResult]{Status: "success", Message: "branch merged", Data: result})
+	}
+}
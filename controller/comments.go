@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MaxCommentLength bounds the body of a single comment.
+const MaxCommentLength = 10000
+
+type CreateThreadRequest struct {
+	DocID string `json:"doc_id"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	// Version is the document version the range was taken at
+	Version int    `json:"doc_version"`
+	Body    string `json:"body"`
+}
+
+type CommentRequest struct {
+	Body string `json:"body"`
+}
+
+func validCommentBody(body string) bool {
+	body = strings.TrimSpace(body)
+	return body != "" && len(body) <= MaxCommentLength
+}
+
+// CreateThread starts a thread on a range of a document with its first
+// comment and announces it to the document's room.
+func CreateThread(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var request CreateThreadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	if request.DocID == "" || !validCommentBody(request.Body) {
+		SendErrorResponse(w, http.StatusBadRequest, "doc_id and a body of at most 10000 bytes are required")
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, request.DocID, false); !ok {
+		return
+	}
+
+	thread := models.Thread{
+		DocID:         request.DocID,
+		CreatedBy:     userId,
+		AnchorStart:   request.Start,
+		AnchorEnd:     request.End,
+		AnchorVersion: request.Version,
+	}
+	err = pool.Store.AddThread(r.Context(), &thread, models.Comment{UserID: userId, Body: request.Body})
+	if errors.Is(err, config.ErrInvalidAnchor) {
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to create thread", "doc_id", request.DocID, "error", err)
+		SendErrorResponse(w, http.StatusNotFound, "document not found")
+		return
+	}
+
+	pool.Publish(r.Context(), thread.DocID, config.ServerMessage{Type: config.ThreadMessageType, DocID: thread.DocID, Thread: &thread})
+	SendJSONResponse(w, http.StatusCreated, SuccessResponse[models.Thread]{Status: "success", Message: "thread created", Data: thread})
+}
+
+// GetThreads lists the threads of a document with their comments, oldest
+// first. resolved=false leaves out resolved threads.
+func GetThreads(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	docID, err := strconv.ParseUint(r.URL.Query().Get("doc_id"), 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "doc_id is required")
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, strconv.FormatUint(docID, 10), false); !ok {
+		return
+	}
+
+	query := DB.Where("doc_id = ?", strconv.FormatUint(docID, 10))
+	if r.URL.Query().Get("resolved") == "false" {
+		query = query.Where("resolved = ?", false)
+	}
+	var threads []models.Thread
+	err = query.Preload("Comments", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("created_at ASC")
+	}).Order("created_at ASC").Find(&threads).Error
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	pool.Store.OverlayThreads(threads)
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]models.Thread]{Status: "success", Message: "threads", Data: threads})
+}
+
+// ReplyToThread adds a comment to a thread.
+func ReplyToThread(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, ThreadId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var request CommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !validCommentBody(request.Body) {
+		SendErrorResponse(w, http.StatusBadRequest, "a body of at most 10000 bytes is required")
+		return
+	}
+	thread, ok := findThread(w, DB, ThreadId)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, thread.DocID, false); !ok {
+		return
+	}
+	comment := models.Comment{ThreadID: thread.ID, UserID: userId, Body: request.Body}
+	if err := DB.Create(&comment).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to save comment")
+		return
+	}
+	publishThread(r, DB, pool, thread.ID)
+	SendJSONResponse(w, http.StatusCreated, SuccessResponse[models.Comment]{Status: "success", Message: "comment added", Data: comment})
+}
+
+// SetThreadResolved resolves or reopens a thread.
+func SetThreadResolved(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, ThreadId string, resolved bool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	thread, ok := findThread(w, DB, ThreadId)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, thread.DocID, false); !ok {
+		return
+	}
+	changes := map[string]interface{}{"resolved": false, "resolved_by": "", "resolved_at": nil}
+	if resolved {
+		changes = map[string]interface{}{"resolved": true, "resolved_by": userId, "resolved_at": time.Now()}
+	}
+	if err := DB.Model(&models.Thread{}).Where("id = ?", thread.ID).Updates(changes).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to update thread")
+		return
+	}
+	publishThread(r, DB, pool, thread.ID)
+	SendJSONResponse(w, http.StatusOK, "thread updated")
+}
+
+func findThread(w http.ResponseWriter, DB *gorm.DB, ThreadId string) (models.Thread, bool) {
+	var thread models.Thread
+	id, err := strconv.ParseUint(ThreadId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the thread id")
+		return thread, false
+	}
+	if err := DB.First(&thread, "id = ?", id).Error; err != nil {
+		SendErrorResponse(w, http.StatusNotFound, "thread not found")
+		return thread, false
+	}
+	return thread, true
+}
+
+// publishThread sends the current state of a thread to its document's room.
+func publishThread(r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, id uint) {
+	var thread models.Thread
+	err := DB.Preload("Comments", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("created_at ASC")
+	}).First(&thread, "id = ?", id).Error
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("failed to load thread for broadcast", "thread_id", id, "error", err)
+		return
+	}
+	threads := []models.Thread{thread}
+	pool.Store.OverlayThreads(threads)
+	pool.Publish(r.Context(), thread.DocID, config.ServerMessage{Type: config.ThreadMessageType, DocID: thread.DocID, Thread: &threads[0]})
+}
@@ -4,10 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"real-time-collab/audit"
 	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/mailer"
 	"real-time-collab/models"
+	"real-time-collab/richtext"
 	"real-time-collab/services"
 	"real-time-collab/utils"
 	"strconv"
@@ -15,6 +20,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
@@ -28,6 +34,10 @@ var upgradeConnection = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},	
+	// clients without a subprotocol get the legacy JSON DocumentEvent protocol
+	Subprotocols: config.SupportedSubprotocols,
+	// permessage-deflate, negotiated with clients that support it
+	EnableCompression: os.Getenv("WS_COMPRESSION") != "false",
 }
 
 type SuccessResponse[T any] struct {
@@ -45,7 +55,7 @@ func SendJSONResponse(w http.ResponseWriter, status int, payload interface{}) {
 	
 	if err != nil {
 		// Log the error server-side
-		log.Printf("Error encoding JSON response: %v", err)
+		slog.Error("Error encoding JSON response", "error", err)
 		// If JSON encoding fails, send a plain text error
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -62,12 +72,11 @@ func SendErrorResponse(w http.ResponseWriter, status int, message string) {
 	SendJSONResponse(w, status, errorResponse)
 }
 
-func RegisterUser(w http.ResponseWriter, r *http.Request, DB *gorm.DB){
+func RegisterUser(w http.ResponseWriter, r *http.Request, DB *gorm.DB, mail mailer.Mailer, settings config.AccountSettings, passwords *services.PasswordPolicy){
 	var user models.User
-	log.Println("Inside register user method")
+	logger := logging.FromContext(r.Context())
 	//parse the request body and decode it into the User struct
 	err:= json.NewDecoder(r.Body).Decode(&user)
-	log.Println("Deoded the request body in valid user")
 	if(err!= nil){
 		SendErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
@@ -78,6 +87,11 @@ func RegisterUser(w http.ResponseWriter, r *http.Request, DB *gorm.DB){
         return
 	}
 
+	if err := passwords.Check(user.Password, user.Email, user.Username); err != nil{
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	exists,err := services.IsUserPresent(&user, DB, user.Email)
 	if(err!= nil){
 		SendErrorResponse(w, http.StatusInternalServerError, "error trying to get user from DB")
@@ -111,10 +125,19 @@ func RegisterUser(w http.ResponseWriter, r *http.Request, DB *gorm.DB){
 			"email": user.Email,
 		},
 	}
+	logger.Info("User registered", "user_id", user.ID)
+	userId := strconv.FormatUint(uint64(user.ID), 10)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionRegister, ActorID: userId, TargetType: audit.TargetUser, TargetID: userId, Details: map[string]interface{}{"email": user.Email}})
+	if err := sendVerificationEmail(r, mail, settings, user); err != nil{
+		logger.Error("failed to create verification token", "user_id", user.ID, "error", err)
+	}
 	SendJSONResponse(w, http.StatusCreated, successResponse)
 }
 
-func LoginUser(w http.ResponseWriter, r *http.Request, DB *gorm.DB){
+// LoginFailedMessage is the answer to every failed login.
+const LoginFailedMessage = "invalid email or password, or the account is temporarily locked"
+
+func LoginUser(w http.ResponseWriter, r *http.Request, DB *gorm.DB, settings config.AccountSettings){
 
 	var user models.User
 
@@ -138,31 +161,81 @@ func LoginUser(w http.ResponseWriter, r *http.Request, DB *gorm.DB){
 		SendErrorResponse(w,http.StatusInternalServerError,"error occured while trying to fetch the DB")
 		return
 	}
-	if(!exists){
-		SendErrorResponse(w,http.StatusBadRequest,"user does not exist")
+	// unknown accounts, locked accounts and wrong passwords all look the
+	// same and take as long, so the answer does not tell which it was
+	userId := ""
+	if exists{
+		userId = strconv.FormatUint(uint64(userFromDb.ID), 10)
+	}
+	loginFailed := func(reason string){
+		audit.Record(r, DB, audit.Entry{Action: audit.ActionLoginFailed, Outcome: audit.OutcomeFailure, ActorID: userId, TargetType: audit.TargetUser, TargetID: userId, Details: map[string]interface{}{"email": user.Email, "reason": reason}})
+	}
+	if(!exists || services.IsLocked(&userFromDb)){
+		services.DummyPasswordCheck(user.Password)
+		if !exists{
+			loginFailed("unknown_account")
+		}else{
+			loginFailed("locked")
+		}
+		SendErrorResponse(w,http.StatusUnauthorized,LoginFailedMessage)
 		return
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(userFromDb.Password),[]byte(user.Password))
 
 	if(err!= nil){
-		SendErrorResponse(w,http.StatusBadRequest,"Pssword Doesnt match")
+		if err := services.RecordFailedLogin(DB,&userFromDb,settings.MaxFailedLogins,settings.LockoutDuration); err != nil{
+			logging.FromContext(r.Context()).Error("failed to record failed login", "user_id", userFromDb.ID, "error", err)
+		}
+		if services.IsLocked(&userFromDb){
+			logging.FromContext(r.Context()).Warn("Account locked after failed logins", "user_id", userFromDb.ID, "until", userFromDb.LockedUntil)
+			loginFailed("wrong_password_locked")
+		}else{
+			loginFailed("wrong_password")
+		}
+		SendErrorResponse(w,http.StatusUnauthorized,LoginFailedMessage)
 		return
 	}
+	if err := services.ResetFailedLogins(DB,&userFromDb); err != nil{
+		logging.FromContext(r.Context()).Error("failed to reset failed logins", "user_id", userFromDb.ID, "error", err)
+	}
 
-	jwtToken,err := utils.GenerateJWT(userFromDb.ID,userFromDb.Email)
+	if(settings.RequireVerification && !userFromDb.EmailVerified){
+		loginFailed("email_not_verified")
+		SendErrorResponse(w,http.StatusForbidden,"email address not verified")
+		return
+	}
+
+	jwtToken,err := utils.GenerateJWT(userFromDb.ID,userFromDb.Email,utils.Fingerprint(userFromDb.Password))
 
 	if(err!= nil){
 		SendErrorResponse(w,http.StatusInternalServerError,"error generating jwt")
 	}
 
-	log.Print("Login Successful for user")
+	logging.FromContext(r.Context()).Info("Login Successful for user", "user_id", userFromDb.ID)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionLogin, ActorID: userId, TargetType: audit.TargetUser, TargetID: userId})
 
 	SendJSONResponse(w,http.StatusAccepted,map[string]string{"token":jwtToken,"username":userFromDb.Username,"userId":strconv.FormatUint(uint64(userFromDb.ID), 10)})
 
 }
 
-func ValidateJwtToken(w http.ResponseWriter, r *http.Request) (string, error) {
+func ValidateJwtToken(w http.ResponseWriter, r *http.Request, DB *gorm.DB) (string, error) {
+    // API tokens were resolved by AddAPITokenMiddleware; their scope is
+    // checked here against the document the route declared. Routes that
+    // only learn the document from what they load check it again in
+    // authorizeDocument, the others refuse tokens limited to a document.
+    if principal := config.PrincipalFromContext(r.Context()); principal != nil {
+        docID, documentRoute := config.DocumentRoute(r.Context())
+        if documentRoute && docID == "" {
+            docID = principal.DocID
+        }
+        if err := principal.Authorize(docID, !isReadMethod(r.Method)); err != nil {
+            logging.FromContext(r.Context()).Info("api token refused", "error", err)
+            return "", err
+        }
+        return principal.UserID, nil
+    }
+
     // Step 1: Retrieve the Authorization header
     authHeader := r.Header.Get("Authorization")
     if authHeader == "" {
@@ -179,11 +252,18 @@ func ValidateJwtToken(w http.ResponseWriter, r *http.Request) (string, error) {
     if jwtToken == "" {
         return "", errors.New("jwt token is missing")
     }
+    return userIdFromJwt(r, DB, jwtToken)
+}
 
+// userIdFromJwt validates a session token and returns the user it was
+// issued to. Tokens carry a fingerprint of the password hash they were
+// issued under, so changing or resetting the password signs out every
+// session.
+func userIdFromJwt(r *http.Request, DB *gorm.DB, jwtToken string) (string, error) {
     // Step 3: Extract and validate claims
     claims, err := utils.ExtractClaims(jwtToken)
     if err != nil {
-        log.Printf("Error extracting claims: %v", err)
+        logging.FromContext(r.Context()).Info("Error extracting claims", "error", err)
         return "", fmt.Errorf("error extracting claims from token: %w", err)
     }
 
@@ -197,73 +277,245 @@ func ValidateJwtToken(w http.ResponseWriter, r *http.Request) (string, error) {
         return "", errors.New("expiration claim missing from token")
     }
 
-    // Step 5: Extract and return user ID
-    if userId, exists := claims["sub"]; exists {
-        if userIdStr, ok := userId.(string); ok {
-            log.Printf("JWT authentication successful for user: %s", userIdStr)
-            return userIdStr, nil
-        }
+    // Step 5: Extract the user ID
+    userId, exists := claims["sub"]
+    if !exists {
+        return "", errors.New("user id claim missing from token")
+    }
+    userIdStr, ok := userId.(string)
+    if !ok {
         return "", errors.New("user id claim is not a string")
     }
-    
-    return "", errors.New("user id claim missing from token")
+
+    // Step 6: Check the password has not changed since the token was issued
+    var user models.User
+    found, err := services.FindUserById(&user, DB, userIdStr)
+    if err != nil {
+        return "", fmt.Errorf("failed to fetch user: %w", err)
+    }
+    if fingerprint, _ := claims["fp"].(string); !found || fingerprint != utils.Fingerprint(user.Password) {
+        return "", errors.New("token was issued before the password changed")
+    }
+    logging.FromContext(r.Context()).Debug("JWT authentication successful", "user_id", userIdStr)
+    return userIdStr, nil
 }
 
 func HandleWebSocketConnection(w http.ResponseWriter, r *http.Request, pool *config.ConnectionPool, DB *gorm.DB){
 
+	logger := logging.FromContext(r.Context())
+	// connections without credentials stay anonymous, as before
+	principal, err := authenticateWebSocket(r, DB)
+	if err != nil{
+		SendErrorResponse(w,http.StatusUnauthorized,"authentication failed")
+		return
+	}
+	docID := r.URL.Query().Get("doc_id")
+	if r.URL.Query().Get("share") != ""{
+		// a share link opens its document alone, visitors without an
+		// account edit under a guest identity
+		link,ok := authorizeShareLink(w,r,DB,docID)
+		if !ok{
+			return
+		}
+		if principal,err = sharePrincipal(link,principal); err != nil{
+			SendErrorResponse(w,http.StatusInternalServerError,"failed to open the share link")
+			return
+		}
+	}else if docID != ""{
+		userId := ""
+		if principal != nil{
+			if err := principal.Authorize(docID,false); err != nil{
+				SendErrorResponse(w,http.StatusForbidden,err.Error())
+				return
+			}
+			userId = principal.UserID
+		}
+		// joining the room on connect streams the document, so it takes view access
+		if _,ok := authorizeDocument(w,r,DB,userId,docID,false); !ok{
+			return
+		}
+	}
 	connection, err := upgradeConnection.Upgrade(w, r ,nil)
 	if err != nil{
-		log.Printf("connection refused")
+		logger.Warn("connection refused", "error", err)
 		return 
 	}
 
-	pool.Mutex.Lock()
-	pool.Connections[connection] = true
-	pool.Mutex.Unlock()
+	// clients can join a document room up front with /ws?doc_id=<id>,
+	// otherwise they join the room of the first document they edit
+	client := pool.AddConnection(connection, docID, principal, logger)
+	if client == nil {
+		connection.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, config.ServiceRestartReason))
+		connection.Close()
+		return
+	}
 
-	go pool.ReadMessage(connection, DB)
+	client.SpanContext = trace.SpanContextFromContext(r.Context())
+	client.Logger.Info("websocket connection opened")
+	go pool.ReadMessage(client, DB)
 }
 
 
 func StoreDocument(w http.ResponseWriter, r *http.Request, DB *gorm.DB){
 	var Document models.Document
-	log.Printf("request body is %v", r.Body)
 	err:= json.NewDecoder(r.Body).Decode(&Document)
 	if err != nil{
 		SendErrorResponse(w,http.StatusBadRequest,"Wrong request body")
+		return
+	}
+	// documents are only created here, they change through their events
+	if Document.ID != 0{
+		SendErrorResponse(w,http.StatusBadRequest,"a new document cannot have an ID")
+		return
+	}
+	// the owner comes from the caller's credentials, never from the body,
+	// and only the branch endpoint makes a document a branch
+	Document.CreatedBy = ""
+	Document.ParentID = nil
+	Document.ForkVersion = 0
+	Document.MergeBase = 0
+	Document.BranchBase = 0
+	Document.Version = 0
+	if Document.Mode == ""{
+		Document.Mode = models.DocumentModeOT
+	}
+	if Document.Mode != models.DocumentModeOT && Document.Mode != models.DocumentModeCRDT{
+		SendErrorResponse(w,http.StatusBadRequest,"mode must be ot or crdt")
+		return
+	}
+	if Document.Type == ""{
+		Document.Type = models.DocumentTypeText
+	}
+	if Document.Type != models.DocumentTypeText && Document.Type != models.DocumentTypeRichText{
+		SendErrorResponse(w,http.StatusBadRequest,"type must be text or richtext")
+		return
+	}
+	if Document.FolderID != nil{
+		// a document filed in a folder joins the folder's workspace
+		userId,err := ValidateJwtToken(w,r,DB)
+		if err != nil{
+			SendErrorResponse(w,http.StatusUnauthorized,"authentication failed")
+			return
+		}
+		folder,permission,ok := findFolder(w,r,DB,userId,strconv.FormatUint(uint64(*Document.FolderID),10))
+		if !ok{
+			return
+		}
+		if permission != models.PermissionEdit{
+			SendErrorResponse(w,http.StatusForbidden,"you can only view this folder")
+			return
+		}
+		Document.WorkspaceID = folder.WorkspaceID
+		Document.CreatedBy = userId
+	}else if Document.WorkspaceID != nil{
+		// only those who can edit a workspace's documents can add to it
+		userId,err := ValidateJwtToken(w,r,DB)
+		if err != nil{
+			SendErrorResponse(w,http.StatusUnauthorized,"authentication failed")
+			return
+		}
+		workspace,role,ok := findWorkspace(w,DB,userId,strconv.FormatUint(uint64(*Document.WorkspaceID),10),false)
+		if !ok{
+			return
+		}
+		if config.RolePermission(role,workspace.DefaultPermission) != models.PermissionEdit{
+			SendErrorResponse(w,http.StatusForbidden,"you can only view this workspace")
+			return
+		}
+		Document.CreatedBy = userId
+	}else if r.Header.Get("Authorization") != "" || config.PrincipalFromContext(r.Context()) != nil{
+		userId,err := ValidateJwtToken(w,r,DB)
+		if err != nil{
+			SendErrorResponse(w,http.StatusUnauthorized,"authentication failed")
+			return
+		}
+		Document.CreatedBy = userId
 	}
-	tx :=DB.Save(&Document)
+	if Document.Type == models.DocumentTypeRichText{
+		if Document.Mode == models.DocumentModeCRDT{
+			SendErrorResponse(w,http.StatusBadRequest,"rich-text documents are edited in ot mode")
+			return
+		}
+		if len(Document.RichText) > 0{
+			delta, err := richtext.Parse(Document.RichText)
+			if err != nil || !delta.IsDocument(){
+				SendErrorResponse(w,http.StatusBadRequest,"richText must be a delta of inserts")
+				return
+			}
+			Document.Content = delta.Text()
+		}
+	}
+	tx :=DB.Create(&Document)
 	if(tx.Error != nil){
 		SendErrorResponse(w,http.StatusInternalServerError, tx.Error.Error())
+		return
+	}
+	// versions are rebuilt from the content the document started with
+	snapshot := models.DocumentSnapshot{DocID: strconv.FormatUint(uint64(Document.ID), 10), Version: Document.Version, Content: Document.Content, RichText: Document.RichText}
+	if err := DB.Create(&snapshot).Error; err != nil{
+		logging.FromContext(r.Context()).Warn("failed to save initial snapshot", "doc_id", Document.ID, "error", err)
 	}
 	SendJSONResponse(w,http.StatusOK,"created document in DB")
 }
 
-func GetDocuments(w http.ResponseWriter, r *http.Request, DB *gorm.DB){
+func GetDocuments(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool){
 	var Documents []models.Document
-	userId,err:= ValidateJwtToken(w,r)
+	userId,err:= ValidateJwtToken(w,r,DB)
 	if err!= nil{
 		SendErrorResponse(w,http.StatusUnauthorized,"authentication failed")
+		return
 	}
-	tx := DB.Where("createdBy= ? ",userId).Find(&Documents)
+	// ?workspace_id= lists a workspace's documents to its members
+	if WorkspaceId := r.URL.Query().Get("workspace_id"); WorkspaceId != ""{
+		workspace,_,ok := findWorkspace(w,DB,userId,WorkspaceId,false)
+		if !ok{
+			return
+		}
+		if err := DB.Where("workspace_id = ?",workspace.ID).Order("title ASC").Find(&Documents).Error; err != nil{
+			SendErrorResponse(w,http.StatusInternalServerError,"Failed to retrive data from the DB")
+			return
+		}
+		for i := range Documents{
+			pool.Store.Overlay(&Documents[i])
+		}
+		SendJSONResponse(w,http.StatusOK,Documents)
+		return
+	}
+	tx := DB.Where("created_by = ?",userId).Find(&Documents)
 	if tx.Error != nil{
 		SendErrorResponse(w,http.StatusInternalServerError,"Failed to retrive data from the DB")
+		return
+	}
+	// documents being edited are ahead of the database until the next flush
+	for i := range Documents{
+		pool.Store.Overlay(&Documents[i])
 	}
 	SendJSONResponse(w,http.StatusOK,Documents)
 }
 
-func GetDocumentById(w http.ResponseWriter, r *http.Request,DB *gorm.DB, DocId string){
-	if _,err:=ValidateJwtToken(w,r);err!=nil{
-		SendErrorResponse(w,http.StatusUnauthorized,"authentication failed")
-	}
+func GetDocumentById(w http.ResponseWriter, r *http.Request,DB *gorm.DB, pool *config.ConnectionPool, DocId string){
 	var Document models.Document
-	DocIdUint,err := strconv.ParseUint(DocId,10,64)
-	if err!= nil{
-		SendErrorResponse(w,http.StatusInternalServerError,"Error Parsing the document id")
-	}
-	tx := DB.First(&Document, "id=?", DocIdUint)
-	if tx.Error != nil{
-		SendErrorResponse(w,http.StatusBadRequest, "Error fetching the data from the DB")
+	if r.URL.Query().Get("share") != ""{
+		// share links open the document without an account
+		link,ok := authorizeShareLink(w,r,DB,DocId)
+		if !ok{
+			return
+		}
+		if err := DB.First(&Document,"id = ?",link.DocID).Error; err != nil{
+			SendErrorResponse(w,http.StatusNotFound,"document not found")
+			return
+		}
+	}else{
+		userId,err:=ValidateJwtToken(w,r,DB)
+		if err!=nil{
+			SendErrorResponse(w,http.StatusUnauthorized,"authentication failed")
+			return
+		}
+		var ok bool
+		if Document,ok = authorizeDocument(w,r,DB,userId,DocId,false); !ok{
+			return
+		}
 	}
+	pool.Store.Overlay(&Document)
 	SendJSONResponse(w,http.StatusOK,Document)
 }
\ No newline at end of file
@@ -0,0 +1,401 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"real-time-collab/audit"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/models"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type CreateFolderRequest struct {
+	Name string `json:"name"`
+	// ParentID files the folder in another, WorkspaceID puts it at the top
+	// of a workspace; without either it is a personal folder
+	ParentID    *uint  `json:"parent_id"`
+	WorkspaceID *uint  `json:"workspace_id"`
+	Permission  string `json:"permission"`
+}
+
+type UpdateFolderRequest struct {
+	Name *string `json:"name"`
+	// ParentID moves the folder, 0 to the top of its tree
+	ParentID   *uint   `json:"parent_id"`
+	Permission *string `json:"permission"`
+}
+
+type MoveDocumentRequest struct {
+	// FolderID is the folder to file the document in, 0 for the top
+	FolderID uint `json:"folder_id"`
+}
+
+// FolderContents is a folder, or the top of a workspace or of a user's
+// personal folders, with what is directly in it.
+type FolderContents struct {
+	Folder *models.Folder `json:"folder,omitempty"`
+	// Permission is the caller's permission on the listed items
+	Permission string            `json:"permission"`
+	Folders    []models.Folder   `json:"folders"`
+	Documents  []models.Document `json:"documents"`
+}
+
+func validFolderName(name string) bool {
+	return name != "" && len(name) <= 200 && !strings.ContainsAny(name, "/\\")
+}
+
+// findFolder returns a folder with the user's permission in it. Users
+// without any permission get a 404.
+func findFolder(w http.ResponseWriter, r *http.Request, DB *gorm.DB, userId string, FolderId string) (models.Folder, string, bool) {
+	var folder models.Folder
+	id, err := strconv.ParseUint(FolderId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the folder id")
+		return folder, "", false
+	}
+	if err := DB.First(&folder, "id = ?", id).Error; err != nil {
+		SendErrorResponse(w, http.StatusNotFound, "folder not found")
+		return folder, "", false
+	}
+	permission, err := config.FolderPermission(DB, folder, userId)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to check folder permission", "folder_id", id, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to check permissions")
+		return folder, "", false
+	}
+	if permission == models.PermissionNone {
+		SendErrorResponse(w, http.StatusNotFound, "folder not found")
+		return folder, "", false
+	}
+	return folder, permission, true
+}
+
+// canSetPermission reports whether the user may change what members get in
+// a folder, which only the admins of its workspace may.
+func canSetPermission(w http.ResponseWriter, DB *gorm.DB, userId string, workspaceID *uint) bool {
+	if workspaceID == nil {
+		SendErrorResponse(w, http.StatusBadRequest, "permissions can only be set on workspace folders")
+		return false
+	}
+	role, err := config.MemberRole(DB, *workspaceID, userId)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return false
+	}
+	if role != models.WorkspaceRoleAdmin {
+		SendErrorResponse(w, http.StatusForbidden, "workspace admin access required")
+		return false
+	}
+	return true
+}
+
+// CreateFolder creates a folder in another, at the top of a workspace or as
+// a personal folder of the caller.
+func CreateFolder(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var request CreateFolderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if !validFolderName(request.Name) {
+		SendErrorResponse(w, http.StatusBadRequest, "a name of at most 200 bytes without slashes is required")
+		return
+	}
+	if !config.ValidFolderPermission(request.Permission) {
+		SendErrorResponse(w, http.StatusBadRequest, "permission must be none, view or edit")
+		return
+	}
+
+	folder := models.Folder{Name: request.Name, CreatedBy: userId, Permission: request.Permission}
+	switch {
+	case request.ParentID != nil:
+		parent, permission, ok := findFolder(w, r, DB, userId, strconv.FormatUint(uint64(*request.ParentID), 10))
+		if !ok {
+			return
+		}
+		if permission != models.PermissionEdit {
+			SendErrorResponse(w, http.StatusForbidden, "you can only view this folder")
+			return
+		}
+		folder.ParentID = &parent.ID
+		folder.WorkspaceID = parent.WorkspaceID
+		folder.OwnerID = parent.OwnerID
+	case request.WorkspaceID != nil:
+		workspace, role, ok := findWorkspace(w, DB, userId, strconv.FormatUint(uint64(*request.WorkspaceID), 10), false)
+		if !ok {
+			return
+		}
+		if config.RolePermission(role, workspace.DefaultPermission) != models.PermissionEdit {
+			SendErrorResponse(w, http.StatusForbidden, "you can only view this workspace")
+			return
+		}
+		folder.WorkspaceID = &workspace.ID
+	default:
+		folder.OwnerID = userId
+	}
+	if folder.Permission != "" && !canSetPermission(w, DB, userId, folder.WorkspaceID) {
+		return
+	}
+
+	if err := DB.Create(&folder).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to save folder")
+		return
+	}
+	SendJSONResponse(w, http.StatusCreated, SuccessResponse[models.Folder]{Status: "success", Message: "folder created", Data: folder})
+}
+
+// GetFolderChildren lists the folders and documents directly in a folder.
+// Subfolders the caller has no permission on are left out.
+func GetFolderChildren(w http.ResponseWriter, r *http.Request, DB *gorm.DB, FolderId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	folder, permission, ok := findFolder(w, r, DB, userId, FolderId)
+	if !ok {
+		return
+	}
+	contents := FolderContents{Folder: &folder, Permission: permission}
+	if !listFolder(w, r, DB, userId, &contents, DB.Where("parent_id = ?", folder.ID), DB.Where("folder_id = ?", folder.ID)) {
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[FolderContents]{Status: "success", Message: "folder", Data: contents})
+}
+
+// GetFolders lists the top of a workspace with ?workspace_id=, or the
+// caller's personal folders.
+func GetFolders(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var contents FolderContents
+	var folders, documents *gorm.DB
+	if WorkspaceId := r.URL.Query().Get("workspace_id"); WorkspaceId != "" {
+		workspace, role, ok := findWorkspace(w, DB, userId, WorkspaceId, false)
+		if !ok {
+			return
+		}
+		contents.Permission = config.RolePermission(role, workspace.DefaultPermission)
+		folders = DB.Where("workspace_id = ? and parent_id is null", workspace.ID)
+		documents = DB.Where("workspace_id = ? and folder_id is null", workspace.ID)
+	} else {
+		contents.Permission = models.PermissionEdit
+		folders = DB.Where("workspace_id is null and owner_id = ? and parent_id is null", userId)
+		documents = DB.Where("workspace_id is null and folder_id is null and created_by = ?", userId)
+	}
+	if !listFolder(w, r, DB, userId, &contents, folders, documents) {
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[FolderContents]{Status: "success", Message: "folders", Data: contents})
+}
+
+// listFolder fills contents from the queries of the folders and documents
+// in it. Documents are listed without their content.
+func listFolder(w http.ResponseWriter, r *http.Request, DB *gorm.DB, userId string, contents *FolderContents, folders *gorm.DB, documents *gorm.DB) bool {
+	var children []models.Folder
+	if err := folders.Order("name ASC").Find(&children).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return false
+	}
+	contents.Folders = make([]models.Folder, 0, len(children))
+	for _, child := range children {
+		permission := contents.Permission
+		if child.Permission != "" {
+			var err error
+			if permission, err = config.FolderPermission(DB, child, userId); err != nil {
+				logging.FromContext(r.Context()).Error("failed to check folder permission", "folder_id", child.ID, "error", err)
+				SendErrorResponse(w, http.StatusInternalServerError, "failed to check permissions")
+				return false
+			}
+		}
+		if permission != models.PermissionNone {
+			contents.Folders = append(contents.Folders, child)
+		}
+	}
+	contents.Documents = []models.Document{}
+	if contents.Permission == models.PermissionNone {
+		return true
+	}
+	err := documents.Omit("content", "crdt_state", "rich_text").Order("title ASC").Find(&contents.Documents).Error
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return false
+	}
+	return true
+}
+
+// UpdateFolder renames or moves a folder, or changes what members get in
+// it. Moving takes edit permission on the folder and on where it goes.
+func UpdateFolder(w http.ResponseWriter, r *http.Request, DB *gorm.DB, FolderId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	folder, permission, ok := findFolder(w, r, DB, userId, FolderId)
+	if !ok {
+		return
+	}
+	var request UpdateFolderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	if permission != models.PermissionEdit {
+		SendErrorResponse(w, http.StatusForbidden, "you can only view this folder")
+		return
+	}
+
+	changes := map[string]interface{}{}
+	if request.Name != nil {
+		name := strings.TrimSpace(*request.Name)
+		if !validFolderName(name) {
+			SendErrorResponse(w, http.StatusBadRequest, "a name of at most 200 bytes without slashes is required")
+			return
+		}
+		changes["name"] = name
+		folder.Name = name
+	}
+	if request.Permission != nil {
+		if !config.ValidFolderPermission(*request.Permission) {
+			SendErrorResponse(w, http.StatusBadRequest, "permission must be none, view or edit")
+			return
+		}
+		if !canSetPermission(w, DB, userId, folder.WorkspaceID) {
+			return
+		}
+		changes["permission"] = *request.Permission
+		folder.Permission = *request.Permission
+	}
+	previousParent := folder.ParentID
+	var parent *models.Folder
+	if request.ParentID != nil && *request.ParentID != 0 {
+		target, targetPermission, ok := findFolder(w, r, DB, userId, strconv.FormatUint(uint64(*request.ParentID), 10))
+		if !ok {
+			return
+		}
+		if targetPermission != models.PermissionEdit {
+			SendErrorResponse(w, http.StatusForbidden, "you can only view the target folder")
+			return
+		}
+		parent = &target
+	}
+
+	// a move that turns out to be invalid must not leave the other changes
+	// half applied
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if len(changes) > 0 {
+			if err := tx.Model(&models.Folder{}).Where("id = ?", folder.ID).Updates(changes).Error; err != nil {
+				return err
+			}
+		}
+		if request.ParentID != nil {
+			return config.MoveFolder(tx, &folder, parent)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, config.ErrFolderCycle), errors.Is(err, config.ErrFolderMismatch):
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		logging.FromContext(r.Context()).Error("failed to update folder", "folder_id", folder.ID, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to update folder")
+		return
+	}
+	if request.ParentID != nil {
+		audit.Record(r, DB, audit.Entry{Action: audit.ActionFolderMove, ActorID: userId, TargetType: audit.TargetFolder, TargetID: strconv.FormatUint(uint64(folder.ID), 10), Details: map[string]interface{}{"from_parent_id": previousParent, "to_parent_id": folder.ParentID, "workspace_id": folder.WorkspaceID}})
+	}
+	if request.Permission != nil {
+		audit.Record(r, DB, audit.Entry{Action: audit.ActionFolderPermission, ActorID: userId, TargetType: audit.TargetFolder, TargetID: strconv.FormatUint(uint64(folder.ID), 10), Details: map[string]interface{}{"permission": folder.Permission}})
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[models.Folder]{Status: "success", Message: "folder updated", Data: folder})
+}
+
+// DeleteFolder deletes a folder and the folders below it, moving their
+// documents up to the folder's parent.
+func DeleteFolder(w http.ResponseWriter, r *http.Request, DB *gorm.DB, FolderId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	folder, permission, ok := findFolder(w, r, DB, userId, FolderId)
+	if !ok {
+		return
+	}
+	if permission != models.PermissionEdit {
+		SendErrorResponse(w, http.StatusForbidden, "you can only view this folder")
+		return
+	}
+	if err := config.DeleteFolder(DB, folder); err != nil {
+		logging.FromContext(r.Context()).Error("failed to delete folder", "folder_id", folder.ID, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to delete folder")
+		return
+	}
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionFolderDelete, ActorID: userId, TargetType: audit.TargetFolder, TargetID: strconv.FormatUint(uint64(folder.ID), 10), Details: map[string]interface{}{"name": folder.Name, "workspace_id": folder.WorkspaceID}})
+	SendJSONResponse(w, http.StatusOK, "folder deleted")
+}
+
+// MoveDocument files a document in a folder of the same workspace, or of
+// the caller's personal folders for documents outside of workspaces.
+func MoveDocument(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, DocId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	document, ok := authorizeDocument(w, r, DB, userId, DocId, true)
+	if !ok {
+		return
+	}
+	var request MoveDocumentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	// personal documents are filed by their creator only, anyone else
+	// could otherwise take them over by filing them in their own folder
+	if document.WorkspaceID == nil && document.CreatedBy != userId {
+		SendErrorResponse(w, http.StatusForbidden, "only the creator can file a personal document")
+		return
+	}
+	var folderID *uint
+	if request.FolderID != 0 {
+		folder, permission, ok := findFolder(w, r, DB, userId, strconv.FormatUint(uint64(request.FolderID), 10))
+		if !ok {
+			return
+		}
+		if permission != models.PermissionEdit {
+			SendErrorResponse(w, http.StatusForbidden, "you can only view the target folder")
+			return
+		}
+		if !config.SameTree(folder, document.WorkspaceID, userId) {
+			SendErrorResponse(w, http.StatusBadRequest, config.ErrFolderMismatch.Error())
+			return
+		}
+		folderID = &folder.ID
+	}
+	if err := DB.Model(&models.Document{}).Where("id = ?", document.ID).Update("folder_id", folderID).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to move document")
+		return
+	}
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionDocumentMove, ActorID: userId, TargetType: audit.TargetDocument, TargetID: strconv.FormatUint(uint64(document.ID), 10), Details: map[string]interface{}{"from_folder_id": document.FolderID, "to_folder_id": folderID, "workspace_id": document.WorkspaceID}})
+	document.FolderID = folderID
+	pool.Store.Overlay(&document)
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[models.Document]{Status: "success", Message: "document moved", Data: document})
+}
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"net/http"
+	"real-time-collab/audit"
+	"real-time-collab/config"
+	"real-time-collab/models"
+	"real-time-collab/richtext"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// RenderDocument serves a document as HTML or Markdown, picked with the
+// format query parameter (html by default). Text documents render as plain
+// paragraphs.
+func RenderDocument(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, DocId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	Document, ok := authorizeDocument(w, r, DB, userId, DocId, false)
+	if !ok {
+		return
+	}
+	pool.Store.Overlay(&Document)
+
+	content := richtext.FromText(Document.Content)
+	if Document.Type == models.DocumentTypeRichText && len(Document.RichText) > 0 {
+		content, err = richtext.Parse(Document.RichText)
+		if err != nil {
+			SendErrorResponse(w, http.StatusInternalServerError, "failed to read the document")
+			return
+		}
+	}
+
+	var contentType, body, format string
+	switch r.URL.Query().Get("format") {
+	case "", "html":
+		contentType, body, format = "text/html; charset=utf-8", richtext.HTML(content), "html"
+	case "markdown", "md":
+		contentType, body, format = "text/markdown; charset=utf-8", richtext.Markdown(content), "markdown"
+	default:
+		SendErrorResponse(w, http.StatusBadRequest, "format must be html or markdown")
+		return
+	}
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionDocumentExport, ActorID: userId, TargetType: audit.TargetDocument, TargetID: strconv.FormatUint(uint64(Document.ID), 10), Details: map[string]interface{}{"format": format}})
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(body))
+}
@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"real-time-collab/audit"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/models"
+	"real-time-collab/services"
+	"real-time-collab/utils"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// SharePasswordHeader carries the password of a protected share link. The
+// password is never read from the URL, where it would end up in logs and
+// browser history; websocket clients, which cannot set headers, trade it
+// for a short-lived share_ticket with CreateShareTicket.
+const SharePasswordHeader = "X-Share-Password"
+
+// shareTicketTTL is how long a ticket opens the websocket of a link.
+const shareTicketTTL = time.Minute
+
+type ShareTicket struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type CreateShareLinkRequest struct {
+	Permission string     `json:"permission"`
+	Password   string     `json:"password"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+type CreatedShareLink struct {
+	models.ShareLink
+	// Token is the share query parameter of the link, shown only once
+	Token string `json:"token"`
+}
+
+// guestIdentity names an anonymous visitor of a share link in the events
+// and presence of the document.
+func guestIdentity() (string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return "guest-" + id[:12], nil
+}
+
+// authorizeShareLink checks the share query parameter opens the document
+// DocId, with its password if it has one. It writes the error response
+// itself and returns false on failure.
+func authorizeShareLink(w http.ResponseWriter, r *http.Request, DB *gorm.DB, DocId string) (models.ShareLink, bool) {
+	link, err := services.LookupShareLink(DB, r.URL.Query().Get("share"))
+	if err != nil {
+		if !errors.Is(err, services.ErrInvalidShareLink) {
+			logging.FromContext(r.Context()).Error("failed to check share link", "error", err)
+		}
+		SendErrorResponse(w, http.StatusNotFound, services.ErrInvalidShareLink.Error())
+		return link, false
+	}
+	if id, err := strconv.ParseUint(DocId, 10, 64); err != nil || strconv.FormatUint(id, 10) != link.DocID {
+		SendErrorResponse(w, http.StatusNotFound, services.ErrInvalidShareLink.Error())
+		return link, false
+	}
+	if ticket := r.URL.Query().Get("share_ticket"); ticket != "" && r.Header.Get(SharePasswordHeader) == "" {
+		if !validShareTicket(ticket, link) {
+			SendErrorResponse(w, http.StatusUnauthorized, "the share ticket is invalid or expired")
+			return link, false
+		}
+		return link, true
+	}
+	if err := services.CheckSharePassword(link, r.Header.Get(SharePasswordHeader)); err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "this link needs its password")
+		return link, false
+	}
+	return link, true
+}
+
+// validShareTicket reports whether ticket was issued for link, and for its
+// current password.
+func validShareTicket(ticket string, link models.ShareLink) bool {
+	claims, err := utils.ParsePurposeClaims(ticket, utils.ShareTicketPurpose)
+	if err != nil {
+		return false
+	}
+	return claims["share"] == strconv.FormatUint(uint64(link.ID), 10) && claims["fp"] == utils.Fingerprint(link.PasswordHash)
+}
+
+// CreateShareTicket trades the password of a share link, given in the
+// X-Share-Password header, for a ticket that opens the link's websocket for
+// a minute as /ws?share=<token>&share_ticket=<ticket>.
+func CreateShareTicket(w http.ResponseWriter, r *http.Request, DB *gorm.DB, DocId string) {
+	link, ok := authorizeShareLink(w, r, DB, DocId)
+	if !ok {
+		return
+	}
+	expiresAt := time.Now().Add(shareTicketTTL)
+	if link.ExpiresAt != nil && link.ExpiresAt.Before(expiresAt) {
+		expiresAt = *link.ExpiresAt
+	}
+	ticket, err := utils.SignPurposeClaims(utils.ShareTicketPurpose, jwt.MapClaims{
+		"share": strconv.FormatUint(uint64(link.ID), 10),
+		"fp":    utils.Fingerprint(link.PasswordHash),
+	}, time.Until(expiresAt))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to issue a share ticket")
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[ShareTicket]{Status: "success", Message: "share ticket issued", Data: ShareTicket{Ticket: ticket, ExpiresAt: expiresAt}})
+}
+
+// sharePrincipal is who a websocket connection opened with a share link
+// acts as: the signed-in user if there is one, a guest otherwise, limited
+// to the link's document and permission.
+func sharePrincipal(link models.ShareLink, principal *config.Principal) (*config.Principal, error) {
+	userID := ""
+	if principal != nil {
+		userID = principal.UserID
+	} else {
+		guest, err := guestIdentity()
+		if err != nil {
+			return nil, err
+		}
+		userID = guest
+	}
+	scope := models.TokenScopeRead
+	if link.Permission == models.PermissionEdit {
+		scope = models.TokenScopeReadWrite
+	}
+	return &config.Principal{UserID: userID, ShareID: link.ID, Scope: scope, DocID: link.DocID, ExpiresAt: link.ExpiresAt}, nil
+}
+
+// CreateShareLink creates a link to a document. Only those who can edit the
+// document may share it.
+func CreateShareLink(w http.ResponseWriter, r *http.Request, DB *gorm.DB, DocId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	document, ok := authorizeDocument(w, r, DB, userId, DocId, true)
+	if !ok {
+		return
+	}
+	var request CreateShareLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	if request.Permission == "" {
+		request.Permission = models.PermissionView
+	}
+	if request.Permission != models.PermissionView && request.Permission != models.PermissionEdit {
+		SendErrorResponse(w, http.StatusBadRequest, "permission must be view or edit")
+		return
+	}
+	if len(request.Password) > services.MaxPasswordLength {
+		SendErrorResponse(w, http.StatusBadRequest, "the password is at most 72 bytes")
+		return
+	}
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		SendErrorResponse(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	docID := strconv.FormatUint(uint64(document.ID), 10)
+	link, raw, err := services.NewShareLink(docID, userId, request.Permission, request.Password, request.ExpiresAt)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to generate share link")
+		return
+	}
+	if err := DB.Create(&link).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to save share link")
+		return
+	}
+	logging.FromContext(r.Context()).Info("Share link created", "doc_id", docID, "share_id", link.ID, "permission", link.Permission)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionShareCreate, ActorID: userId, TargetType: audit.TargetShareLink, TargetID: strconv.FormatUint(uint64(link.ID), 10), Details: map[string]interface{}{"doc_id": docID, "permission": link.Permission, "protected": link.Protected, "expires_at": link.ExpiresAt}})
+	SendJSONResponse(w, http.StatusCreated, SuccessResponse[CreatedShareLink]{Status: "success", Message: "share link created, it will not be shown again", Data: CreatedShareLink{ShareLink: link, Token: raw}})
+}
+
+// GetShareLinks lists the links to a document to those who can edit it.
+func GetShareLinks(w http.ResponseWriter, r *http.Request, DB *gorm.DB, DocId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	document, ok := authorizeDocument(w, r, DB, userId, DocId, true)
+	if !ok {
+		return
+	}
+	var links []models.ShareLink
+	if err := DB.Where("doc_id = ?", strconv.FormatUint(uint64(document.ID), 10)).Order("created_at DESC").Find(&links).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]models.ShareLink]{Status: "success", Message: "share links", Data: links})
+}
+
+// RevokeShareLink stops a link from working and closes the connections
+// opened with it.
+func RevokeShareLink(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, ShareId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	id, err := strconv.ParseUint(ShareId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the share link id")
+		return
+	}
+	var link models.ShareLink
+	if err := DB.First(&link, "id = ?", id).Error; err != nil {
+		SendErrorResponse(w, http.StatusNotFound, "share link not found")
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, link.DocID, true); !ok {
+		return
+	}
+	result := DB.Model(&models.ShareLink{}).Where("id = ? and revoked_at is null", link.ID).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to revoke share link")
+		return
+	}
+	if result.RowsAffected == 0 {
+		SendErrorResponse(w, http.StatusConflict, "share link already revoked")
+		return
+	}
+	closed := pool.CloseShare(link.ID)
+	logging.FromContext(r.Context()).Info("Share link revoked", "doc_id", link.DocID, "share_id", link.ID, "closed_connections", closed)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionShareRevoke, ActorID: userId, TargetType: audit.TargetShareLink, TargetID: strconv.FormatUint(uint64(link.ID), 10), Details: map[string]interface{}{"doc_id": link.DocID}})
+	SendJSONResponse(w, http.StatusOK, "share link revoked")
+}
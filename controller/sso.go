@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"real-time-collab/audit"
+	"real-time-collab/logging"
+	"real-time-collab/services"
+	"real-time-collab/sso"
+	"real-time-collab/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// oidcCookie carries the state, nonce and PKCE verifier of a login attempt
+// from /auth/oidc/login to the callback, signed so it cannot be forged.
+const (
+	oidcCookie    = "oidc_login"
+	oidcCookieTTL = 10 * time.Minute
+)
+
+func randomToken() (string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+func setOIDCCookie(w http.ResponseWriter, client *sso.Client, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(client.Settings.RedirectURL, "https://"),
+		// Lax so the cookie comes back on the provider's top-level redirect
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// OIDCLogin starts a sign-in at the identity provider.
+func OIDCLogin(w http.ResponseWriter, r *http.Request, client *sso.Client) {
+	if !client.Enabled() {
+		SendErrorResponse(w, http.StatusNotFound, sso.ErrDisabled.Error())
+		return
+	}
+	state, err := randomToken()
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to start sign-in")
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to start sign-in")
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+	redirect, err := client.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to start oidc login", "error", err)
+		SendErrorResponse(w, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+	cookie, err := utils.SignPurposeClaims(utils.OIDCLoginPurpose, jwt.MapClaims{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	}, oidcCookieTTL)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to start sign-in")
+		return
+	}
+	setOIDCCookie(w, client, cookie, int(oidcCookieTTL.Seconds()))
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// OIDCCallback finishes a sign-in: it checks the state, trades the code for
+// a verified ID token, finds, links or creates the user and issues the same
+// session token as LoginUser.
+func OIDCCallback(w http.ResponseWriter, r *http.Request, DB *gorm.DB, client *sso.Client) {
+	if !client.Enabled() {
+		SendErrorResponse(w, http.StatusNotFound, sso.ErrDisabled.Error())
+		return
+	}
+	logger := logging.FromContext(r.Context())
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		SendErrorResponse(w, http.StatusBadRequest, "sign-in failed: "+providerError+" "+query.Get("error_description"))
+		return
+	}
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "sign-in expired, start again")
+		return
+	}
+	setOIDCCookie(w, client, "", -1)
+	attempt, err := utils.ParsePurposeClaims(cookie.Value, utils.OIDCLoginPurpose)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "sign-in expired, start again")
+		return
+	}
+	state, _ := attempt["state"].(string)
+	nonce, _ := attempt["nonce"].(string)
+	verifier, _ := attempt["verifier"].(string)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		SendErrorResponse(w, http.StatusBadRequest, "sign-in state does not match")
+		return
+	}
+
+	claims, err := client.Exchange(r.Context(), query.Get("code"), verifier, nonce)
+	if err != nil {
+		logger.Warn("oidc callback rejected", "error", err)
+		SendErrorResponse(w, http.StatusUnauthorized, "sign-in failed")
+		return
+	}
+	if !client.DomainAllowed(claims.Email) {
+		SendErrorResponse(w, http.StatusForbidden, "this email domain may not sign in")
+		return
+	}
+	user, err := services.FindOrProvisionUser(DB, claims, client.Settings.AutoProvision)
+	if errors.Is(err, services.ErrIdentityRefused) {
+		SendErrorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("failed to link identity", "issuer", claims.Issuer, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "sign-in failed")
+		return
+	}
+
+	jwtToken, err := utils.GenerateJWT(user.ID, user.Email, utils.Fingerprint(user.Password))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error generating jwt")
+		return
+	}
+	logger.Info("Login Successful for user", "user_id", user.ID, "issuer", claims.Issuer)
+	userId := strconv.FormatUint(uint64(user.ID), 10)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionOIDCLogin, ActorID: userId, TargetType: audit.TargetUser, TargetID: userId, Details: map[string]interface{}{"issuer": claims.Issuer}})
+	if client.Settings.SuccessRedirect != "" {
+		// in the fragment, which browsers do not send to servers or in Referer
+		fragment := url.Values{"token": {jwtToken}, "username": {user.Username}, "userId": {userId}}
+		http.Redirect(w, r, client.Settings.SuccessRedirect+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+	SendJSONResponse(w, http.StatusAccepted, map[string]string{"token": jwtToken, "username": user.Username, "userId": userId})
+}
@@ -0,0 +1,349 @@
+//go:build sqlite
+
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"real-time-collab/internal/testdb"
+	"real-time-collab/models"
+	"real-time-collab/sso"
+	"real-time-collab/utils"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const testClientID = "collab"
+
+// grant is an authorization code the fake provider handed out.
+type grant struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+// fakeProvider is an OpenID Connect provider with discovery, an authorize
+// endpoint that signs in whoever identity says, a token endpoint checking
+// PKCE and a key set for its RS256 ID tokens.
+type fakeProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mutex sync.Mutex
+	// identity are the claims of the next sign-in
+	identity jwt.MapClaims
+	// nonce, when set, replaces the nonce of the next ID token
+	nonce  string
+	grants map[string]grant
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeProvider{key: key, grants: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("GET /authorize", provider.authorize)
+	mux.HandleFunc("POST /token", provider.token)
+	mux.HandleFunc("GET /jwks", provider.jwks)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (provider *fakeProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := provider.server.URL
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (provider *fakeProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	provider.mutex.Lock()
+	provider.grants[code] = grant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: provider.identity}
+	provider.mutex.Unlock()
+	callback := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, callback, http.StatusFound)
+}
+
+func (provider *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	provider.mutex.Lock()
+	code, ok := provider.grants[r.FormValue("code")]
+	delete(provider.grants, r.FormValue("code"))
+	nonce := provider.nonce
+	provider.mutex.Unlock()
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || r.FormValue("grant_type") != "authorization_code" || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	if nonce == "" {
+		nonce = code.nonce
+	}
+	claims := jwt.MapClaims{
+		"iss":   provider.server.URL,
+		"aud":   testClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": nonce,
+	}
+	for name, value := range code.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(provider.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func (provider *fakeProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	public := provider.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}},
+	})
+}
+
+func newSSOTest(t *testing.T, autoProvision bool) (*gorm.DB, *sso.Client, *fakeProvider) {
+	t.Setenv("JWT_SECRET", "test-session-secret-of-at-least-32-bytes")
+	t.Setenv("ACTION_TOKEN_SECRET", "test-action-secret-of-at-least-32-bytes")
+	if err := utils.LoadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	DB := testdb.Open(t)
+	provider := newFakeProvider(t)
+	client := sso.NewClient(sso.Settings{
+		Issuer:        provider.server.URL,
+		ClientID:      testClientID,
+		ClientSecret:  "secret",
+		RedirectURL:   "http://collab.test/auth/oidc/callback",
+		Scopes:        []string{"openid", "email", "profile"},
+		AutoProvision: autoProvision,
+	})
+	return DB, client, provider
+}
+
+// startLogin runs /auth/oidc/login and signs in at the provider as
+// identity, returning the callback request the browser would make.
+func startLogin(t *testing.T, client *sso.Client, provider *fakeProvider, identity jwt.MapClaims) *http.Request {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	OIDCLogin(recorder, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil), client)
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("login answered %d: %s", recorder.Code, recorder.Body)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookie {
+		t.Fatalf("login set cookies %v", cookies)
+	}
+
+	provider.mutex.Lock()
+	provider.identity = identity
+	provider.mutex.Unlock()
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := browser.Get(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("provider answered %d", response.StatusCode)
+	}
+
+	callback := httptest.NewRequest(http.MethodGet, response.Header.Get("Location"), nil)
+	callback.AddCookie(cookies[0])
+	return callback
+}
+
+func finishLogin(DB *gorm.DB, client *sso.Client, callback *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	OIDCCallback(recorder, callback, DB, client)
+	return recorder
+}
+
+// signedInUser checks a callback signed a user in and returns its id.
+func signedInUser(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	t.Helper()
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("callback answered %d: %s", recorder.Code, recorder.Body)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := utils.ExtractClaims(body["token"])
+	if err != nil {
+		t.Fatalf("callback issued an invalid session token: %v", err)
+	}
+	if claims["sub"] != body["userId"] {
+		t.Errorf("session token is for %v, response for %s", claims["sub"], body["userId"])
+	}
+	return body["userId"]
+}
+
+func identities(t *testing.T, DB *gorm.DB) []models.ExternalIdentity {
+	var found []models.ExternalIdentity
+	if err := DB.Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestOIDCCallbackProvisionsAndSignsInAgain(t *testing.T) {
+	DB, client, provider := newSSOTest(t, true)
+	identity := jwt.MapClaims{"sub": "alice-1", "email": "alice@example.com", "email_verified": true, "preferred_username": "alice"}
+
+	userId := signedInUser(t, finishLogin(DB, client, startLogin(t, client, provider, identity)))
+	var user models.User
+	if err := DB.First(&user, "id = ?", userId).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.Email != "alice@example.com" || !user.EmailVerified {
+		t.Errorf("provisioned %+v", user)
+	}
+	// the password is a hash of a secret nobody knows
+	if _, err := bcrypt.Cost([]byte(user.Password)); err != nil || bcrypt.CompareHashAndPassword([]byte(user.Password), nil) == nil {
+		t.Errorf("provisioned account has a usable password %q", user.Password)
+	}
+	linked := identities(t, DB)
+	if len(linked) != 1 || linked[0].Issuer != provider.server.URL || linked[0].Subject != "alice-1" || strconv.FormatUint(uint64(linked[0].UserID), 10) != userId {
+		t.Fatalf("linked identities are %+v", linked)
+	}
+
+	// the same subject signs in to the same account, even with a new email
+	identity["email"] = "alice@new.example.com"
+	if again := signedInUser(t, finishLogin(DB, client, startLogin(t, client, provider, identity))); again != userId {
+		t.Errorf("second sign-in is user %s, first was %s", again, userId)
+	}
+	var users int64
+	DB.Model(&models.User{}).Count(&users)
+	if users != 1 {
+		t.Errorf("%d users after signing in twice", users)
+	}
+	if linked := identities(t, DB); len(linked) != 1 || linked[0].Email != "alice@new.example.com" {
+		t.Errorf("linked identities are %+v", linked)
+	}
+}
+
+func TestOIDCCallbackLinksAccountWithVerifiedEmail(t *testing.T) {
+	DB, client, provider := newSSOTest(t, false)
+	existing := models.User{Username: "bob", Email: "bob@example.com", Password: "hash"}
+	if err := DB.Create(&existing).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// an unverified email could belong to anyone
+	unverified := jwt.MapClaims{"sub": "bob-1", "email": "bob@example.com", "email_verified": false}
+	if recorder := finishLogin(DB, client, startLogin(t, client, provider, unverified)); recorder.Code != http.StatusForbidden {
+		t.Fatalf("unverified email answered %d: %s", recorder.Code, recorder.Body)
+	}
+	if linked := identities(t, DB); len(linked) != 0 {
+		t.Fatalf("an unverified email was linked: %+v", linked)
+	}
+
+	verified := jwt.MapClaims{"sub": "bob-1", "email": "bob@example.com", "email_verified": true}
+	userId := signedInUser(t, finishLogin(DB, client, startLogin(t, client, provider, verified)))
+	if userId != strconv.FormatUint(uint64(existing.ID), 10) {
+		t.Errorf("signed in as %s, want the existing account %d", userId, existing.ID)
+	}
+	var user models.User
+	if err := DB.First(&user, "id = ?", existing.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	// the account was never verified, so whoever chose its password may
+	// not own the address
+	if !user.EmailVerified || user.Password == "hash" {
+		t.Errorf("linked account is %+v", user)
+	}
+}
+
+func TestOIDCCallbackRefusesUnknownUsersWithoutProvisioning(t *testing.T) {
+	DB, client, provider := newSSOTest(t, false)
+	identity := jwt.MapClaims{"sub": "carol-1", "email": "carol@example.com", "email_verified": true}
+	if recorder := finishLogin(DB, client, startLogin(t, client, provider, identity)); recorder.Code != http.StatusForbidden {
+		t.Fatalf("unknown user answered %d: %s", recorder.Code, recorder.Body)
+	}
+	var users int64
+	DB.Model(&models.User{}).Count(&users)
+	if users != 0 {
+		t.Errorf("%d users created with provisioning off", users)
+	}
+}
+
+func TestOIDCCallbackChecksStateAndNonce(t *testing.T) {
+	DB, client, provider := newSSOTest(t, true)
+	identity := jwt.MapClaims{"sub": "dave-1", "email": "dave@example.com", "email_verified": true}
+
+	callback := startLogin(t, client, provider, identity)
+	query := callback.URL.Query()
+	query.Set("state", "forged")
+	callback.URL.RawQuery = query.Encode()
+	if recorder := finishLogin(DB, client, callback); recorder.Code != http.StatusBadRequest {
+		t.Errorf("forged state answered %d: %s", recorder.Code, recorder.Body)
+	}
+
+	callback = startLogin(t, client, provider, identity)
+	callback.Header.Del("Cookie")
+	if recorder := finishLogin(DB, client, callback); recorder.Code != http.StatusBadRequest {
+		t.Errorf("callback without the login cookie answered %d: %s", recorder.Code, recorder.Body)
+	}
+
+	provider.mutex.Lock()
+	provider.nonce = "replayed"
+	provider.mutex.Unlock()
+	if recorder := finishLogin(DB, client, startLogin(t, client, provider, identity)); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("ID token with another nonce answered %d: %s", recorder.Code, recorder.Body)
+	}
+	if linked := identities(t, DB); len(linked) != 0 {
+		t.Errorf("rejected callbacks linked %+v", linked)
+	}
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/models"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// GetSuggestions lists the suggestions of a document, oldest first. Only
+// pending ones are listed unless status says otherwise; they are moved to
+// the current version of the document so they show where they would apply.
+func GetSuggestions(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	docID, err := strconv.ParseUint(r.URL.Query().Get("doc_id"), 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "doc_id is required")
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, strconv.FormatUint(docID, 10), false); !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.SuggestionPending
+	}
+
+	var suggestions []models.Suggestion
+	query := DB.Where("doc_id = ?", strconv.FormatUint(docID, 10))
+	if status != "all" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Order("created_at ASC").Find(&suggestions).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	if err := pool.Store.RebaseSuggestions(r.Context(), suggestions); err != nil {
+		logging.FromContext(r.Context()).Error("failed to rebase suggestions", "doc_id", docID, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to rebase suggestions")
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]models.Suggestion]{Status: "success", Message: "suggestions", Data: suggestions})
+}
+
+// DecideSuggestion accepts or rejects a pending suggestion. Only the owner
+// of the document may accept; the author may also withdraw it by rejecting.
+func DecideSuggestion(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool, SuggestionId string, accept bool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	id, err := strconv.ParseUint(SuggestionId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the suggestion id")
+		return
+	}
+	var suggestion models.Suggestion
+	if err := DB.First(&suggestion, "id = ?", id).Error; err != nil {
+		SendErrorResponse(w, http.StatusNotFound, "suggestion not found")
+		return
+	}
+	document, ok := authorizeDocument(w, r, DB, userId, suggestion.DocID, false)
+	if !ok {
+		return
+	}
+
+	owner := document.CreatedBy == userId
+	if !owner && (accept || suggestion.UserID != userId) {
+		SendErrorResponse(w, http.StatusForbidden, "only the owner of the document can decide on suggestions")
+		return
+	}
+
+	if accept {
+		err = pool.AcceptSuggestion(r.Context(), &suggestion, userId)
+	} else {
+		err = pool.RejectSuggestion(r.Context(), &suggestion, userId)
+	}
+	switch {
+	case errors.Is(err, config.ErrSuggestionDecided):
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+	case errors.Is(err, config.ErrSuggestionConflict):
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+	case err != nil:
+		logging.FromContext(r.Context()).Error("failed to decide suggestion", "suggestion_id", id, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to decide suggestion")
+	default:
+		SendJSONResponse(w, http.StatusOK, SuccessResponse[models.Suggestion]{Status: "success", Message: "suggestion " + suggestion.Status, Data: suggestion})
+	}
+}
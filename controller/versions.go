@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"real-time-collab/config"
+	"real-time-collab/diff"
+	"real-time-collab/logging"
+	"real-time-collab/models"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// MaxTagNameLength bounds the name of a version tag.
+const MaxTagNameLength = 100
+
+// DefaultDiffContext is the number of unchanged lines or words shown around
+// each change of a diff.
+const DefaultDiffContext = 3
+
+type CreateTagRequest struct {
+	DocID       string `json:"doc_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Version is the version to tag, the head when it is left out
+	Version *int `json:"doc_version"`
+}
+
+type DiffResponse struct {
+	DocID       string      `json:"doc_id"`
+	From        int         `json:"from"`
+	To          int         `json:"to"`
+	Granularity string      `json:"granularity"`
+	Hunks       []diff.Hunk `json:"hunks"`
+	Unified     string      `json:"unified"`
+}
+
+// validTagName keeps names apart from the version numbers and "head" a diff
+// can also be asked for.
+func validTagName(name string) bool {
+	if name == "" || len(name) > MaxTagNameLength || name == "head" {
+		return false
+	}
+	_, err := strconv.Atoi(name)
+	return err != nil
+}
+
+// CreateTag names a version of a document.
+func CreateTag(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var request CreateTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.DocID == "" || !validTagName(request.Name) {
+		SendErrorResponse(w, http.StatusBadRequest, "doc_id and a name of at most 100 bytes that is not a number or head are required")
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, request.DocID, true); !ok {
+		return
+	}
+
+	tag := models.VersionTag{
+		DocID:       request.DocID,
+		Name:        request.Name,
+		Description: request.Description,
+		Version:     config.HeadVersion,
+		CreatedBy:   userId,
+	}
+	if request.Version != nil {
+		tag.Version = *request.Version
+	}
+	err = pool.Store.TagVersion(r.Context(), &tag)
+	switch {
+	case errors.Is(err, config.ErrTagExists):
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+	case errors.Is(err, config.ErrVersionUnavailable):
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		logging.FromContext(r.Context()).Error("failed to tag version", "doc_id", request.DocID, "error", err)
+		SendErrorResponse(w, http.StatusNotFound, "document not found")
+	default:
+		SendJSONResponse(w, http.StatusCreated, SuccessResponse[models.VersionTag]{Status: "success", Message: "version tagged", Data: tag})
+	}
+}
+
+// GetTags lists the tags of a document, newest version first.
+func GetTags(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	docID, err := strconv.ParseUint(r.URL.Query().Get("doc_id"), 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "doc_id is required")
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, strconv.FormatUint(docID, 10), false); !ok {
+		return
+	}
+	var tags []models.VersionTag
+	err = DB.Where("doc_id = ?", strconv.FormatUint(docID, 10)).
+		Order("version DESC, created_at DESC").
+		Find(&tags).Error
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]models.VersionTag]{Status: "success", Message: "tags", Data: tags})
+}
+
+// GetDiff compares two versions of a document. from and to are version
+// numbers, tag names or "head" (the default for to); granularity is line
+// or word and context the number of unchanged tokens around each change.
+// format=unified returns the unified diff as plain text instead of JSON.
+func GetDiff(w http.ResponseWriter, r *http.Request, DB *gorm.DB, pool *config.ConnectionPool) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	query := r.URL.Query()
+	docID, err := strconv.ParseUint(query.Get("doc_id"), 10, 64)
+	if err != nil || query.Get("from") == "" {
+		SendErrorResponse(w, http.StatusBadRequest, "doc_id and from are required")
+		return
+	}
+	if _, ok := authorizeDocument(w, r, DB, userId, strconv.FormatUint(docID, 10), false); !ok {
+		return
+	}
+	key := strconv.FormatUint(docID, 10)
+	granularity := query.Get("granularity")
+	if granularity == "" {
+		granularity = diff.Lines
+	}
+	if granularity != diff.Lines && granularity != diff.Words {
+		SendErrorResponse(w, http.StatusBadRequest, "granularity must be line or word")
+		return
+	}
+	context := DefaultDiffContext
+	if value := query.Get("context"); value != "" {
+		if context, err = strconv.Atoi(value); err != nil || context < 0 {
+			SendErrorResponse(w, http.StatusBadRequest, "context must be a positive number")
+			return
+		}
+	}
+	to := query.Get("to")
+	if to == "" {
+		to = "head"
+	}
+
+	fromVersion, err := resolveVersion(DB, key, query.Get("from"))
+	if err != nil {
+		SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	toVersion, err := resolveVersion(DB, key, to)
+	if err != nil {
+		SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	old, ok := snapshotAt(w, r, pool, userId, key, fromVersion)
+	if !ok {
+		return
+	}
+	current, ok := snapshotAt(w, r, pool, userId, key, toVersion)
+	if !ok {
+		return
+	}
+
+	hunks := diff.Compare(old.Content, current.Content, granularity, context)
+	unified := diff.Unified(hunks, fmt.Sprintf("%s@%d", key, old.Version), fmt.Sprintf("%s@%d", key, current.Version), granularity)
+	if query.Get("format") == "unified" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(unified))
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[DiffResponse]{Status: "success", Message: "diff", Data: DiffResponse{
+		DocID:       key,
+		From:        old.Version,
+		To:          current.Version,
+		Granularity: granularity,
+		Hunks:       hunks,
+		Unified:     unified,
+	}})
+}
+
+// resolveVersion turns a version number, a tag name or "head" into a version.
+func resolveVersion(DB *gorm.DB, docID string, ref string) (int, error) {
+	if ref == "head" {
+		return config.HeadVersion, nil
+	}
+	if version, err := strconv.Atoi(ref); err == nil {
+		return version, nil
+	}
+	var tag models.VersionTag
+	if err := DB.First(&tag, "doc_id = ? and name = ?", docID, ref).Error; err != nil {
+		return 0, fmt.Errorf("no tag named %q", ref)
+	}
+	return tag.Version, nil
+}
+
+func snapshotAt(w http.ResponseWriter, r *http.Request, pool *config.ConnectionPool, userId string, docID string, version int) (models.DocumentSnapshot, bool) {
+	snapshot, err := pool.Store.ContentAt(r.Context(), docID, version, userId)
+	if errors.Is(err, config.ErrVersionUnavailable) {
+		SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return snapshot, false
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to rebuild version", "doc_id", docID, "version", version, "error", err)
+		SendErrorResponse(w, http.StatusNotFound, "document not found")
+		return snapshot, false
+	}
+	return snapshot, true
+}
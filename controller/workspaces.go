@@ -0,0 +1,459 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"real-time-collab/audit"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/mailer"
+	"real-time-collab/models"
+	"real-time-collab/services"
+	"real-time-collab/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type WorkspaceRequest struct {
+	Name              string `json:"name"`
+	DefaultPermission string `json:"default_permission"`
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+type InviteRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// WorkspaceWithRole is a workspace as listed for one of its members.
+type WorkspaceWithRole struct {
+	models.Workspace
+	Role string `json:"role"`
+}
+
+type Member struct {
+	models.Membership
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// authorizeDocument checks the user may read, or write, a document and
+// returns it. It writes the error response itself and returns false on
+// failure.
+func authorizeDocument(w http.ResponseWriter, r *http.Request, DB *gorm.DB, userId string, DocId string, write bool) (models.Document, bool) {
+	var document models.Document
+	id, err := strconv.ParseUint(DocId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the document id")
+		return document, false
+	}
+	if !authorizeToken(w, r, strconv.FormatUint(id, 10), write) {
+		return document, false
+	}
+	if err := DB.First(&document, "id = ?", id).Error; err != nil {
+		SendErrorResponse(w, http.StatusNotFound, "document not found")
+		return document, false
+	}
+	permission, err := config.DocumentPermission(DB, document, userId)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to check document permission", "doc_id", id, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to check permissions")
+		return document, false
+	}
+	if permission == models.PermissionNone {
+		// the document's existence is not revealed to outsiders
+		SendErrorResponse(w, http.StatusNotFound, "document not found")
+		return document, false
+	}
+	if !config.PermissionAllows(permission, write) {
+		SendErrorResponse(w, http.StatusForbidden, "you can only view this document")
+		return document, false
+	}
+	return document, true
+}
+
+// findWorkspace returns a workspace with the user's role in it, answering
+// 404 to non members and 403 to non admins when admin is set.
+func findWorkspace(w http.ResponseWriter, DB *gorm.DB, userId string, WorkspaceId string, admin bool) (models.Workspace, string, bool) {
+	var workspace models.Workspace
+	id, err := strconv.ParseUint(WorkspaceId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the workspace id")
+		return workspace, "", false
+	}
+	role, err := config.MemberRole(DB, uint(id), userId)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return workspace, "", false
+	}
+	if role == "" || DB.First(&workspace, "id = ?", id).Error != nil {
+		SendErrorResponse(w, http.StatusNotFound, "workspace not found")
+		return workspace, "", false
+	}
+	if admin && role != models.WorkspaceRoleAdmin {
+		SendErrorResponse(w, http.StatusForbidden, "workspace admin access required")
+		return workspace, "", false
+	}
+	return workspace, role, true
+}
+
+// CreateWorkspace creates a workspace with the caller as its admin.
+func CreateWorkspace(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var request WorkspaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 100 {
+		SendErrorResponse(w, http.StatusBadRequest, "a name of at most 100 bytes is required")
+		return
+	}
+	if request.DefaultPermission == "" {
+		request.DefaultPermission = models.PermissionEdit
+	}
+	if !config.ValidDefaultPermission(request.DefaultPermission) {
+		SendErrorResponse(w, http.StatusBadRequest, "default_permission must be view or edit")
+		return
+	}
+	workspace := models.Workspace{Name: request.Name, CreatedBy: userId, DefaultPermission: request.DefaultPermission}
+	if err := config.CreateWorkspace(DB, &workspace); err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to save workspace")
+		return
+	}
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionWorkspaceCreate, ActorID: userId, TargetType: audit.TargetWorkspace, TargetID: strconv.FormatUint(uint64(workspace.ID), 10), Details: map[string]interface{}{"name": workspace.Name, "default_permission": workspace.DefaultPermission}})
+	SendJSONResponse(w, http.StatusCreated, SuccessResponse[WorkspaceWithRole]{Status: "success", Message: "workspace created", Data: WorkspaceWithRole{Workspace: workspace, Role: models.WorkspaceRoleAdmin}})
+}
+
+// GetWorkspaces lists the workspaces the caller is a member of.
+func GetWorkspaces(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	var memberships []models.Membership
+	if err := DB.Where("user_id = ?", userId).Find(&memberships).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	roles := make(map[uint]string, len(memberships))
+	ids := make([]uint, 0, len(memberships))
+	for _, membership := range memberships {
+		roles[membership.WorkspaceID] = membership.Role
+		ids = append(ids, membership.WorkspaceID)
+	}
+	var workspaces []models.Workspace
+	if len(ids) > 0 {
+		if err := DB.Where("id IN ?", ids).Order("name ASC").Find(&workspaces).Error; err != nil {
+			SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+			return
+		}
+	}
+	listed := make([]WorkspaceWithRole, 0, len(workspaces))
+	for _, workspace := range workspaces {
+		listed = append(listed, WorkspaceWithRole{Workspace: workspace, Role: roles[workspace.ID]})
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]WorkspaceWithRole]{Status: "success", Message: "workspaces", Data: listed})
+}
+
+// UpdateWorkspace renames a workspace or changes its default permission.
+func UpdateWorkspace(w http.ResponseWriter, r *http.Request, DB *gorm.DB, WorkspaceId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	workspace, _, ok := findWorkspace(w, DB, userId, WorkspaceId, true)
+	if !ok {
+		return
+	}
+	var request WorkspaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	changes := map[string]interface{}{}
+	if name := strings.TrimSpace(request.Name); name != "" {
+		if len(name) > 100 {
+			SendErrorResponse(w, http.StatusBadRequest, "the name is at most 100 bytes")
+			return
+		}
+		changes["name"] = name
+		workspace.Name = name
+	}
+	if request.DefaultPermission != "" {
+		if !config.ValidDefaultPermission(request.DefaultPermission) {
+			SendErrorResponse(w, http.StatusBadRequest, "default_permission must be view or edit")
+			return
+		}
+		changes["default_permission"] = request.DefaultPermission
+		workspace.DefaultPermission = request.DefaultPermission
+	}
+	if len(changes) > 0 {
+		if err := DB.Model(&models.Workspace{}).Where("id = ?", workspace.ID).Updates(changes).Error; err != nil {
+			SendErrorResponse(w, http.StatusInternalServerError, "failed to update workspace")
+			return
+		}
+		audit.Record(r, DB, audit.Entry{Action: audit.ActionWorkspaceUpdate, ActorID: userId, TargetType: audit.TargetWorkspace, TargetID: strconv.FormatUint(uint64(workspace.ID), 10), Details: changes})
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[models.Workspace]{Status: "success", Message: "workspace updated", Data: workspace})
+}
+
+// GetMembers lists the members of a workspace to any of its members.
+func GetMembers(w http.ResponseWriter, r *http.Request, DB *gorm.DB, WorkspaceId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	workspace, _, ok := findWorkspace(w, DB, userId, WorkspaceId, false)
+	if !ok {
+		return
+	}
+	var memberships []models.Membership
+	if err := DB.Where("workspace_id = ?", workspace.ID).Order("created_at ASC").Find(&memberships).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	members := make([]Member, 0, len(memberships))
+	for _, membership := range memberships {
+		member := Member{Membership: membership}
+		var user models.User
+		if exists, err := services.FindUserById(&user, DB, membership.UserID); err == nil && exists {
+			member.Username = user.Username
+			member.Email = user.Email
+		}
+		members = append(members, member)
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]Member]{Status: "success", Message: "members", Data: members})
+}
+
+// UpdateMember changes the role of a member. Only admins may.
+func UpdateMember(w http.ResponseWriter, r *http.Request, DB *gorm.DB, WorkspaceId string, MemberId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	workspace, _, ok := findWorkspace(w, DB, userId, WorkspaceId, true)
+	if !ok {
+		return
+	}
+	var request RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !config.ValidRole(request.Role) {
+		SendErrorResponse(w, http.StatusBadRequest, "role must be admin, member or guest")
+		return
+	}
+	changeMembership(w, r, DB, userId, workspace.ID, MemberId, request.Role)
+}
+
+// RemoveMember takes a user out of a workspace. Admins may remove anyone,
+// members only themselves.
+func RemoveMember(w http.ResponseWriter, r *http.Request, DB *gorm.DB, WorkspaceId string, MemberId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	workspace, _, ok := findWorkspace(w, DB, userId, WorkspaceId, MemberId != userId)
+	if !ok {
+		return
+	}
+	changeMembership(w, r, DB, userId, workspace.ID, MemberId, "")
+}
+
+func changeMembership(w http.ResponseWriter, r *http.Request, DB *gorm.DB, userId string, workspaceID uint, MemberId string, role string) {
+	err := config.SetMemberRole(DB, workspaceID, MemberId, role)
+	if err == nil {
+		entry := audit.Entry{Action: audit.ActionMemberRole, ActorID: userId, TargetType: audit.TargetUser, TargetID: MemberId, Details: map[string]interface{}{"workspace_id": workspaceID, "role": role}}
+		if role == "" {
+			entry.Action = audit.ActionMemberRemove
+			entry.Details = map[string]interface{}{"workspace_id": workspaceID}
+		}
+		audit.Record(r, DB, entry)
+	}
+	switch {
+	case errors.Is(err, config.ErrNotMember):
+		SendErrorResponse(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, config.ErrLastAdmin):
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+	case err != nil:
+		logging.FromContext(r.Context()).Error("failed to change membership", "workspace_id", workspaceID, "member_id", MemberId, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to change membership")
+	case role == "":
+		SendJSONResponse(w, http.StatusOK, "member removed")
+	default:
+		SendJSONResponse(w, http.StatusOK, "role changed to "+role)
+	}
+}
+
+// InviteMember emails an invitation to join a workspace. Only admins may
+// invite.
+func InviteMember(w http.ResponseWriter, r *http.Request, DB *gorm.DB, mail mailer.Mailer, settings config.AccountSettings, WorkspaceId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	workspace, _, ok := findWorkspace(w, DB, userId, WorkspaceId, true)
+	if !ok {
+		return
+	}
+	var request InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Wrong request body")
+		return
+	}
+	request.Email = strings.ToLower(strings.TrimSpace(request.Email))
+	if request.Role == "" {
+		request.Role = models.WorkspaceRoleMember
+	}
+	if !strings.Contains(request.Email, "@") || !config.ValidRole(request.Role) {
+		SendErrorResponse(w, http.StatusBadRequest, "an email and a role of admin, member or guest are required")
+		return
+	}
+
+	invite := models.WorkspaceInvite{
+		WorkspaceID: workspace.ID,
+		Email:       request.Email,
+		Role:        request.Role,
+		InvitedBy:   userId,
+		ExpiresAt:   time.Now().Add(settings.InviteTTL),
+	}
+	if err := DB.Create(&invite).Error; err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to save invite")
+		return
+	}
+	token, err := utils.GenerateActionToken(invite.ID, utils.WorkspaceInvitePurpose, utils.Fingerprint(invite.Email), settings.InviteTTL)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to create invite token")
+		return
+	}
+	sendMail(r, mail, mailer.Message{
+		To:      invite.Email,
+		Subject: "You are invited to " + workspace.Name,
+		Body: "Hi,\n\nyou are invited to join the workspace " + workspace.Name + " as " + invite.Role +
+			". Sign in or create an account with this address, then open this link:\n\n" +
+			settings.BaseURL + "/invites/accept?token=" + url.QueryEscape(token) +
+			"\n\nThe invitation expires in " + settings.InviteTTL.String() + ".\n",
+	})
+	logging.FromContext(r.Context()).Info("Workspace invite sent", "workspace_id", workspace.ID, "invite_id", invite.ID, "role", invite.Role)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionInviteCreate, ActorID: userId, TargetType: audit.TargetInvite, TargetID: strconv.FormatUint(uint64(invite.ID), 10), Details: map[string]interface{}{"workspace_id": workspace.ID, "email": invite.Email, "role": invite.Role}})
+	SendJSONResponse(w, http.StatusCreated, SuccessResponse[models.WorkspaceInvite]{Status: "success", Message: "invite sent", Data: invite})
+}
+
+// GetInvites lists the invites of a workspace that were not accepted yet.
+func GetInvites(w http.ResponseWriter, r *http.Request, DB *gorm.DB, WorkspaceId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	workspace, _, ok := findWorkspace(w, DB, userId, WorkspaceId, true)
+	if !ok {
+		return
+	}
+	var invites []models.WorkspaceInvite
+	err = DB.Where("workspace_id = ? and accepted_at is null and expires_at > ?", workspace.ID, time.Now()).
+		Order("created_at DESC").Find(&invites).Error
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrive data from the DB")
+		return
+	}
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[[]models.WorkspaceInvite]{Status: "success", Message: "invites", Data: invites})
+}
+
+// RevokeInvite deletes an invite so its link stops working.
+func RevokeInvite(w http.ResponseWriter, r *http.Request, DB *gorm.DB, WorkspaceId string, InviteId string) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	workspace, _, ok := findWorkspace(w, DB, userId, WorkspaceId, true)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseUint(InviteId, 10, 64)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "Error Parsing the invite id")
+		return
+	}
+	result := DB.Where("id = ? and workspace_id = ? and accepted_at is null", id, workspace.ID).Delete(&models.WorkspaceInvite{})
+	if result.Error != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to revoke invite")
+		return
+	}
+	if result.RowsAffected == 0 {
+		SendErrorResponse(w, http.StatusNotFound, "invite not found")
+		return
+	}
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionInviteRevoke, ActorID: userId, TargetType: audit.TargetInvite, TargetID: strconv.FormatUint(id, 10), Details: map[string]interface{}{"workspace_id": workspace.ID}})
+	SendJSONResponse(w, http.StatusOK, "invite revoked")
+}
+
+// AcceptInvite joins the caller to the workspace of an invite. The token
+// comes from the query of the emailed link or from the body, and only
+// works for the account with the invited address.
+func AcceptInvite(w http.ResponseWriter, r *http.Request, DB *gorm.DB) {
+	userId, err := ValidateJwtToken(w, r, DB)
+	if err != nil {
+		SendErrorResponse(w, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		var request TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err == nil {
+			token = request.Token
+		}
+	}
+	inviteId, fingerprint, err := utils.ParseActionToken(token, utils.WorkspaceInvitePurpose)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, "invalid or expired invite")
+		return
+	}
+	var invite models.WorkspaceInvite
+	if err := DB.First(&invite, "id = ?", inviteId).Error; err != nil || fingerprint != utils.Fingerprint(invite.Email) || time.Now().After(invite.ExpiresAt) {
+		SendErrorResponse(w, http.StatusBadRequest, "invalid or expired invite")
+		return
+	}
+	var user models.User
+	exists, err := services.FindUserById(&user, DB, userId)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, "error occured while trying to fetch the DB")
+		return
+	}
+	if !exists || !strings.EqualFold(user.Email, invite.Email) {
+		SendErrorResponse(w, http.StatusForbidden, "the invite is for another email address")
+		return
+	}
+
+	err = config.AcceptInvite(DB, &invite, userId)
+	if errors.Is(err, config.ErrInviteUsed) {
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to accept invite", "invite_id", invite.ID, "error", err)
+		SendErrorResponse(w, http.StatusInternalServerError, "failed to accept invite")
+		return
+	}
+	logging.FromContext(r.Context()).Info("Workspace invite accepted", "workspace_id", invite.WorkspaceID, "invite_id", invite.ID, "user_id", userId)
+	audit.Record(r, DB, audit.Entry{Action: audit.ActionInviteAccept, ActorID: userId, TargetType: audit.TargetInvite, TargetID: strconv.FormatUint(uint64(invite.ID), 10), Details: map[string]interface{}{"workspace_id": invite.WorkspaceID, "role": invite.Role}})
+	SendJSONResponse(w, http.StatusOK, SuccessResponse[models.WorkspaceInvite]{Status: "success", Message: "joined the workspace", Data: invite})
+}
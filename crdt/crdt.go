@@ -0,0 +1,464 @@
+// Package crdt implements the replicated growable array (RGA) sequence
+// CRDT used by documents in CRDT mode.
+//
+// Every character carries a unique ID made of the id of the client that
+// inserted it and a Lamport clock, and remembers the character it was
+// inserted after (its origin). Concurrent inserts after the same origin are
+// ordered by ID, greatest first, so every replica that has seen the same
+// inserts ends up with the same sequence no matter in which order they
+// arrived. Deleted characters stay in the sequence as tombstones because
+// later inserts may use them as origin.
+//
+// Replicas exchange Updates. An update is idempotent and may be applied in
+// any order; inserts whose origin has not arrived yet are held back until
+// it does. A StateVector summarises which inserts a replica has, so two
+// replicas can sync by sending each other Diff(other's vector). The vector
+// is only exact when the updates of each client are applied in the order
+// the client made them, which relaying them over one connection does.
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// SeedClient is the client id of the characters a document had when it was
+// switched to CRDT mode. The seed is deterministic so every replica that
+// seeds the same text gets the same IDs.
+const SeedClient = "~seed"
+
+// MaxPending bounds how many inserts and deletes may wait for a missing
+// origin before Apply gives up on the update.
+const MaxPending = 10000
+
+// MaxSpanLength bounds the characters one delete span may cover.
+const MaxSpanLength = 1 << 20
+
+// ID identifies a single character.
+type ID struct {
+	Client string `json:"client" msgpack:"client"`
+	Clock  uint64 `json:"clock" msgpack:"clock"`
+}
+
+// IsZero reports whether id is the start of the document, the origin of
+// characters inserted at position 0.
+func (id ID) IsZero() bool {
+	return id.Client == "" && id.Clock == 0
+}
+
+// after orders IDs by clock, then by client.
+func (id ID) after(other ID) bool {
+	if id.Clock != other.Clock {
+		return id.Clock > other.Clock
+	}
+	return id.Client > other.Client
+}
+
+// Insert is a run of characters typed by one client. The i-th character
+// has ID{Client, Clock+i} and the origin of each character but the first
+// is the one before it.
+type Insert struct {
+	ID     ID     `json:"id" msgpack:"id"`
+	Origin ID     `json:"origin" msgpack:"origin"`
+	Text   string `json:"text" msgpack:"text"`
+}
+
+// Span is a run of characters with consecutive clocks from one client.
+type Span struct {
+	Client string `json:"client" msgpack:"client"`
+	Clock  uint64 `json:"clock" msgpack:"clock"`
+	Length int    `json:"length" msgpack:"length"`
+}
+
+// Update is the unit replicas exchange.
+type Update struct {
+	Inserts []Insert `json:"inserts,omitempty" msgpack:"inserts,omitempty"`
+	Deletes []Span   `json:"deletes,omitempty" msgpack:"deletes,omitempty"`
+}
+
+// Empty reports whether the update carries nothing.
+func (update Update) Empty() bool {
+	return len(update.Inserts) == 0 && len(update.Deletes) == 0
+}
+
+// StateVector maps a client id to the highest clock of its inserts a
+// replica has integrated. Clients send their inserts in order, so the
+// replica has every insert of that client up to the clock.
+type StateVector map[string]uint64
+
+// Merge raises vector to include everything other has.
+func (vector StateVector) Merge(other StateVector) {
+	for client, clock := range other {
+		if clock > vector[client] {
+			vector[client] = clock
+		}
+	}
+}
+
+// Clone returns a copy of the vector.
+func (vector StateVector) Clone() StateVector {
+	clone := make(StateVector, len(vector))
+	for client, clock := range vector {
+		clone[client] = clock
+	}
+	return clone
+}
+
+type item struct {
+	id      ID
+	origin  ID
+	value   rune
+	deleted bool
+}
+
+// Doc is one replica of a document. It is not safe for concurrent use.
+type Doc struct {
+	items  []item
+	known  map[ID]bool
+	vector StateVector
+	// maxClock is the highest clock seen, the next local insert must be above it
+	maxClock uint64
+
+	pending        []Insert
+	pendingDeletes []Span
+}
+
+// New returns an empty document.
+func New() *Doc {
+	return &Doc{known: make(map[ID]bool), vector: make(StateVector)}
+}
+
+// FromText returns a document holding text, inserted by SeedClient.
+func FromText(text string) *Doc {
+	doc := New()
+	if text != "" {
+		doc.integrate(Insert{ID: ID{Client: SeedClient, Clock: 1}, Text: text})
+	}
+	return doc
+}
+
+// Decode restores a document from the output of Encode.
+func Decode(data []byte) (*Doc, error) {
+	var update Update
+	if err := json.Unmarshal(data, &update); err != nil {
+		return nil, fmt.Errorf("failed to decode crdt state: %w", err)
+	}
+	doc := New()
+	if _, err := doc.Apply(update); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Encode returns the full state of the document, tombstones included.
+// Inserts still waiting for their origin are not part of it.
+func (doc *Doc) Encode() ([]byte, error) {
+	return json.Marshal(doc.Diff(nil))
+}
+
+// Text materialises the visible content of the document.
+func (doc *Doc) Text() string {
+	buffer := make([]byte, 0, len(doc.items))
+	for _, item := range doc.items {
+		if !item.deleted {
+			buffer = utf8.AppendRune(buffer, item.value)
+		}
+	}
+	return string(buffer)
+}
+
+// StateVector returns a copy of the document's state vector.
+func (doc *Doc) StateVector() StateVector {
+	return doc.vector.Clone()
+}
+
+// Pending is the number of inserts and deletes waiting for a missing origin.
+func (doc *Doc) Pending() int {
+	return len(doc.pending) + len(doc.pendingDeletes)
+}
+
+// Apply integrates an update and returns whether it changed the document.
+// Parts of the update that were applied before are ignored and parts whose
+// origin is missing are held back until a later update brings it.
+func (doc *Doc) Apply(update Update) (bool, error) {
+	for _, insert := range update.Inserts {
+		if insert.ID.Client == "" || insert.ID.Clock == 0 {
+			return false, fmt.Errorf("insert without client id or clock")
+		}
+		if insert.Text == "" || !utf8.ValidString(insert.Text) {
+			return false, fmt.Errorf("insert %s@%d has no valid text", insert.ID.Client, insert.ID.Clock)
+		}
+	}
+	for _, span := range update.Deletes {
+		if span.Client == "" || span.Clock == 0 || span.Length <= 0 || span.Length > MaxSpanLength ||
+			span.Clock+uint64(span.Length) < span.Clock {
+			return false, fmt.Errorf("invalid delete span")
+		}
+	}
+	if doc.Pending()+len(update.Inserts)+len(update.Deletes) > MaxPending {
+		return false, fmt.Errorf("too many operations waiting for missing origins")
+	}
+
+	// Lamport order is causal order, so origins are integrated before the
+	// inserts that point at them whenever both are in the same update
+	inserts := append(doc.pending, update.Inserts...)
+	sort.SliceStable(inserts, func(i, j int) bool {
+		return inserts[j].ID.after(inserts[i].ID)
+	})
+	doc.pending = nil
+	changed := false
+	for progress := true; progress; {
+		progress = false
+		remaining := inserts[:0]
+		for _, insert := range inserts {
+			switch {
+			case doc.has(insert):
+			case doc.ready(insert, remaining):
+				doc.integrate(insert)
+				changed = true
+				progress = true
+			default:
+				remaining = append(remaining, insert)
+			}
+		}
+		inserts = remaining
+	}
+	doc.pending = append(doc.pending, inserts...)
+
+	deletes := append(doc.pendingDeletes, update.Deletes...)
+	doc.pendingDeletes = nil
+	for _, span := range deletes {
+		deleted, missing := doc.delete(span)
+		changed = changed || deleted
+		doc.pendingDeletes = append(doc.pendingDeletes, missing...)
+	}
+	return changed, nil
+}
+
+// Diff returns what a replica with the given state vector is missing: the
+// inserts it has not seen and, since deletes are not covered by the vector,
+// every delete.
+func (doc *Doc) Diff(vector StateVector) Update {
+	var update Update
+	for i, item := range doc.items {
+		if item.id.Clock <= vector[item.id.Client] {
+			continue
+		}
+		if n := len(update.Inserts); n > 0 && i > 0 {
+			last := &update.Inserts[n-1]
+			previous := doc.items[i-1]
+			// extend the run while the characters were typed in one go
+			if previous.id.Client == item.id.Client && previous.id.Clock+1 == item.id.Clock &&
+				item.origin == previous.id && last.ID.Client == item.id.Client &&
+				last.ID.Clock+uint64(utf8.RuneCountInString(last.Text)) == item.id.Clock {
+				last.Text += string(item.value)
+				continue
+			}
+		}
+		update.Inserts = append(update.Inserts, Insert{ID: item.id, Origin: item.origin, Text: string(item.value)})
+	}
+	update.Deletes = doc.deleteSet()
+	return update
+}
+
+// LocalInsert inserts text at a visible position on behalf of client and
+// returns the update to send to the other replicas.
+func (doc *Doc) LocalInsert(client string, position int, text string) (Update, error) {
+	if text == "" {
+		return Update{}, nil
+	}
+	origin, err := doc.originAt(position)
+	if err != nil {
+		return Update{}, err
+	}
+	insert := Insert{ID: ID{Client: client, Clock: doc.maxClock + 1}, Origin: origin, Text: text}
+	update := Update{Inserts: []Insert{insert}}
+	_, err = doc.Apply(update)
+	return update, err
+}
+
+// LocalDelete deletes length visible characters starting at position and
+// returns the update to send to the other replicas.
+func (doc *Doc) LocalDelete(position int, length int) (Update, error) {
+	var update Update
+	visible := 0
+	for _, item := range doc.items {
+		if item.deleted {
+			continue
+		}
+		if visible >= position && visible < position+length {
+			update.Deletes = appendSpan(update.Deletes, item.id)
+		}
+		visible++
+	}
+	if position < 0 || length < 0 || position+length > visible {
+		return Update{}, fmt.Errorf("delete of %d at %d is out of range (length %d)", length, position, visible)
+	}
+	_, err := doc.Apply(update)
+	return update, err
+}
+
+// has reports whether every character of insert is integrated already.
+func (doc *Doc) has(insert Insert) bool {
+	clock := insert.ID.Clock
+	for range insert.Text {
+		if !doc.known[ID{Client: insert.ID.Client, Clock: clock}] {
+			return false
+		}
+		clock++
+	}
+	return true
+}
+
+// ready reports whether insert can be integrated: its origin is there and
+// no earlier insert of the same client is still waiting.
+func (doc *Doc) ready(insert Insert, waiting []Insert) bool {
+	for _, other := range waiting {
+		if other.ID.Client == insert.ID.Client && other.ID.Clock < insert.ID.Clock {
+			return false
+		}
+	}
+	return insert.Origin.IsZero() || doc.known[insert.Origin]
+}
+
+// integrate places the characters of insert, whose origin must be present.
+// Characters that are there already, because the run overlaps an earlier
+// one, are skipped.
+func (doc *Doc) integrate(insert Insert) {
+	origin := insert.Origin
+	index := doc.indexOf(origin)
+	clock := insert.ID.Clock
+	for _, value := range insert.Text {
+		id := ID{Client: insert.ID.Client, Clock: clock}
+		if doc.known[id] {
+			origin = id
+			index = doc.indexOf(id)
+			clock++
+			continue
+		}
+		position := index + 1
+		// concurrent inserts after the same origin with a greater id, and
+		// everything inserted after those, come first
+		for position < len(doc.items) && doc.items[position].id.after(id) {
+			position++
+		}
+		doc.items = append(doc.items, item{})
+		copy(doc.items[position+1:], doc.items[position:])
+		doc.items[position] = item{id: id, origin: origin, value: value}
+		doc.known[id] = true
+
+		origin = id
+		index = position
+		clock++
+	}
+	last := clock - 1
+	if last > doc.vector[insert.ID.Client] {
+		doc.vector[insert.ID.Client] = last
+	}
+	if last > doc.maxClock {
+		doc.maxClock = last
+	}
+}
+
+// delete marks the characters of span as deleted and returns the parts of
+// it that are not in the document yet. It walks the document rather than
+// the span, so the cost does not depend on the length the sender claims.
+func (doc *Doc) delete(span Span) (bool, []Span) {
+	changed := false
+	end := span.Clock + uint64(span.Length)
+	var present []uint64
+	for i := range doc.items {
+		item := &doc.items[i]
+		if item.id.Client != span.Client || item.id.Clock < span.Clock || item.id.Clock >= end {
+			continue
+		}
+		if !item.deleted {
+			item.deleted = true
+			changed = true
+		}
+		present = append(present, item.id.Clock)
+	}
+	sort.Slice(present, func(i, j int) bool { return present[i] < present[j] })
+
+	// the gaps between the characters found are still to come
+	var missing []Span
+	next := span.Clock
+	for _, clock := range present {
+		if clock > next {
+			missing = append(missing, Span{Client: span.Client, Clock: next, Length: int(clock - next)})
+		}
+		next = clock + 1
+	}
+	if next < end {
+		missing = append(missing, Span{Client: span.Client, Clock: next, Length: int(end - next)})
+	}
+	return changed, missing
+}
+
+func (doc *Doc) deleteSet() []Span {
+	var deleted []ID
+	for _, item := range doc.items {
+		if item.deleted {
+			deleted = append(deleted, item.id)
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		if deleted[i].Client != deleted[j].Client {
+			return deleted[i].Client < deleted[j].Client
+		}
+		return deleted[i].Clock < deleted[j].Clock
+	})
+	var spans []Span
+	for _, id := range deleted {
+		spans = appendSpan(spans, id)
+	}
+	return append(spans, doc.pendingDeletes...)
+}
+
+// appendSpan adds id to spans, extending the last span when it is the next
+// clock of the same client.
+func appendSpan(spans []Span, id ID) []Span {
+	if n := len(spans); n > 0 {
+		last := &spans[n-1]
+		if last.Client == id.Client && last.Clock+uint64(last.Length) == id.Clock {
+			last.Length++
+			return spans
+		}
+	}
+	return append(spans, Span{Client: id.Client, Clock: id.Clock, Length: 1})
+}
+
+func (doc *Doc) indexOf(id ID) int {
+	if id.IsZero() {
+		return -1
+	}
+	for i := range doc.items {
+		if doc.items[i].id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// originAt returns the ID of the visible character before position.
+func (doc *Doc) originAt(position int) (ID, error) {
+	if position < 0 {
+		return ID{}, fmt.Errorf("position %d is out of range", position)
+	}
+	if position == 0 {
+		return ID{}, nil
+	}
+	visible := 0
+	for _, item := range doc.items {
+		if item.deleted {
+			continue
+		}
+		visible++
+		if visible == position {
+			return item.id, nil
+		}
+	}
+	return ID{}, fmt.Errorf("position %d is out of range (length %d)", position, visible)
+}
@@ -0,0 +1,242 @@
+package crdt
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// permutations returns every order of n items.
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	var orders [][]int
+	for _, order := range permutations(n - 1) {
+		for i := 0; i <= len(order); i++ {
+			next := append(append(append([]int(nil), order[:i]...), n-1), order[i:]...)
+			orders = append(orders, next)
+		}
+	}
+	return orders
+}
+
+func mustApply(t *testing.T, doc *Doc, update Update) {
+	t.Helper()
+	if _, err := doc.Apply(update); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentEditsConvergeInAnyOrder(t *testing.T) {
+	base := FromText("hello")
+	seed := base.Diff(nil)
+
+	// three replicas edit the same base concurrently
+	alice, bob, carol := New(), New(), New()
+	for _, replica := range []*Doc{alice, bob, carol} {
+		mustApply(t, replica, seed)
+	}
+	var updates []Update
+	edit := func(update Update, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		updates = append(updates, update)
+	}
+	edit(alice.LocalInsert("alice", 5, " world"))
+	edit(alice.LocalDelete(0, 1))
+	edit(bob.LocalInsert("bob", 5, "!"))
+	edit(bob.LocalInsert("bob", 0, ">"))
+	edit(carol.LocalDelete(1, 3))
+	edit(carol.LocalInsert("carol", 1, "EY"))
+
+	var want string
+	for _, order := range permutations(len(updates)) {
+		replica := New()
+		mustApply(t, replica, seed)
+		for _, i := range order {
+			mustApply(t, replica, updates[i])
+		}
+		if replica.Pending() != 0 {
+			t.Fatalf("order %v left %d operations pending", order, replica.Pending())
+		}
+		if want == "" {
+			want = replica.Text()
+		} else if got := replica.Text(); got != want {
+			t.Fatalf("order %v gives %q, another order gave %q", order, got, want)
+		}
+	}
+	// no delete covers a concurrent insert, so every insert survives
+	for _, part := range []string{" world", "!", ">", "EY"} {
+		if !strings.Contains(want, part) {
+			t.Errorf("converged text %q lost %q", want, part)
+		}
+	}
+}
+
+func TestConcurrentInsertsAtTheSamePosition(t *testing.T) {
+	a, b := New(), New()
+	first, err := a.LocalInsert("a", 0, "xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.LocalInsert("b", 0, "yy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustApply(t, a, second)
+	mustApply(t, b, first)
+	if a.Text() != b.Text() {
+		t.Fatalf("replicas diverged: %q and %q", a.Text(), b.Text())
+	}
+	// runs are not interleaved
+	if got := a.Text(); got != "xxyy" && got != "yyxx" {
+		t.Errorf("concurrent runs interleaved: %q", got)
+	}
+}
+
+func TestOutOfOrderUpdatesWaitForTheirOrigin(t *testing.T) {
+	source := New()
+	first, _ := source.LocalInsert("a", 0, "ab")
+	second, _ := source.LocalInsert("a", 2, "cd")
+	remove, _ := source.LocalDelete(1, 2)
+
+	replica := New()
+	mustApply(t, replica, remove)
+	mustApply(t, replica, second)
+	if replica.Text() != "" || replica.Pending() != 2 {
+		t.Fatalf("text %q with %d pending before the origin arrived", replica.Text(), replica.Pending())
+	}
+	mustApply(t, replica, first)
+	if replica.Text() != source.Text() || replica.Pending() != 0 {
+		t.Errorf("got %q with %d pending, want %q", replica.Text(), replica.Pending(), source.Text())
+	}
+
+	// applying everything again changes nothing
+	for _, update := range []Update{first, second, remove} {
+		changed, err := replica.Apply(update)
+		if err != nil || changed {
+			t.Errorf("reapplying %+v changed the document: %v", update, err)
+		}
+	}
+}
+
+func TestSyncWithStateVectors(t *testing.T) {
+	a, b := New(), New()
+	shared, _ := a.LocalInsert("a", 0, "shared")
+	mustApply(t, b, shared)
+	a.LocalInsert("a", 6, " by a")
+	b.LocalInsert("b", 0, "b: ")
+	b.LocalDelete(3, 1)
+
+	toB := a.Diff(b.StateVector())
+	toA := b.Diff(a.StateVector())
+	mustApply(t, a, toA)
+	mustApply(t, b, toB)
+	if a.Text() != b.Text() {
+		t.Fatalf("replicas diverged after sync: %q and %q", a.Text(), b.Text())
+	}
+	if a.Text() != "b: hared by a" {
+		t.Errorf("synced text is %q", a.Text())
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	doc := FromText("draft")
+	doc.LocalInsert("a", 5, " two")
+	doc.LocalDelete(0, 1)
+	data, err := doc.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Text() != doc.Text() {
+		t.Errorf("decoded %q, want %q", decoded.Text(), doc.Text())
+	}
+	// the tombstone survives, so a late edit after it still lands
+	late, _ := doc.LocalInsert("b", 0, "D")
+	mustApply(t, decoded, late)
+	if decoded.Text() != doc.Text() {
+		t.Errorf("after a late edit decoded is %q, want %q", decoded.Text(), doc.Text())
+	}
+}
+
+func TestLongDeleteSpansAreCheap(t *testing.T) {
+	doc := FromText("some text")
+	start := time.Now()
+	changed, err := doc.Apply(Update{Deletes: []Span{{Client: SeedClient, Clock: 1, Length: MaxSpanLength}}})
+	if err != nil || !changed {
+		t.Fatalf("delete of the whole seed: changed %v, %v", changed, err)
+	}
+	if doc.Text() != "" {
+		t.Errorf("text %q left after deleting the seed", doc.Text())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("a long span took %v", elapsed)
+	}
+	// only what was not there yet waits
+	if doc.Pending() != 1 {
+		t.Errorf("%d spans pending, want the one past the seed", doc.Pending())
+	}
+
+	for _, span := range []Span{
+		{Client: "a", Clock: 1, Length: 1 << 31},
+		{Client: "a", Clock: 1, Length: MaxSpanLength + 1},
+		{Client: "a", Clock: ^uint64(0), Length: 2},
+		{Client: "a", Clock: 1, Length: 0},
+	} {
+		if _, err := doc.Apply(Update{Deletes: []Span{span}}); err == nil {
+			t.Errorf("span %+v was accepted", span)
+		}
+	}
+}
+
+func TestRandomConcurrentEditsConverge(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	clients := []string{"a", "b", "c"}
+	for round := 0; round < 50; round++ {
+		replicas := make([]*Doc, len(clients))
+		seed := FromText("0123456789").Diff(nil)
+		for i := range replicas {
+			replicas[i] = New()
+			mustApply(t, replicas[i], seed)
+		}
+		// each replica makes a few edits without seeing the others
+		var updates []Update
+		for i, replica := range replicas {
+			for edit := 0; edit < 4; edit++ {
+				length := len([]rune(replica.Text()))
+				var update Update
+				var err error
+				if length > 0 && random.Intn(2) == 0 {
+					position := random.Intn(length)
+					update, err = replica.LocalDelete(position, 1+random.Intn(length-position))
+				} else {
+					update, err = replica.LocalInsert(clients[i], random.Intn(length+1), string(rune('a'+random.Intn(26))))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				updates = append(updates, update)
+			}
+		}
+		var want string
+		for attempt := 0; attempt < 5; attempt++ {
+			replica := New()
+			mustApply(t, replica, seed)
+			for _, i := range random.Perm(len(updates)) {
+				mustApply(t, replica, updates[i])
+			}
+			if attempt == 0 {
+				want = replica.Text()
+			} else if replica.Text() != want {
+				t.Fatalf("round %d: %q and %q from different orders", round, replica.Text(), want)
+			}
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Package diff compares two texts line by line or word by word with Myers'
+// algorithm and groups the result into hunks with context, as JSON or as
+// unified diff text.
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Granularities a text can be compared at.
+const (
+	Lines = "line"
+	Words = "word"
+)
+
+// Kinds of edit.
+const (
+	Equal  = "equal"
+	Insert = "insert"
+	Delete = "delete"
+)
+
+// Edit is a run of tokens that are equal in both texts, only in the new one
+// or only in the old one.
+type Edit struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// Hunk is a group of changes with the unchanged tokens around them. Starts
+// are 1-based token numbers, lines or words depending on the granularity.
+type Hunk struct {
+	OldStart int    `json:"oldStart"`
+	OldCount int    `json:"oldCount"`
+	NewStart int    `json:"newStart"`
+	NewCount int    `json:"newCount"`
+	Edits    []Edit `json:"edits"`
+}
+
+// Tokenize splits text at the granularity. Lines lose their newline; words
+// are runs of letters and digits, runs of white space and single other
+// characters, so joining the words gives back the text.
+func Tokenize(text string, granularity string) []string {
+	if granularity == Words {
+		return words(text)
+	}
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+func words(text string) []string {
+	var tokens []string
+	class := func(r rune) int {
+		switch {
+		case unicode.IsSpace(r):
+			return 1
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			return 2
+		default:
+			return 3
+		}
+	}
+	start := 0
+	previous := 0
+	for i, r := range text {
+		current := class(r)
+		// punctuation is a token on its own
+		if i > start && (current != previous || current == 3) {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		previous = current
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+type tokenEdit struct {
+	op    string
+	token string
+}
+
+// maxEditDistance bounds the search for the shortest edit script. The
+// search keeps a slice of the frontier per step, so texts further apart
+// than this are diffed coarsely instead of with quadratic memory.
+const maxEditDistance = 1000
+
+// compute returns an edit script from a to b, one token per edit. The
+// script is the shortest one unless the texts differ by more than
+// maxEditDistance tokens, then the differing middle is deleted and
+// inserted as a whole.
+func compute(a []string, b []string) []tokenEdit {
+	// the common prefix and suffix are equal whatever the script
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]tokenEdit, 0, len(a)+len(b)-prefix-suffix)
+	for _, token := range a[:prefix] {
+		edits = append(edits, tokenEdit{Equal, token})
+	}
+	oldMiddle, newMiddle := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	middle, ok := myers(oldMiddle, newMiddle, maxEditDistance)
+	if !ok {
+		middle = middle[:0]
+		for _, token := range oldMiddle {
+			middle = append(middle, tokenEdit{Delete, token})
+		}
+		for _, token := range newMiddle {
+			middle = append(middle, tokenEdit{Insert, token})
+		}
+	}
+	edits = append(edits, middle...)
+	for _, token := range a[len(a)-suffix:] {
+		edits = append(edits, tokenEdit{Equal, token})
+	}
+	return edits
+}
+
+// myers returns the shortest edit script from a to b, or false when it is
+// longer than maxD. Step d only reaches diagonals -d to d, so the frontier
+// saved for it is the 2d+3 entries around them.
+func myers(a []string, b []string, maxD int) ([]tokenEdit, bool) {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxD)
+	if n+m == 0 {
+		return nil, true
+	}
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil, false
+	}
+
+	edits := make([]tokenEdit, 0, n+m)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		// diagonal k of step d is at k+d+1 in its saved frontier
+		v := trace[d]
+		k := x - y
+		var previousK int
+		if k == -d || (k != d && v[k-1+d+1] < v[k+1+d+1]) {
+			previousK = k + 1
+		} else {
+			previousK = k - 1
+		}
+		previousX := v[previousK+d+1]
+		previousY := previousX - previousK
+		for x > previousX && y > previousY {
+			edits = append(edits, tokenEdit{Equal, a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == previousX {
+				edits = append(edits, tokenEdit{Insert, b[y-1]})
+				y--
+			} else {
+				edits = append(edits, tokenEdit{Delete, a[x-1]})
+				x--
+			}
+		}
+		x, y = previousX, previousY
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits, true
+}
+
+// Compare diffs two texts and returns the hunks of changes, each with up to
+// context unchanged tokens before and after it. Hunks closer than twice the
+// context are merged.
+func Compare(old string, new string, granularity string, context int) []Hunk {
+	if context < 0 {
+		context = 0
+	}
+	edits := compute(Tokenize(old, granularity), Tokenize(new, granularity))
+	separator := ""
+	if granularity != Words {
+		separator = "\n"
+	}
+
+	var hunks []Hunk
+	oldLine, newLine := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].op == Equal {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+		// a change starts here, take the context before it
+		before := 0
+		for before < context && i-before-1 >= 0 && edits[i-before-1].op == Equal {
+			before++
+		}
+		start := i - before
+		hunk := Hunk{OldStart: oldLine - before + 1, NewStart: newLine - before + 1}
+		end := i
+		for end < len(edits) {
+			if edits[end].op != Equal {
+				end++
+				continue
+			}
+			run := 0
+			for end+run < len(edits) && edits[end+run].op == Equal {
+				run++
+			}
+			if end+run == len(edits) || run > 2*context {
+				end += min(run, context)
+				break
+			}
+			end += run
+		}
+		for _, edit := range edits[start:end] {
+			switch edit.op {
+			case Equal:
+				hunk.OldCount++
+				hunk.NewCount++
+			case Delete:
+				hunk.OldCount++
+			case Insert:
+				hunk.NewCount++
+			}
+			hunk.Edits = appendEdit(hunk.Edits, edit, separator)
+		}
+		oldLine = hunk.OldStart - 1 + hunk.OldCount
+		newLine = hunk.NewStart - 1 + hunk.NewCount
+		hunks = append(hunks, hunk)
+		i = end
+	}
+	return hunks
+}
+
+// appendEdit merges a token into the last edit when it is of the same kind.
+func appendEdit(edits []Edit, edit tokenEdit, separator string) []Edit {
+	if n := len(edits); n > 0 && edits[n-1].Op == edit.op {
+		edits[n-1].Text += separator + edit.token
+		return edits
+	}
+	return append(edits, Edit{Op: edit.op, Text: edit.token})
+}
+
+// Unified renders hunks as a unified diff. Line hunks use the usual " ",
+// "-" and "+" prefixes; word hunks are written inline, with deleted words
+// as [-...-] and inserted ones as {+...+}.
+func Unified(hunks []Hunk, oldName string, newName string, granularity string) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range hunks {
+		fmt.Fprintf(&builder, "@@ -%s +%s @@\n", hunkRange(hunk.OldStart, hunk.OldCount), hunkRange(hunk.NewStart, hunk.NewCount))
+		if granularity == Words {
+			for _, edit := range hunk.Edits {
+				switch edit.Op {
+				case Delete:
+					builder.WriteString("[-" + edit.Text + "-]")
+				case Insert:
+					builder.WriteString("{+" + edit.Text + "+}")
+				default:
+					builder.WriteString(edit.Text)
+				}
+			}
+			builder.WriteString("\n")
+			continue
+		}
+		for _, edit := range hunk.Edits {
+			prefix := " "
+			switch edit.Op {
+			case Delete:
+				prefix = "-"
+			case Insert:
+				prefix = "+"
+			}
+			for _, line := range strings.Split(edit.Text, "\n") {
+				builder.WriteString(prefix + line + "\n")
+			}
+		}
+	}
+	return builder.String()
+}
+
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		// an empty range names the token before it
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,151 @@
+package diff
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// apply rebuilds both texts from an edit script.
+func apply(edits []tokenEdit) ([]string, []string) {
+	var old, new []string
+	for _, edit := range edits {
+		switch edit.op {
+		case Equal:
+			old = append(old, edit.token)
+			new = append(new, edit.token)
+		case Delete:
+			old = append(old, edit.token)
+		case Insert:
+			new = append(new, edit.token)
+		}
+	}
+	return old, new
+}
+
+func changes(edits []tokenEdit) int {
+	count := 0
+	for _, edit := range edits {
+		if edit.op != Equal {
+			count++
+		}
+	}
+	return count
+}
+
+func TestComputeShortest(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		changes int
+	}{
+		{"", "", 0},
+		{"a b c", "a b c", 0},
+		{"", "a b", 2},
+		{"a b", "", 2},
+		{"a b c a b b a", "c b a b a c", 5},
+		{"a x c", "a y c", 2},
+		{"x a b c", "a b c y", 2},
+	}
+	for _, test := range tests {
+		a, b := strings.Fields(test.a), strings.Fields(test.b)
+		edits := compute(a, b)
+		old, new := apply(edits)
+		if strings.Join(old, " ") != test.a || strings.Join(new, " ") != test.b {
+			t.Errorf("compute(%q, %q) rebuilds %q, %q", test.a, test.b, old, new)
+		}
+		if got := changes(edits); got != test.changes {
+			t.Errorf("compute(%q, %q) has %d changes, want %d", test.a, test.b, got, test.changes)
+		}
+	}
+}
+
+func TestComputeFallsBackBeyondMaxEditDistance(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 5000; i++ {
+		a = append(a, fmt.Sprintf("old %d", i))
+		b = append(b, fmt.Sprintf("new %d", i))
+	}
+	a = append([]string{"head"}, append(a, "tail")...)
+	b = append([]string{"head"}, append(b, "tail")...)
+
+	edits := compute(a, b)
+	old, new := apply(edits)
+	if !reflect.DeepEqual(old, a) || !reflect.DeepEqual(new, b) {
+		t.Fatal("coarse script does not rebuild the texts")
+	}
+	if edits[0] != (tokenEdit{Equal, "head"}) || edits[len(edits)-1] != (tokenEdit{Equal, "tail"}) {
+		t.Errorf("common prefix and suffix are not kept equal: %v ... %v", edits[0], edits[len(edits)-1])
+	}
+	if got := changes(edits); got != 10000 {
+		t.Errorf("got %d changes, want 10000", got)
+	}
+}
+
+func TestComputeJustWithinMaxEditDistance(t *testing.T) {
+	var a, b []string
+	for i := 0; i < maxEditDistance; i++ {
+		a = append(a, "same", fmt.Sprintf("old %d", i))
+		b = append(b, "same")
+	}
+	edits := compute(a, b)
+	old, new := apply(edits)
+	if !reflect.DeepEqual(old, a) || !reflect.DeepEqual(new, b) {
+		t.Fatal("script does not rebuild the texts")
+	}
+	if got := changes(edits); got != maxEditDistance {
+		t.Errorf("got %d changes, want the shortest %d", got, maxEditDistance)
+	}
+}
+
+func TestTokenizeWords(t *testing.T) {
+	got := Tokenize("Hello, big  world!\n", Words)
+	want := []string{"Hello", ",", " ", "big", "  ", "world", "!", "\n"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize = %q, want %q", got, want)
+	}
+	if strings.Join(got, "") != "Hello, big  world!\n" {
+		t.Error("words do not join back to the text")
+	}
+}
+
+func TestCompareHunks(t *testing.T) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	new := "1\n2\nthree\n4\n5\n6\n7\n8\n9\nten\n"
+	hunks := Compare(old, new, Lines, 1)
+	want := []Hunk{
+		{OldStart: 2, OldCount: 3, NewStart: 2, NewCount: 3, Edits: []Edit{{Equal, "2"}, {Delete, "3"}, {Insert, "three"}, {Equal, "4"}}},
+		{OldStart: 9, OldCount: 2, NewStart: 9, NewCount: 2, Edits: []Edit{{Equal, "9"}, {Delete, "10"}, {Insert, "ten"}}},
+	}
+	if !reflect.DeepEqual(hunks, want) {
+		t.Fatalf("Compare = %+v, want %+v", hunks, want)
+	}
+
+	merged := Compare(old, new, Lines, 3)
+	if len(merged) != 1 || merged[0].OldStart != 1 || merged[0].OldCount != 10 {
+		t.Errorf("close hunks are not merged: %+v", merged)
+	}
+	if hunks := Compare(old, old, Lines, 3); len(hunks) != 0 {
+		t.Errorf("equal texts have hunks: %+v", hunks)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	hunks := Compare("a\nb\nc\n", "a\nB\nc\n", Lines, 1)
+	got := Unified(hunks, "doc@1", "doc@2", Lines)
+	want := "--- doc@1\n+++ doc@2\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"
+	if got != want {
+		t.Errorf("Unified = %q, want %q", got, want)
+	}
+
+	hunks = Compare("the quick fox", "the slow fox", Words, 1)
+	got = Unified(hunks, "doc@1", "doc@2", Words)
+	want = "--- doc@1\n+++ doc@2\n@@ -2,3 +2,3 @@\n [-quick-]{+slow+} \n"
+	if got != want {
+		t.Errorf("Unified = %q, want %q", got, want)
+	}
+
+	if got := Unified(Compare("", "a\n", Lines, 0), "old", "new", Lines); got != "--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n" {
+		t.Errorf("Unified of an insertion into an empty text = %q", got)
+	}
+}
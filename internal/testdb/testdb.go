@@ -0,0 +1,38 @@
+//go:build sqlite
+
+// Package testdb opens a SQLite database with the server's schema for the
+// tests that need a database. They are built with -tags sqlite, which takes
+// cgo:
+//
+//	go test -tags sqlite ./...
+package testdb
+
+import (
+	"path/filepath"
+	"real-time-collab/utils"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open returns a migrated database of its own for the test, removed when
+// the test ends.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	// a file rather than :memory:, which every connection of the pool would
+	// see as a different, empty database
+	path := filepath.Join(t.TempDir(), "test.db")
+	DB, err := gorm.Open(sqlite.Open(path+"?_busy_timeout=5000&_journal_mode=WAL"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.AutoMigrateModels(DB)
+	sqlDB, err := DB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return DB
+}
@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Redacted replaces the value of attributes that must never reach the logs.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values are always redacted, no
+// matter which group they are logged under.
+var sensitiveKeys = map[string]bool{
+	"content":       true,
+	"password":      true,
+	"token":         true,
+	"authorization": true,
+}
+
+type contextKey struct{}
+
+// Init installs the process wide slog logger. LOG_LEVEL picks the minimum
+// level (debug, info, warn, error) and LOG_FORMAT=json switches from text
+// to JSON output. Anything still using the standard log package is routed
+// through the same handler.
+func Init() *slog.Logger {
+	logger := New(os.Stdout, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+	slog.SetDefault(logger)
+	return logger
+}
+
+// New builds a logger writing to out with the given level and format.
+func New(out io.Writer, level string, format string) *slog.Logger {
+	options := &slog.HandlerOptions{
+		Level:       parseLevel(level),
+		ReplaceAttr: redact,
+	}
+	var handler slog.Handler
+	if strings.EqualFold(format, "json") {
+		handler = slog.NewJSONHandler(out, options)
+	} else {
+		handler = slog.NewTextHandler(out, options)
+	}
+	return slog.New(handler)
+}
+
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, Redacted)
+	}
+	return attr
+}
+
+// NewContext returns a copy of ctx carrying logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx, which carries the request
+// or connection id, or the default logger if there is none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the correlation id of the
+// request it belongs to.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the correlation id stored in ctx, "" outside of requests.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// NewID returns a random id used to correlate the log lines of one HTTP
+// request or websocket connection.
+func NewID() string {
+	buffer := make([]byte, 8)
+	if _, err := rand.Read(buffer); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buffer)
+}
@@ -0,0 +1,132 @@
+// Package mailer sends the transactional emails of the service, through an
+// SMTP server in production or to the log and a file in development.
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// FromEnv builds the mailer MAIL_DRIVER names: smtp, configured with
+// SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM, or log,
+// which appends messages to MAIL_FILE when it is set. There is no default:
+// messages carry reset and invite links, and a deployment that forgot to
+// configure SMTP must not quietly write them to a file instead.
+func FromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPMailer{
+			Addr:     net.JoinHostPort(os.Getenv("SMTP_HOST"), port),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	case "log":
+		return &LogMailer{From: from, File: os.Getenv("MAIL_FILE")}, nil
+	case "":
+		return nil, errors.New("MAIL_DRIVER must be set to smtp or log")
+	}
+	return nil, fmt.Errorf("unknown MAIL_DRIVER %q, use smtp or log", os.Getenv("MAIL_DRIVER"))
+}
+
+// SMTPMailer sends through an SMTP server, authenticating with PLAIN auth
+// when a username is set. net/smtp upgrades to TLS when the server offers
+// STARTTLS and refuses PLAIN auth over plain text to remote hosts.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (mailer *SMTPMailer) Send(ctx context.Context, message Message) error {
+	var auth smtp.Auth
+	if mailer.Username != "" {
+		host, _, _ := net.SplitHostPort(mailer.Addr)
+		auth = smtp.PlainAuth("", mailer.Username, mailer.Password, host)
+	}
+	// net/smtp has no context support, so the send runs until it fails or
+	// the caller gives up waiting on it
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(mailer.Addr, auth, mailer.From, []string{message.To}, format(mailer.From, message))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send mail: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LogMailer logs that a message was sent and, when File is set, appends it
+// to that file so links can be followed during local development. The body
+// is never logged, it carries the tokens of the links.
+type LogMailer struct {
+	From  string
+	File  string
+	mutex sync.Mutex
+}
+
+func (mailer *LogMailer) Send(ctx context.Context, message Message) error {
+	slog.InfoContext(ctx, "mail", "to", message.To, "subject", message.Subject)
+	if mailer.File == "" {
+		return nil
+	}
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	file, err := os.OpenFile(mailer.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open mail file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(format(mailer.From, message), "\n\n"...)); err != nil {
+		return fmt.Errorf("failed to write mail file: %w", err)
+	}
+	return nil
+}
+
+// format renders a message with its headers. Header values are stripped of
+// line breaks so a recipient cannot inject headers.
+func format(from string, message Message) []byte {
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "From: %s\r\n", clean.Replace(from))
+	fmt.Fprintf(&builder, "To: %s\r\n", clean.Replace(message.To))
+	fmt.Fprintf(&builder, "Subject: %s\r\n", clean.Replace(message.Subject))
+	fmt.Fprintf(&builder, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	builder.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	builder.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return []byte(builder.String())
+}
@@ -1,17 +1,44 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/mailer"
 	"real-time-collab/middleware"
 	"real-time-collab/routes"
+	"real-time-collab/tracing"
 	"real-time-collab/utils"
+	"syscall"
 )
 
 
 func main() {
 
+	logging.Init()
+
+	if err := utils.LoadSecrets(); err != nil {
+		slog.Error("Could not load signing secrets", "error", err)
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		slog.Error("Could not initialise tracing", "error", err)
+		os.Exit(1)
+	}
+
+	mail, err := mailer.FromEnv()
+	if err != nil {
+		slog.Error("Could not configure mail", "error", err)
+		os.Exit(1)
+	}
+
 	DB := config.InitDb()
 
 	workers := 40
@@ -23,16 +50,47 @@ func main() {
 	go pool.StartBroadcasting()
 
 	mux:= http.NewServeMux()
-	routes.SetRoutesForMux(mux,DB,pool)
+	routes.SetRoutesForMux(mux,DB,pool,mail)
 
-	handler:= middleware.AddCORSMiddleware(mux)
-	
-	log.Println("Starting server on :8080")
+	// tracing sits inside logging so the mux sets the route pattern on the
+	// same request the tracing and metrics middlewares look at; API tokens
+	// are resolved before them for the same reason
+	handler:= middleware.AddLoggingMiddleware(middleware.AddAPITokenMiddleware(DB,middleware.AddTracingMiddleware(middleware.AddMetricsMiddleware(middleware.AddCORSMiddleware(mux)))))
 
-	err:= http.ListenAndServe(":8080", handler)
+	server := &http.Server{
+		Addr:    ":8080",
+		Handler: handler,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		slog.Info("Starting server", "addr", server.Addr)
+		err:= server.ListenAndServe()
+		if(err != nil && !errors.Is(err, http.ErrServerClosed)){
+			slog.Error("Could not start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down, waiting for connections to drain", "timeout", pool.Settings.ShutdownTimeout)
 
-	if(err != nil){
-		log.Fatalf("Could not start server due to error : %v", err)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), pool.Settings.ShutdownTimeout)
+	defer cancel()
+
+	// stop accepting new requests first so no socket joins the pool while it drains
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown", "error", err)
+	}
+	if err := pool.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Connection pool shutdown", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Tracing shutdown", "error", err)
 	}
 
-}
\ No newline at end of file
+	slog.Info("Server stopped")
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "collab"
+
+var (
+	// ActiveConnections is the number of open websocket connections
+	ActiveConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_connections",
+		Help:      "Number of open websocket connections.",
+	})
+
+	// DocumentConnections is the number of connections in each document room
+	DocumentConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "document_connections",
+		Help:      "Number of websocket connections joined to a document.",
+	}, []string{"doc_id"})
+
+	// EventsProcessed counts document events that were applied and persisted
+	EventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_processed_total",
+		Help:      "Document events applied and persisted, by operation.",
+	}, []string{"operation"})
+
+	// EventsRejected counts websocket messages the workers dropped
+	EventsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_rejected_total",
+		Help:      "Websocket messages dropped by the workers, by reason.",
+	}, []string{"reason"})
+
+	TransformDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transform_duration_seconds",
+		Help:      "Time spent transforming an event against concurrent edits.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	PersistDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "persist_duration_seconds",
+		Help:      "Time spent flushing pending events and the document snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	// FlushFailures counts write-behind flushes that failed and will be retried
+	FlushFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "flush_failures_total",
+		Help:      "Write-behind flushes that failed and were left pending.",
+	})
+
+	// BroadcastFanout is the number of connections a broadcast was sent to
+	BroadcastFanout = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "broadcast_fanout",
+		Help:      "Number of connections a single broadcast was written to.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100, 250},
+	})
+
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route pattern and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// Rejection reasons used with EventsRejected
+const (
+	ReasonInvalidMessage   = "invalid_message"
+	ReasonInvalidEvent     = "invalid_event"
+	ReasonTransformFailed  = "transform_failed"
+	ReasonApplyFailed      = "apply_failed"
+	ReasonResumeFailed     = "resume_failed"
+	ReasonRateLimited      = "rate_limited"
+	ReasonBatchFailed      = "batch_failed"
+	ReasonWrongMode        = "wrong_mode"
+	ReasonCRDTFailed       = "crdt_failed"
+	ReasonDeltaFailed      = "delta_failed"
+	ReasonSuggestionFailed = "suggestion_failed"
+	ReasonForbidden        = "forbidden"
+)
+
+// RegisterPendingEvents exposes the number of applied events not yet flushed.
+func RegisterPendingEvents(pending func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pending_events",
+		Help:      "Events applied in memory and waiting to be flushed to the database.",
+	}, func() float64 {
+		return float64(pending())
+	})
+}
+
+// RegisterQueueDepth exposes the number of messages waiting for a worker.
+func RegisterQueueDepth(depth func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "message_queue_depth",
+		Help:      "Messages waiting in the worker queue.",
+	}, func() float64 {
+		return float64(depth())
+	})
+}
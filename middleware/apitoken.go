@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/services"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// AddAPITokenMiddleware authenticates requests that carry an API token and
+// stores the principal in the context, where ValidateJwtToken finds it.
+// /ws also takes the token from the access_token query parameter, since
+// browsers cannot set headers on websocket requests. Session tokens pass
+// through untouched.
+func AddAPITokenMiddleware(DB *gorm.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if credential == "" && r.URL.Path == "/ws" {
+			credential = r.URL.Query().Get("access_token")
+		}
+		if !services.IsAPIToken(credential) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := services.LookupAPIToken(DB.WithContext(r.Context()), credential)
+		if err != nil {
+			if !errors.Is(err, services.ErrInvalidAPIToken) {
+				logging.FromContext(r.Context()).Error("failed to check api token", "error", err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "error",
+				"message": "authentication failed",
+			})
+			return
+		}
+		// ExpiresAt lets keepAlive cut websocket connections the token outlives
+		principal := &config.Principal{UserID: token.UserID, TokenID: token.ID, Scope: token.Scope, DocID: token.DocID, ExpiresAt: token.ExpiresAt}
+		ctx := config.WithPrincipal(r.Context(), principal)
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("api_token_id", token.ID))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
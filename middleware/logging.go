@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"real-time-collab/logging"
+	"time"
+)
+
+// RequestIDHeader carries the correlation id of a request. An id sent by a
+// trusted proxy is reused, otherwise a new one is generated.
+const RequestIDHeader = "X-Request-ID"
+
+// AddLoggingMiddleware tags every request with a correlation id, stores a
+// logger carrying it in the request context and logs the outcome.
+func AddLoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > 64 {
+			requestID = logging.NewID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := logging.FromContext(r.Context()).With("request_id", requestID)
+		ctx := logging.WithRequestID(logging.NewContext(r.Context(), logger), requestID)
+		r = r.WithContext(ctx)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		logger.Info("request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration", time.Since(start),
+		)
+	})
+}
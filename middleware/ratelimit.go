@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"real-time-collab/config"
+	"real-time-collab/logging"
+	"real-time-collab/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTTL is how long an unused bucket is kept before it is dropped.
+const limiterIdleTTL = 10 * time.Minute
+
+// RateLimiter hands out one token bucket per client key. Requests are keyed
+// by client IP and, when they carry a valid JWT, also by user id, and must
+// get a token from every bucket they map to.
+type RateLimiter struct {
+	name       string
+	limit      rate.Limit
+	burst      int
+	trustProxy bool
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter allows perMinute requests per key with bursts of up to
+// burst requests. With trustProxy the client IP is taken from
+// X-Forwarded-For, which is only safe behind a proxy that sets it.
+func NewRateLimiter(name string, perMinute float64, burst int, trustProxy bool) *RateLimiter {
+	limiter := &RateLimiter{
+		name:       name,
+		limit:      rate.Limit(perMinute / 60),
+		burst:      burst,
+		trustProxy: trustProxy,
+		buckets:    make(map[string]*bucket),
+	}
+	go limiter.evictIdle()
+	return limiter
+}
+
+// Middleware rejects requests over budget with 429 and reports the budget
+// in X-RateLimit-* headers.
+func (limiter *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := config.ClientIP(r, limiter.trustProxy)
+		r = r.WithContext(config.WithClientIP(r.Context(), ip))
+		keys := []string{"ip:" + ip}
+		if userId := userFromRequest(r); userId != "" {
+			keys = append(keys, "user:"+userId)
+		}
+
+		allowed, remaining, retryAfter := limiter.take(keys)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !allowed {
+			logging.FromContext(r.Context()).Warn("rate limit exceeded", "limiter", limiter.name, "keys", keys)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "error",
+				"message": "rate limit exceeded, retry later",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// take consumes a token from the bucket of every key, or from none of them
+// if any bucket is empty.
+func (limiter *RateLimiter) take(keys []string) (bool, int, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	remaining := limiter.burst
+	var reservations []*rate.Reservation
+	for _, key := range keys {
+		entry, ok := limiter.buckets[key]
+		if !ok {
+			entry = &bucket{limiter: rate.NewLimiter(limiter.limit, limiter.burst)}
+			limiter.buckets[key] = entry
+		}
+		entry.lastSeen = now
+
+		reservation := entry.limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			for _, taken := range reservations {
+				taken.CancelAt(now)
+			}
+			return false, 0, delay
+		}
+		reservations = append(reservations, reservation)
+		if tokens := int(entry.limiter.TokensAt(now)); tokens < remaining {
+			remaining = tokens
+		}
+	}
+	return true, remaining, 0
+}
+
+func (limiter *RateLimiter) evictIdle() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		limiter.mutex.Lock()
+		for key, entry := range limiter.buckets {
+			if time.Since(entry.lastSeen) > limiterIdleTTL {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.mutex.Unlock()
+	}
+}
+
+// userFromRequest returns the user id of a valid bearer token, if any.
+// Invalid tokens are left for the handler to reject; they are limited by IP.
+func userFromRequest(r *http.Request) string {
+	if principal := config.PrincipalFromContext(r.Context()); principal != nil {
+		return principal.UserID
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return ""
+	}
+	claims, err := utils.ExtractClaims(token)
+	if err != nil {
+		return ""
+	}
+	userId, _ := claims["sub"].(string)
+	return userId
+}
@@ -1,8 +1,12 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"time"
 	"github.com/jinzhu/gorm"
+	gormio "gorm.io/gorm"
 )
 
 type User struct {
@@ -12,8 +16,186 @@ type User struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Email    string `json:"email" gorm:"unique"`
+	//never decoded from a request body, admins are promoted in the DB or through ADMIN_EMAILS
+	IsAdmin  bool   `json:"-" gorm:"default:false"`
+	//set by following the link of a verification email, never from a request body
+	EmailVerified bool `json:"-" gorm:"default:false"`
+	EmailVerifiedAt *time.Time `json:"-"`
+	//wrong passwords since the last successful login, reset when the account locks
+	FailedLoginAttempts int `json:"-" gorm:"default:0"`
+	LockedUntil *time.Time `json:"-"`
 }
 
+// LogValue keeps the password hash out of the logs
+func (user User) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("id", uint64(user.ID)),
+		slog.String("username", user.Username),
+	)
+}
+
+
+// ExternalIdentity links an account of an identity provider, named by its
+// issuer and subject, to a user.
+type ExternalIdentity struct{
+	gorm.Model
+	UserID uint `json:"userId" gorm:"index"`
+	Issuer string `json:"issuer" gorm:"uniqueIndex:idx_external_identity"`
+	Subject string `json:"subject" gorm:"uniqueIndex:idx_external_identity"`
+	//the email the provider gave at the last login
+	Email string `json:"email"`
+}
+
+// Scopes of an API token.
+const (
+	TokenScopeRead      = "read"
+	TokenScopeReadWrite = "read_write"
+)
+
+// APIToken lets scripts act as a user without a login. Only a hash of the
+// token is stored; Prefix is its start, kept to tell tokens apart.
+type APIToken struct{
+	gorm.Model
+	UserID string `json:"userId" gorm:"index"`
+	Name string `json:"name"`
+	Prefix string `json:"prefix"`
+	Hash string `json:"-" gorm:"uniqueIndex"`
+	Scope string `json:"scope"`
+	//when set, the token only works on this document
+	DocID string `json:"doc_id,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Roles of a workspace member. Admins manage the workspace and edit all of
+// its documents, members get the workspace's default permission and guests
+// can only view.
+const (
+	WorkspaceRoleAdmin  = "admin"
+	WorkspaceRoleMember = "member"
+	WorkspaceRoleGuest  = "guest"
+)
+
+// Permissions on a document, each including the ones before it.
+const (
+	PermissionNone = "none"
+	PermissionView = "view"
+	PermissionEdit = "edit"
+)
+
+type Workspace struct{
+	gorm.Model
+	Name string `json:"name"`
+	CreatedBy string `json:"createdBy"`
+	//what members get on the workspace's documents, view or edit
+	DefaultPermission string `json:"defaultPermission" gorm:"default:edit"`
+}
+
+type Membership struct{
+	gorm.Model
+	WorkspaceID uint `json:"workspaceId" gorm:"uniqueIndex:idx_membership"`
+	UserID string `json:"userId" gorm:"uniqueIndex:idx_membership;index"`
+	Role string `json:"role"`
+}
+
+// WorkspaceInvite is an invitation emailed to an address, accepted once by
+// the user signed in with that address.
+type WorkspaceInvite struct{
+	gorm.Model
+	WorkspaceID uint `json:"workspaceId" gorm:"index"`
+	Email string `json:"email"`
+	Role string `json:"role"`
+	InvitedBy string `json:"invitedBy"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	AcceptedBy string `json:"acceptedBy,omitempty"`
+	AcceptedAt *time.Time `json:"acceptedAt,omitempty"`
+}
+
+// Folder organises documents in a tree. Folders of a workspace hold its
+// documents, personal folders belong to OwnerID and hold documents outside
+// of workspaces.
+type Folder struct{
+	gorm.Model
+	Name string `json:"name"`
+	ParentID *uint `json:"parentId,omitempty" gorm:"index"`
+	WorkspaceID *uint `json:"workspaceId,omitempty" gorm:"index"`
+	OwnerID string `json:"ownerId,omitempty" gorm:"index"`
+	CreatedBy string `json:"createdBy"`
+	//what members get on everything below the folder, empty to inherit it
+	//from the parent and at the top from the workspace default
+	Permission string `json:"permission,omitempty"`
+}
+
+// ShareLink opens a document to whoever has the link, with or without an
+// account. Only a hash of the link's token is stored.
+type ShareLink struct{
+	gorm.Model
+	DocID string `json:"doc_id" gorm:"index"`
+	Prefix string `json:"prefix"`
+	Hash string `json:"-" gorm:"uniqueIndex"`
+	//view or edit
+	Permission string `json:"permission"`
+	//bcrypt hash of the optional password, Protected tells whether there is one
+	PasswordHash string `json:"-"`
+	Protected bool `json:"protected"`
+	CreatedBy string `json:"createdBy"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Active reports whether the link still opens its document at now.
+func (link ShareLink) Active(now time.Time) bool {
+	return link.RevokedAt == nil && (link.ExpiresAt == nil || now.Before(*link.ExpiresAt))
+}
+
+// ErrAppendOnly is returned by any attempt to change or delete an audit event.
+var ErrAppendOnly = errors.New("audit events are append-only")
+
+// AuditEvent records a security relevant action: who did what to what,
+// from where and whether it succeeded. Audit events are only ever inserted.
+type AuditEvent struct{
+	ID uint `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"createdAt" gorm:"index"`
+	Action string `json:"action" gorm:"index"`
+	//success or failure
+	Outcome string `json:"outcome"`
+	//the user who acted, empty when unknown like for a failed login
+	ActorID string `json:"actorId,omitempty" gorm:"index"`
+	TargetType string `json:"targetType,omitempty" gorm:"index:idx_audit_target"`
+	TargetID string `json:"targetId,omitempty" gorm:"index:idx_audit_target"`
+	IP string `json:"ip"`
+	UserAgent string `json:"userAgent,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	//what else the action needs to be understood, never secrets
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+// BeforeUpdate and BeforeDelete keep the audit log append-only for anything
+// going through the ORM; the table also refuses them, see AutoMigrateModels.
+func (event *AuditEvent) BeforeUpdate(tx *gormio.DB) error {
+	return ErrAppendOnly
+}
+
+func (event *AuditEvent) BeforeDelete(tx *gormio.DB) error {
+	return ErrAppendOnly
+}
+
+// Editing modes of a document. OT documents are edited through the
+// server's transform path, CRDT documents merge updates from replicas that
+// may have been offline for a long time.
+const (
+	DocumentModeOT   = "ot"
+	DocumentModeCRDT = "crdt"
+)
+
+// Types of document content. Text documents are a plain string edited with
+// insert/delete/replace events, rich-text documents are a richtext.Delta
+// edited with delta events, with Content holding their plain text.
+const (
+	DocumentTypeText     = "text"
+	DocumentTypeRichText = "richtext"
+)
 
 type Document struct{
 	gorm.Model
@@ -21,6 +203,25 @@ type Document struct{
 	Version int `json:"version"`
 	Title string `json:"title"`
 	CreatedBy string `json:"createdBy"`
+	Mode string `json:"mode" gorm:"default:ot"`
+	//encoded crdt.Doc of a CRDT document, Content is materialised from it
+	CRDTState []byte `json:"-"`
+	Type string `json:"type" gorm:"default:text"`
+	//the richtext.Delta of a rich-text document
+	RichText json.RawMessage `json:"richText,omitempty"`
+	//set on a branch: the document it was forked from and the version it
+	//shares history with it up to
+	ParentID *uint `json:"parentId,omitempty" gorm:"index"`
+	ForkVersion int `json:"forkVersion,omitempty"`
+	//the versions of the parent and of the branch the last merge left them
+	//in sync at, the base of the next three-way merge
+	MergeBase int `json:"mergeBase,omitempty"`
+	BranchBase int `json:"branchBase,omitempty"`
+	//the workspace that owns the document, documents without one are open
+	//to every user as before workspaces existed
+	WorkspaceID *uint `json:"workspaceId,omitempty" gorm:"index"`
+	//the folder the document is filed in, nil at the top
+	FolderID *uint `json:"folderId,omitempty" gorm:"index"`
 }
 
 type DocumentEvent struct{
@@ -34,7 +235,92 @@ type DocumentEvent struct{
 	Content	 string 	`json:"content"`
 	Version int 	`json:"doc_version"` 
 	Title string    `json:"title"`
+	//the richtext.Delta of a delta event on a rich-text document
+	Delta json.RawMessage `json:"delta,omitempty"`
+}
+
+// LogValue logs the shape of an event without the document text it carries
+func (event DocumentEvent) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("doc_id", event.DocID),
+		slog.String("user_id", event.UserID),
+		slog.String("operation", event.Operation),
+		slog.Int("position", event.Position),
+		slog.Int("length", event.Length),
+		slog.Int("content_length", len(event.Content)),
+		slog.Int("delta_length", len(event.Delta)),
+		slog.Int("version", event.Version),
+	)
+}
+
+// Thread is a discussion anchored to a range of a document. The range is
+// relative to AnchorVersion and is moved along with the edits made after it.
+type Thread struct{
+	gorm.Model
+	DocID string `json:"doc_id" gorm:"index"`
+	CreatedBy string `json:"createdBy"`
+	AnchorStart int `json:"start"`
+	AnchorEnd int `json:"end"`
+	AnchorVersion int `json:"doc_version"`
+	//the text the range covered when the thread was started
+	Quote string `json:"quote"`
+	Resolved bool `json:"resolved"`
+	ResolvedBy string `json:"resolvedBy,omitempty"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+	Comments []Comment `json:"comments,omitempty" gorm:"foreignKey:ThreadID"`
+}
+
+type Comment struct{
+	gorm.Model
+	ThreadID uint `json:"threadId" gorm:"index"`
+	UserID string `json:"userId"`
+	Body string `json:"body"`
 }
 
+// Statuses of a suggestion.
+const (
+	SuggestionPending  = "pending"
+	SuggestionAccepted = "accepted"
+	SuggestionRejected = "rejected"
+)
+
+// Suggestion is an edit proposed against BaseVersion of a document. It stays
+// out of the event log until an owner accepts it, at which point it is
+// transformed over the edits made since and applied like any other event.
+type Suggestion struct{
+	gorm.Model
+	DocID     string    `json:"doc_id" gorm:"index"`
+	UserID    string    `json:"user_id"`
+	Operation string    `json:"operation"`
+	Position  int       `json:"position"`
+	Length    int       `json:"length"`
+	Content   string    `json:"content"`
+	BaseVersion int     `json:"doc_version"`
+	Status    string    `json:"status" gorm:"default:pending;index"`
+	DecidedBy string    `json:"decidedBy,omitempty"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty"`
+	//the version the accepted edit produced
+	AppliedVersion int  `json:"appliedVersion,omitempty"`
+}
 
+// VersionTag gives a version of a document a name, like a checkpoint users
+// can come back to and diff against.
+type VersionTag struct{
+	gorm.Model
+	DocID string `json:"doc_id" gorm:"uniqueIndex:idx_version_tag_name"`
+	Name string `json:"name" gorm:"uniqueIndex:idx_version_tag_name"`
+	Description string `json:"description"`
+	Version int `json:"doc_version"`
+	CreatedBy string `json:"createdBy"`
+}
 
+// DocumentSnapshot is the content of a document at a version. Snapshots are
+// kept when a document is created and when a version is tagged, other
+// versions are rebuilt by replaying the event log from the nearest one.
+type DocumentSnapshot struct{
+	gorm.Model
+	DocID string `json:"doc_id" gorm:"index"`
+	Version int `json:"doc_version"`
+	Content string `json:"content"`
+	RichText json.RawMessage `json:"richText,omitempty"`
+}
@@ -0,0 +1,412 @@
+// Package richtext implements rich-text deltas in the style of Quill: a
+// delta is a list of insert, retain and delete operations, each of which may
+// carry formatting attributes.
+//
+// A document is a delta made only of inserts. Every line of a document ends
+// with a "\n" insert that carries the line's block attributes (header,
+// list, blockquote, code-block) while the other inserts carry inline ones
+// (bold, italic, link...). A change is any delta and is applied to a
+// document with Apply, which composes the two.
+//
+// Lengths and positions count Unicode code points.
+package richtext
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// Attributes are the formatting of an insert or the formatting a retain
+// changes. A nil value in a retain removes the attribute.
+type Attributes map[string]interface{}
+
+// Op is a single operation. Exactly one of Insert, Retain and Delete is set.
+type Op struct {
+	Insert     string     `json:"insert,omitempty" msgpack:"insert,omitempty"`
+	Retain     int        `json:"retain,omitempty" msgpack:"retain,omitempty"`
+	Delete     int        `json:"delete,omitempty" msgpack:"delete,omitempty"`
+	Attributes Attributes `json:"attributes,omitempty" msgpack:"attributes,omitempty"`
+}
+
+// Length is the number of code points the operation covers.
+func (op Op) Length() int {
+	switch {
+	case op.Delete > 0:
+		return op.Delete
+	case op.Retain > 0:
+		return op.Retain
+	default:
+		return utf8.RuneCountInString(op.Insert)
+	}
+}
+
+func (op Op) kind() string {
+	switch {
+	case op.Delete > 0:
+		return "delete"
+	case op.Retain > 0:
+		return "retain"
+	default:
+		return "insert"
+	}
+}
+
+// Delta is a list of operations.
+type Delta struct {
+	Ops []Op `json:"ops" msgpack:"ops"`
+}
+
+// FromText returns a document holding plain text. A document always ends
+// with a newline, one is added if text lacks it.
+func FromText(text string) Delta {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	var delta Delta
+	return delta.Insert(text, nil)
+}
+
+// Parse decodes a delta from JSON.
+func Parse(data []byte) (Delta, error) {
+	var delta Delta
+	if err := json.Unmarshal(data, &delta); err != nil {
+		return delta, fmt.Errorf("invalid delta: %w", err)
+	}
+	return delta, delta.Validate()
+}
+
+// Validate checks that every operation is exactly one of insert, retain or
+// delete.
+func (delta Delta) Validate() error {
+	for i, op := range delta.Ops {
+		set := 0
+		if op.Insert != "" {
+			set++
+		}
+		if op.Retain > 0 {
+			set++
+		}
+		if op.Delete > 0 {
+			set++
+		}
+		if set != 1 || op.Retain < 0 || op.Delete < 0 {
+			return fmt.Errorf("op %d must be exactly one of insert, retain or delete", i)
+		}
+		if op.Delete > 0 && len(op.Attributes) > 0 {
+			return fmt.Errorf("op %d: a delete has no attributes", i)
+		}
+		if !utf8.ValidString(op.Insert) {
+			return fmt.Errorf("op %d: insert is not valid UTF-8", i)
+		}
+	}
+	return nil
+}
+
+// Insert appends an insert.
+func (delta Delta) Insert(text string, attributes Attributes) Delta {
+	if text == "" {
+		return delta
+	}
+	return delta.push(Op{Insert: text, Attributes: attributes})
+}
+
+// Retain appends a retain.
+func (delta Delta) Retain(length int, attributes Attributes) Delta {
+	if length <= 0 {
+		return delta
+	}
+	return delta.push(Op{Retain: length, Attributes: attributes})
+}
+
+// Delete appends a delete.
+func (delta Delta) Delete(length int) Delta {
+	if length <= 0 {
+		return delta
+	}
+	return delta.push(Op{Delete: length})
+}
+
+// push appends op, merging it into the last operation when they are of the
+// same kind with the same attributes. An insert is kept in front of a
+// delete at the same position so equal changes have one representation.
+func (delta Delta) push(op Op) Delta {
+	if len(op.Attributes) == 0 {
+		op.Attributes = nil
+	}
+	ops := delta.Ops
+	index := len(ops)
+	if index > 0 {
+		last := &ops[index-1]
+		if op.Delete > 0 && last.Delete > 0 {
+			ops[index-1] = Op{Delete: last.Delete + op.Delete}
+			return Delta{Ops: ops}
+		}
+		if last.Delete > 0 && op.Insert != "" {
+			index--
+			if index == 0 {
+				return Delta{Ops: append([]Op{op}, ops...)}
+			}
+			last = &ops[index-1]
+		}
+		if reflect.DeepEqual(last.Attributes, op.Attributes) {
+			if last.Insert != "" && op.Insert != "" {
+				last.Insert += op.Insert
+				return Delta{Ops: ops}
+			}
+			if last.Retain > 0 && op.Retain > 0 {
+				last.Retain += op.Retain
+				return Delta{Ops: ops}
+			}
+		}
+	}
+	if index == len(ops) {
+		return Delta{Ops: append(ops, op)}
+	}
+	ops = append(ops, Op{})
+	copy(ops[index+1:], ops[index:])
+	ops[index] = op
+	return Delta{Ops: ops}
+}
+
+// chop drops a trailing retain without attributes, which changes nothing.
+func (delta Delta) chop() Delta {
+	if n := len(delta.Ops); n > 0 {
+		last := delta.Ops[n-1]
+		if last.Retain > 0 && len(last.Attributes) == 0 {
+			delta.Ops = delta.Ops[:n-1]
+		}
+	}
+	return delta
+}
+
+// Length is the total length of the operations.
+func (delta Delta) Length() int {
+	length := 0
+	for _, op := range delta.Ops {
+		length += op.Length()
+	}
+	return length
+}
+
+// BaseLength is the length of the document a change can be applied to at
+// least, the part it retains or deletes.
+func (delta Delta) BaseLength() int {
+	length := 0
+	for _, op := range delta.Ops {
+		if op.Insert == "" {
+			length += op.Length()
+		}
+	}
+	return length
+}
+
+// IsDocument reports whether the delta is made only of inserts.
+func (delta Delta) IsDocument() bool {
+	for _, op := range delta.Ops {
+		if op.Insert == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Text returns the plain text of a document.
+func (delta Delta) Text() string {
+	var builder strings.Builder
+	for _, op := range delta.Ops {
+		builder.WriteString(op.Insert)
+	}
+	return builder.String()
+}
+
+// Apply returns document with change applied. It fails when the change
+// reaches past the end of the document.
+func Apply(document Delta, change Delta) (Delta, error) {
+	if err := change.Validate(); err != nil {
+		return document, err
+	}
+	if base, length := change.BaseLength(), document.Length(); base > length {
+		return document, fmt.Errorf("change spans %d characters, the document has %d", base, length)
+	}
+	return Compose(document, change), nil
+}
+
+// Compose returns a delta with the effect of a followed by b.
+func Compose(a Delta, b Delta) Delta {
+	iterA := newIterator(a)
+	iterB := newIterator(b)
+	var result Delta
+	for iterA.hasNext() || iterB.hasNext() {
+		switch {
+		case iterB.peekKind() == "insert":
+			result = result.push(iterB.next(math.MaxInt))
+		case iterA.peekKind() == "delete":
+			result = result.push(iterA.next(math.MaxInt))
+		default:
+			length := min(iterA.peekLength(), iterB.peekLength())
+			opA := iterA.next(length)
+			opB := iterB.next(length)
+			if opB.Retain > 0 {
+				op := Op{Retain: length}
+				if opA.Retain == 0 {
+					op = Op{Insert: opA.Insert}
+				}
+				// a retain keeps nil values so it still removes the
+				// attribute where it is applied next
+				op.Attributes = composeAttributes(opA.Attributes, opB.Attributes, opA.Retain > 0)
+				result = result.push(op)
+			} else if opB.Delete > 0 && opA.Retain > 0 {
+				result = result.push(opB)
+			}
+			// a delete of something a inserted cancels out
+		}
+	}
+	return result.chop()
+}
+
+// Transform rewrites b, made concurrently with a on the same document, so
+// it applies after a. When both insert at the same position, priority puts
+// a's insert first.
+func Transform(a Delta, b Delta, priority bool) Delta {
+	iterA := newIterator(a)
+	iterB := newIterator(b)
+	var result Delta
+	for iterA.hasNext() || iterB.hasNext() {
+		switch {
+		case iterA.peekKind() == "insert" && (priority || iterB.peekKind() != "insert"):
+			result = result.Retain(iterA.next(math.MaxInt).Length(), nil)
+		case iterB.peekKind() == "insert":
+			result = result.push(iterB.next(math.MaxInt))
+		default:
+			length := min(iterA.peekLength(), iterB.peekLength())
+			opA := iterA.next(length)
+			opB := iterB.next(length)
+			switch {
+			case opA.Delete > 0:
+				// already gone, whatever b did to it
+			case opB.Delete > 0:
+				result = result.push(opB)
+			default:
+				result = result.Retain(length, transformAttributes(opA.Attributes, opB.Attributes, priority))
+			}
+		}
+	}
+	return result.chop()
+}
+
+// TransformPosition moves a position in the document over a change, e.g. a
+// cursor or a comment anchor. With priority an insert at the position ends
+// up after it.
+func (delta Delta) TransformPosition(position int, priority bool) int {
+	offset := 0
+	for _, op := range delta.Ops {
+		if offset > position {
+			break
+		}
+		length := op.Length()
+		switch {
+		case op.Delete > 0:
+			position -= min(length, position-offset)
+			continue
+		case op.Insert != "" && (offset < position || !priority):
+			position += length
+		}
+		offset += length
+	}
+	return position
+}
+
+func composeAttributes(a Attributes, b Attributes, keepNil bool) Attributes {
+	attributes := make(Attributes, len(a)+len(b))
+	for key, value := range b {
+		if value != nil || keepNil {
+			attributes[key] = value
+		}
+	}
+	for key, value := range a {
+		if _, ok := b[key]; !ok && value != nil {
+			attributes[key] = value
+		}
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+	return attributes
+}
+
+func transformAttributes(a Attributes, b Attributes, priority bool) Attributes {
+	if !priority {
+		return b
+	}
+	// a was first, so it wins the attributes both set
+	attributes := make(Attributes, len(b))
+	for key, value := range b {
+		if _, ok := a[key]; !ok {
+			attributes[key] = value
+		}
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+	return attributes
+}
+
+// iterator walks the operations of a delta, splitting them as asked.
+type iterator struct {
+	ops    []Op
+	index  int
+	offset int
+}
+
+func newIterator(delta Delta) *iterator {
+	return &iterator{ops: delta.Ops}
+}
+
+func (iter *iterator) hasNext() bool {
+	return iter.peekLength() < math.MaxInt
+}
+
+func (iter *iterator) peekLength() int {
+	if iter.index < len(iter.ops) {
+		return iter.ops[iter.index].Length() - iter.offset
+	}
+	return math.MaxInt
+}
+
+// peekKind is "retain" past the end: a delta implicitly retains the rest.
+func (iter *iterator) peekKind() string {
+	if iter.index < len(iter.ops) {
+		return iter.ops[iter.index].kind()
+	}
+	return "retain"
+}
+
+// next returns up to length of the current operation.
+func (iter *iterator) next(length int) Op {
+	if iter.index >= len(iter.ops) {
+		return Op{Retain: math.MaxInt}
+	}
+	op := iter.ops[iter.index]
+	offset := iter.offset
+	remaining := op.Length() - offset
+	if length >= remaining {
+		length = remaining
+		iter.index++
+		iter.offset = 0
+	} else {
+		iter.offset += length
+	}
+	switch {
+	case op.Delete > 0:
+		return Op{Delete: length}
+	case op.Retain > 0:
+		return Op{Retain: length, Attributes: op.Attributes}
+	default:
+		runes := []rune(op.Insert)
+		return Op{Insert: string(runes[offset : offset+length]), Attributes: op.Attributes}
+	}
+}
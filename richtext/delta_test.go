@@ -0,0 +1,145 @@
+package richtext
+
+import (
+	"reflect"
+	"testing"
+)
+
+// equal compares deltas, treating nil and empty operation lists alike.
+func equal(a Delta, b Delta) bool {
+	if len(a.Ops) == 0 && len(b.Ops) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestApply(t *testing.T) {
+	bold := Attributes{"bold": true}
+	hello := FromText("hello")
+	tests := []struct {
+		name     string
+		document Delta
+		change   Delta
+		want     Delta
+		fails    bool
+	}{
+		{"insert", hello, Delta{}.Retain(5, nil).Insert(" world", nil), FromText("hello world"), false},
+		{"delete", hello, Delta{}.Retain(1, nil).Delete(3), FromText("ho"), false},
+		{"format", hello, Delta{}.Retain(5, bold), Delta{}.Insert("hello", bold).Insert("\n", nil), false},
+		{"remove a format", Delta{}.Insert("hi", bold).Insert("\n", nil), Delta{}.Retain(2, Attributes{"bold": nil}), FromText("hi"), false},
+		{"replace", hello, Delta{}.Delete(1).Insert("j", nil), FromText("jello"), false},
+		{"past the end", hello, Delta{}.Retain(10, nil).Insert("x", nil), hello, true},
+		{"invalid op", hello, Delta{Ops: []Op{{Retain: 1, Delete: 1}}}, hello, true},
+	}
+	for _, test := range tests {
+		got, err := Apply(test.document, test.change)
+		if failed := err != nil; failed != test.fails {
+			t.Errorf("%s: error = %v, want failure %v", test.name, err, test.fails)
+			continue
+		}
+		if !equal(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got.Ops, test.want.Ops)
+		}
+	}
+}
+
+func TestCompose(t *testing.T) {
+	bold := Attributes{"bold": true}
+	tests := []struct {
+		name string
+		a, b Delta
+		want Delta
+	}{
+		{"inserts", Delta{}.Insert("ac", nil), Delta{}.Retain(1, nil).Insert("b", nil), Delta{}.Insert("abc", nil)},
+		{"delete of an insert cancels out", Delta{}.Insert("abc", nil), Delta{}.Retain(1, nil).Delete(1), Delta{}.Insert("ac", nil)},
+		{"insert after a delete", Delta{}.Delete(2), Delta{}.Insert("x", nil), Delta{}.Insert("x", nil).Delete(2)},
+		{"deletes", Delta{}.Delete(1), Delta{}.Delete(2), Delta{}.Delete(3)},
+		{"format an insert", Delta{}.Insert("ab", nil), Delta{}.Retain(1, bold), Delta{}.Insert("a", bold).Insert("b", nil)},
+		{"retains keep removals", Delta{}.Retain(3, bold), Delta{}.Retain(3, Attributes{"bold": nil}), Delta{}.Retain(3, Attributes{"bold": nil})},
+		{"retains change nothing", Delta{}.Retain(2, nil), Delta{}.Retain(3, nil), Delta{}},
+	}
+	for _, test := range tests {
+		if got := Compose(test.a, test.b); !equal(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got.Ops, test.want.Ops)
+		}
+	}
+}
+
+var transformTests = []struct {
+	name     string
+	a, b     Delta
+	priority bool
+	want     Delta
+}{
+	{"insert tie with priority", Delta{}.Insert("A", nil), Delta{}.Insert("B", nil), true, Delta{}.Retain(1, nil).Insert("B", nil)},
+	{"insert tie without priority", Delta{}.Insert("A", nil), Delta{}.Insert("B", nil), false, Delta{}.Insert("B", nil)},
+	{"insert before an insert", Delta{}.Retain(2, nil).Insert("X", nil), Delta{}.Retain(3, nil).Insert("Y", nil), false, Delta{}.Retain(4, nil).Insert("Y", nil)},
+	{"delete after an insert", Delta{}.Insert("X", nil), Delta{}.Delete(1), true, Delta{}.Retain(1, nil).Delete(1)},
+	{"overlapping deletes", Delta{}.Retain(1, nil).Delete(3), Delta{}.Retain(2, nil).Delete(3), true, Delta{}.Retain(1, nil).Delete(1)},
+	{"same delete", Delta{}.Delete(2), Delta{}.Delete(2), false, Delta{}},
+	{"attribute conflict with priority", Delta{}.Retain(2, Attributes{"bold": true}), Delta{}.Retain(2, Attributes{"bold": false, "italic": true}), true, Delta{}.Retain(2, Attributes{"italic": true})},
+	{"attribute conflict without priority", Delta{}.Retain(2, Attributes{"bold": true}), Delta{}.Retain(2, Attributes{"bold": false, "italic": true}), false, Delta{}.Retain(2, Attributes{"bold": false, "italic": true})},
+	{"format a deleted range", Delta{}.Delete(2), Delta{}.Retain(3, Attributes{"bold": true}), true, Delta{}.Retain(1, Attributes{"bold": true})},
+}
+
+func TestTransform(t *testing.T) {
+	for _, test := range transformTests {
+		if got := Transform(test.a, test.b, test.priority); !equal(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got.Ops, test.want.Ops)
+		}
+	}
+}
+
+// TestTransformConverges checks both sides of a concurrent edit end up with
+// the same document, the side that went first holding priority.
+func TestTransformConverges(t *testing.T) {
+	document := FromText("abcdef")
+	for _, test := range transformTests {
+		first, err := Apply(document, test.a)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		left, err := Apply(first, Transform(test.a, test.b, true))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		second, err := Apply(document, test.b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		right, err := Apply(second, Transform(test.b, test.a, false))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !equal(left, right) {
+			t.Errorf("%s: %+v and %+v diverged", test.name, left.Ops, right.Ops)
+		}
+	}
+}
+
+func TestTransformPosition(t *testing.T) {
+	insert := Delta{}.Retain(2, nil).Insert("xy", nil)
+	remove := Delta{}.Retain(1, nil).Delete(3)
+	tests := []struct {
+		name     string
+		change   Delta
+		position int
+		priority bool
+		want     int
+	}{
+		{"before an insert", insert, 1, false, 1},
+		{"at an insert", insert, 2, false, 4},
+		{"at an insert with priority", insert, 2, true, 2},
+		{"after an insert", insert, 3, false, 5},
+		{"insert at the start", Delta{}.Insert("ab", nil), 0, false, 2},
+		{"insert at the start with priority", Delta{}.Insert("ab", nil), 0, true, 0},
+		{"before a delete", remove, 0, false, 0},
+		{"inside a delete", remove, 2, false, 1},
+		{"after a delete", remove, 5, false, 2},
+	}
+	for _, test := range tests {
+		if got := test.change.TransformPosition(test.position, test.priority); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package richtext
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+)
+
+// segment is a run of text with its inline attributes.
+type segment struct {
+	text       string
+	attributes Attributes
+}
+
+// line is a line of a document with the block attributes of its newline.
+type line struct {
+	segments   []segment
+	attributes Attributes
+}
+
+// lines splits a document into its lines. Text after the last newline is
+// treated as a line of its own.
+func lines(document Delta) []line {
+	var result []line
+	var current line
+	for _, op := range document.Ops {
+		text := op.Insert
+		for text != "" {
+			index := strings.IndexByte(text, '\n')
+			if index < 0 {
+				current.segments = append(current.segments, segment{text: text, attributes: op.Attributes})
+				break
+			}
+			if index > 0 {
+				current.segments = append(current.segments, segment{text: text[:index], attributes: op.Attributes})
+			}
+			current.attributes = op.Attributes
+			result = append(result, current)
+			current = line{}
+			text = text[index+1:]
+		}
+	}
+	if len(current.segments) > 0 {
+		result = append(result, current)
+	}
+	return result
+}
+
+func listType(attributes Attributes) string {
+	list, _ := attributes["list"].(string)
+	return list
+}
+
+func headerLevel(attributes Attributes) int {
+	// decoded from JSON the level is a float64
+	switch level := attributes["header"].(type) {
+	case float64:
+		if level >= 1 && level <= 6 {
+			return int(level)
+		}
+	case int:
+		if level >= 1 && level <= 6 {
+			return level
+		}
+	}
+	return 0
+}
+
+func isSet(attributes Attributes, key string) bool {
+	value, ok := attributes[key]
+	if !ok || value == nil {
+		return false
+	}
+	if set, isBool := value.(bool); isBool {
+		return set
+	}
+	return true
+}
+
+// safeLink returns the link of a segment if it is one a reader may follow,
+// so a document cannot smuggle javascript: URLs into rendered HTML.
+func safeLink(attributes Attributes) string {
+	link, _ := attributes["link"].(string)
+	if link == "" {
+		return ""
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https", "mailto":
+		return link
+	}
+	return ""
+}
+
+// HTML renders a document as an HTML fragment.
+func HTML(document Delta) string {
+	var builder strings.Builder
+	openList := ""
+	closeList := func() {
+		if openList != "" {
+			fmt.Fprintf(&builder, "</%s>", openList)
+			openList = ""
+		}
+	}
+	all := lines(document)
+	for i := 0; i < len(all); i++ {
+		current := all[i]
+		if list := listType(current.attributes); list != "" {
+			tag := "ul"
+			if list == "ordered" {
+				tag = "ol"
+			}
+			if openList != tag {
+				closeList()
+				fmt.Fprintf(&builder, "<%s>", tag)
+				openList = tag
+			}
+			switch list {
+			case "checked":
+				builder.WriteString(`<li data-checked="true">`)
+			case "unchecked":
+				builder.WriteString(`<li data-checked="false">`)
+			default:
+				builder.WriteString("<li>")
+			}
+			writeInlineHTML(&builder, current.segments)
+			builder.WriteString("</li>")
+			continue
+		}
+		closeList()
+
+		switch {
+		case isSet(current.attributes, "code-block"):
+			// consecutive code lines form one block
+			builder.WriteString("<pre>")
+			for {
+				for _, segment := range all[i].segments {
+					builder.WriteString(html.EscapeString(segment.text))
+				}
+				if i+1 >= len(all) || !isSet(all[i+1].attributes, "code-block") {
+					break
+				}
+				builder.WriteString("\n")
+				i++
+			}
+			builder.WriteString("</pre>")
+		case headerLevel(current.attributes) > 0:
+			level := headerLevel(current.attributes)
+			fmt.Fprintf(&builder, "<h%d>", level)
+			writeInlineHTML(&builder, current.segments)
+			fmt.Fprintf(&builder, "</h%d>", level)
+		case isSet(current.attributes, "blockquote"):
+			builder.WriteString("<blockquote>")
+			writeInlineHTML(&builder, current.segments)
+			builder.WriteString("</blockquote>")
+		default:
+			builder.WriteString("<p>")
+			if len(current.segments) == 0 {
+				builder.WriteString("<br>")
+			}
+			writeInlineHTML(&builder, current.segments)
+			builder.WriteString("</p>")
+		}
+	}
+	closeList()
+	return builder.String()
+}
+
+func writeInlineHTML(builder *strings.Builder, segments []segment) {
+	for _, segment := range segments {
+		text := html.EscapeString(segment.text)
+		attributes := segment.attributes
+		if isSet(attributes, "code") {
+			text = "<code>" + text + "</code>"
+		}
+		if isSet(attributes, "bold") {
+			text = "<strong>" + text + "</strong>"
+		}
+		if isSet(attributes, "italic") {
+			text = "<em>" + text + "</em>"
+		}
+		if isSet(attributes, "underline") {
+			text = "<u>" + text + "</u>"
+		}
+		if isSet(attributes, "strike") {
+			text = "<s>" + text + "</s>"
+		}
+		if link := safeLink(attributes); link != "" {
+			text = `<a href="` + html.EscapeString(link) + `">` + text + "</a>"
+		}
+		builder.WriteString(text)
+	}
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`,
+)
+
+// Markdown renders a document as CommonMark. Underline has no Markdown
+// equivalent and is dropped.
+func Markdown(document Delta) string {
+	var builder strings.Builder
+	ordered := 0
+	all := lines(document)
+	for i := 0; i < len(all); i++ {
+		current := all[i]
+		list := listType(current.attributes)
+		if list == "ordered" {
+			ordered++
+		} else {
+			ordered = 0
+		}
+
+		switch {
+		case isSet(current.attributes, "code-block"):
+			builder.WriteString("```\n")
+			for {
+				for _, segment := range all[i].segments {
+					builder.WriteString(segment.text)
+				}
+				builder.WriteString("\n")
+				if i+1 >= len(all) || !isSet(all[i+1].attributes, "code-block") {
+					break
+				}
+				i++
+			}
+			builder.WriteString("```\n")
+			continue
+		case headerLevel(current.attributes) > 0:
+			builder.WriteString(strings.Repeat("#", headerLevel(current.attributes)) + " ")
+		case list == "ordered":
+			fmt.Fprintf(&builder, "%d. ", ordered)
+		case list == "checked":
+			builder.WriteString("- [x] ")
+		case list == "unchecked":
+			builder.WriteString("- [ ] ")
+		case list != "":
+			builder.WriteString("- ")
+		case isSet(current.attributes, "blockquote"):
+			builder.WriteString("> ")
+		}
+		writeInlineMarkdown(&builder, current.segments)
+		builder.WriteString("\n")
+		// blocks are separated by a blank line, the items of a list are not
+		next := i + 1
+		if next < len(all) && (list == "" || listType(all[next].attributes) == "") {
+			builder.WriteString("\n")
+		}
+	}
+	return builder.String()
+}
+
+func writeInlineMarkdown(builder *strings.Builder, segments []segment) {
+	for _, segment := range segments {
+		attributes := segment.attributes
+		var text string
+		if isSet(attributes, "code") {
+			text = "`" + strings.ReplaceAll(segment.text, "`", "") + "`"
+		} else {
+			text = markdownEscaper.Replace(segment.text)
+		}
+		if isSet(attributes, "bold") {
+			text = "**" + text + "**"
+		}
+		if isSet(attributes, "italic") {
+			text = "_" + text + "_"
+		}
+		if isSet(attributes, "strike") {
+			text = "~~" + text + "~~"
+		}
+		if link := safeLink(attributes); link != "" {
+			text = "[" + text + "](<" + strings.ReplaceAll(link, ">", "%3E") + ">)"
+		}
+		builder.WriteString(text)
+	}
+}
@@ -4,32 +4,269 @@ import (
 	"net/http"
 	"real-time-collab/config"
 	"real-time-collab/controller"
+	"real-time-collab/mailer"
+	"real-time-collab/middleware"
+	"real-time-collab/services"
+	"real-time-collab/sso"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gorm.io/gorm"
 )
 
-func SetRoutesForMux(mux *http.ServeMux, DB *gorm.DB,pool *config.ConnectionPool){
-
-	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
-        controller.RegisterUser(w, r, DB)
-    })
-	mux.HandleFunc("/login",func(w http.ResponseWriter, r *http.Request) {
-		controller.LoginUser(w,r,DB)
+// documentRoute marks a route as acting on the document docID names, which
+// API tokens limited to one document are checked against. Routes passing
+// nil act on the document of the thread, suggestion, branch or share link
+// they load, which the handler checks. Tokens limited to one document are
+// refused on every other route.
+func documentRoute(docID func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := ""
+		if docID != nil {
+			id = docID(r)
+		}
+		next.ServeHTTP(w, r.WithContext(config.WithDocumentRoute(r.Context(), id)))
 	})
-	mux.HandleFunc("/ws",func(w http.ResponseWriter, r *http.Request) {
+}
+
+func pathDocID(r *http.Request) string {
+	return r.PathValue("id")
+}
+
+func queryDocID(r *http.Request) string {
+	return r.URL.Query().Get("doc_id")
+}
+
+// Handlers get DB bound to the request context so their queries are
+// traced as part of the request span.
+func SetRoutesForMux(mux *http.ServeMux, DB *gorm.DB,pool *config.ConnectionPool,mail mailer.Mailer){
+
+	limits := config.LoadRateLimitSettings()
+	// login and register get their own, much smaller budget against password guessing
+	authLimiter := middleware.NewRateLimiter("auth", limits.AuthPerMinute, limits.AuthBurst, limits.TrustProxy)
+	apiLimiter := middleware.NewRateLimiter("api", limits.APIPerMinute, limits.APIBurst, limits.TrustProxy)
+
+	accounts := config.LoadAccountSettings()
+	passwords := services.NewPasswordPolicy(accounts.MinPasswordLength, accounts.PasswordBlocklist)
+
+	mux.Handle("/register", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        controller.RegisterUser(w, r, DB.WithContext(r.Context()), mail, accounts, passwords)
+    })))
+	mux.Handle("/login", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.LoginUser(w,r,DB.WithContext(r.Context()),accounts)
+	})))
+	// the account recovery endpoints share the auth budget, they mail
+	// strangers and take tokens that could be guessed at
+	mux.Handle("POST /verify-email/request", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.RequestEmailVerification(w,r,DB.WithContext(r.Context()),mail,accounts)
+	})))
+	mux.Handle("/verify-email", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.VerifyEmail(w,r,DB.WithContext(r.Context()))
+	})))
+	mux.Handle("POST /password-reset/request", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.RequestPasswordReset(w,r,DB.WithContext(r.Context()),mail,accounts)
+	})))
+	mux.Handle("POST /password-reset", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.ResetPassword(w,r,DB.WithContext(r.Context()),passwords)
+	})))
+	mux.Handle("POST /password", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.ChangePassword(w,r,DB.WithContext(r.Context()),accounts,passwords)
+	})))
+	// single sign-on through an OIDC identity provider, off unless OIDC_ISSUER is set
+	oidcClient := sso.NewClient(sso.LoadSettings())
+	mux.Handle("GET /auth/oidc/login", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.OIDCLogin(w,r,oidcClient)
+	})))
+	mux.Handle("GET /auth/oidc/callback", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.OIDCCallback(w,r,DB.WithContext(r.Context()),oidcClient)
+	})))
+	mux.Handle("/ws", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		controller.HandleWebSocketConnection(w,r,pool,DB)
-	})
+	})))
 
-	mux.HandleFunc("/documents/create",func(w http.ResponseWriter, r *http.Request) {
-		controller.StoreDocument(w,r,DB)
-	})
+	mux.Handle("/documents/create", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.StoreDocument(w,r,DB.WithContext(r.Context()))
+	})))
 
-	mux.HandleFunc("/documents/get/{id}",func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/documents/get/{id}", apiLimiter.Middleware(documentRoute(pathDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		DocId := r.PathValue("id")
-		controller.GetDocumentById(w,r,DB,DocId)
-	})
+		controller.GetDocumentById(w,r,DB.WithContext(r.Context()),pool,DocId)
+	}))))
+
+	mux.Handle("/documents/render/{id}", apiLimiter.Middleware(documentRoute(pathDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.RenderDocument(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"))
+	}))))
+
+	mux.Handle("GET /threads", apiLimiter.Middleware(documentRoute(queryDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetThreads(w,r,DB.WithContext(r.Context()),pool)
+	}))))
+
+	mux.Handle("POST /threads", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.CreateThread(w,r,DB.WithContext(r.Context()),pool)
+	}))))
+
+	mux.Handle("POST /threads/{id}/comments", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.ReplyToThread(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"))
+	}))))
+
+	mux.Handle("POST /threads/{id}/resolve", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.SetThreadResolved(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"),true)
+	}))))
+
+	mux.Handle("POST /threads/{id}/reopen", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.SetThreadResolved(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"),false)
+	}))))
+
+	mux.Handle("GET /suggestions", apiLimiter.Middleware(documentRoute(queryDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetSuggestions(w,r,DB.WithContext(r.Context()),pool)
+	}))))
+
+	mux.Handle("POST /suggestions/{id}/accept", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.DecideSuggestion(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"),true)
+	}))))
+
+	mux.Handle("POST /suggestions/{id}/reject", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.DecideSuggestion(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"),false)
+	}))))
+
+	mux.Handle("GET /tags", apiLimiter.Middleware(documentRoute(queryDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetTags(w,r,DB.WithContext(r.Context()),pool)
+	}))))
+
+	mux.Handle("POST /tags", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.CreateTag(w,r,DB.WithContext(r.Context()),pool)
+	}))))
+
+	mux.Handle("GET /diff", apiLimiter.Middleware(documentRoute(queryDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetDiff(w,r,DB.WithContext(r.Context()),pool)
+	}))))
+
+	mux.Handle("GET /branches", apiLimiter.Middleware(documentRoute(queryDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetBranches(w,r,DB.WithContext(r.Context()),pool)
+	}))))
+
+	mux.Handle("POST /branches", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.CreateBranch(w,r,DB.WithContext(r.Context()),pool)
+	}))))
+
+	mux.Handle("POST /branches/{id}/merge", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.MergeBranch(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"))
+	}))))
+
+	mux.Handle("GET /tokens", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetAPITokens(w,r,DB.WithContext(r.Context()))
+	})))
+
+	mux.Handle("POST /tokens", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.CreateAPIToken(w,r,DB.WithContext(r.Context()))
+	})))
 
-	mux.HandleFunc("/documents",func(w http.ResponseWriter, r *http.Request){
-		controller.GetDocuments(w,r,DB)
+	mux.Handle("DELETE /tokens/{id}", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.RevokeAPIToken(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"))
+	})))
+
+	mux.Handle("GET /workspaces", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetWorkspaces(w,r,DB.WithContext(r.Context()))
+	})))
+
+	mux.Handle("POST /workspaces", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.CreateWorkspace(w,r,DB.WithContext(r.Context()))
+	})))
+
+	mux.Handle("PATCH /workspaces/{id}", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.UpdateWorkspace(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	})))
+
+	mux.Handle("GET /workspaces/{id}/members", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetMembers(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	})))
+
+	mux.Handle("PUT /workspaces/{id}/members/{user}", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.UpdateMember(w,r,DB.WithContext(r.Context()),r.PathValue("id"),r.PathValue("user"))
+	})))
+
+	mux.Handle("DELETE /workspaces/{id}/members/{user}", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.RemoveMember(w,r,DB.WithContext(r.Context()),r.PathValue("id"),r.PathValue("user"))
+	})))
+
+	mux.Handle("GET /workspaces/{id}/invites", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetInvites(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	})))
+
+	mux.Handle("POST /workspaces/{id}/invites", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.InviteMember(w,r,DB.WithContext(r.Context()),mail,accounts,r.PathValue("id"))
+	})))
+
+	mux.Handle("DELETE /workspaces/{id}/invites/{invite}", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.RevokeInvite(w,r,DB.WithContext(r.Context()),r.PathValue("id"),r.PathValue("invite"))
+	})))
+
+	mux.Handle("POST /invites/accept", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.AcceptInvite(w,r,DB.WithContext(r.Context()))
+	})))
+
+	mux.Handle("GET /folders", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetFolders(w,r,DB.WithContext(r.Context()))
+	})))
+
+	mux.Handle("POST /folders", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.CreateFolder(w,r,DB.WithContext(r.Context()))
+	})))
+
+	mux.Handle("GET /folders/{id}/children", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetFolderChildren(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	})))
+
+	mux.Handle("PATCH /folders/{id}", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.UpdateFolder(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	})))
+
+	mux.Handle("DELETE /folders/{id}", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.DeleteFolder(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	})))
+
+	mux.Handle("PUT /documents/move/{id}", apiLimiter.Middleware(documentRoute(pathDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.MoveDocument(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"))
+	}))))
+
+	mux.Handle("GET /documents/share/{id}", apiLimiter.Middleware(documentRoute(pathDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetShareLinks(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	}))))
+
+	mux.Handle("POST /documents/share/{id}", apiLimiter.Middleware(documentRoute(pathDocID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.CreateShareLink(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	}))))
+
+	// share link passwords are guessable, so tickets take the auth budget
+	mux.Handle("POST /documents/share/{id}/ticket", authLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.CreateShareTicket(w,r,DB.WithContext(r.Context()),r.PathValue("id"))
+	})))
+
+	mux.Handle("DELETE /shares/{id}", apiLimiter.Middleware(documentRoute(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.RevokeShareLink(w,r,DB.WithContext(r.Context()),pool,r.PathValue("id"))
+	}))))
+
+	mux.Handle("/documents", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		controller.GetDocuments(w,r,DB.WithContext(r.Context()),pool)
+	})))
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", controller.Healthz)
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		controller.Readyz(w,r,DB,pool)
 	})
 
-}
\ No newline at end of file
+	mux.Handle("GET /admin/pool", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetPoolStats(w,r,DB.WithContext(r.Context()),pool)
+	})))
+
+	mux.Handle("GET /admin/audit", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.GetAuditEvents(w,r,DB.WithContext(r.Context()))
+	})))
+
+	mux.Handle("GET /admin/audit/export", apiLimiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller.ExportAuditEvents(w,r,DB.WithContext(r.Context()))
+	})))
+
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"real-time-collab/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APITokenPrefix starts every API token, telling them apart from session
+// tokens and making leaked ones easy to scan for.
+const APITokenPrefix = "rtc_"
+
+// lastUsedResolution limits how often a busy token's last use is written.
+const lastUsedResolution = time.Minute
+
+// ErrInvalidAPIToken is returned for unknown, expired or revoked tokens.
+var ErrInvalidAPIToken = errors.New("invalid api token")
+
+// IsAPIToken reports whether a bearer credential is an API token.
+func IsAPIToken(credential string) bool {
+	return strings.HasPrefix(credential, APITokenPrefix)
+}
+
+// HashAPIToken is how a token is stored. Tokens carry 256 random bits, so
+// a plain SHA-256 is enough and lets them be looked up by hash.
+func HashAPIToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIToken generates a token for a user. The raw token is returned once
+// and never stored.
+func NewAPIToken(userID string, name string, scope string, docID string, expiresAt *time.Time) (models.APIToken, string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return models.APIToken{}, "", err
+	}
+	raw := APITokenPrefix + base64.RawURLEncoding.EncodeToString(buffer)
+	token := models.APIToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    raw[:len(APITokenPrefix)+6],
+		Hash:      HashAPIToken(raw),
+		Scope:     scope,
+		DocID:     docID,
+		ExpiresAt: expiresAt,
+	}
+	return token, raw, nil
+}
+
+// LookupAPIToken returns the live token matching raw and records its use.
+func LookupAPIToken(DB *gorm.DB, raw string) (models.APIToken, error) {
+	var token models.APIToken
+	err := DB.Where("hash = ?", HashAPIToken(raw)).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return token, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return token, fmt.Errorf("failed to fetch api token: %w", err)
+	}
+	now := time.Now()
+	if token.RevokedAt != nil || (token.ExpiresAt != nil && now.After(*token.ExpiresAt)) {
+		return token, ErrInvalidAPIToken
+	}
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > lastUsedResolution {
+		DB.Model(&models.APIToken{}).Where("id = ?", token.ID).Update("last_used_at", now)
+		token.LastUsedAt = &now
+	}
+	return token, nil
+}
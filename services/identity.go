@@ -0,0 +1,137 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"real-time-collab/models"
+	"real-time-collab/sso"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrIdentityRefused is returned when a provider login cannot be linked
+	// to an account: no email, an unverified email matching an existing
+	// account, or an unknown user while provisioning is off.
+	ErrIdentityRefused = errors.New("sign-in through the identity provider was refused")
+)
+
+// FindOrProvisionUser returns the user an identity provider login belongs
+// to. Identities already linked sign in directly; otherwise the login is
+// linked to the account with the same email, which the provider must have
+// verified so nobody can claim an account through a provider that lets
+// them pick any address, or a new account is created when autoProvision
+// is set.
+func FindOrProvisionUser(DB *gorm.DB, claims sso.Claims, autoProvision bool) (models.User, error) {
+	var user models.User
+	var identity models.ExternalIdentity
+	err := DB.Where("issuer = ? and subject = ?", claims.Issuer, claims.Subject).First(&identity).Error
+	if err == nil {
+		if err := DB.First(&user, "id = ?", identity.UserID).Error; err != nil {
+			return user, fmt.Errorf("failed to fetch linked user: %w", err)
+		}
+		if claims.Email != "" && claims.Email != identity.Email {
+			DB.Model(&identity).Update("email", claims.Email)
+		}
+		if user.Password == "" {
+			// accounts provisioned before unusable passwords existed
+			password, err := unusablePassword()
+			if err != nil {
+				return user, err
+			}
+			if err := DB.Model(&user).Where("password = ?", "").Update("password", password).Error; err != nil {
+				return user, fmt.Errorf("failed to update user: %w", err)
+			}
+			user.Password = password
+		}
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, fmt.Errorf("failed to fetch identity: %w", err)
+	}
+	if claims.Email == "" {
+		return user, fmt.Errorf("%w: the provider did not share an email", ErrIdentityRefused)
+	}
+
+	exists, err := FindUserByEmailId(&user, DB, claims.Email)
+	if err != nil {
+		return user, err
+	}
+	if exists && !claims.EmailVerified {
+		return user, fmt.Errorf("%w: the provider has not verified %s", ErrIdentityRefused, claims.Email)
+	}
+	if !exists && !autoProvision {
+		return user, fmt.Errorf("%w: no account for %s", ErrIdentityRefused, claims.Email)
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if !exists {
+			password, err := unusablePassword()
+			if err != nil {
+				return err
+			}
+			// the account signs in through the provider until its owner
+			// sets a password with a reset email
+			user = models.User{
+				Username:      provisionedUsername(claims),
+				Email:         claims.Email,
+				Password:      password,
+				EmailVerified: claims.EmailVerified,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return fmt.Errorf("failed to create user: %w", err)
+			}
+		} else if !user.EmailVerified {
+			// whoever signed up with the address never proved they own it,
+			// so the password they chose is dropped along with the claim
+			password, err := unusablePassword()
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			if err := tx.Model(&user).Updates(map[string]interface{}{"email_verified": true, "email_verified_at": now, "password": password}).Error; err != nil {
+				return fmt.Errorf("failed to update user: %w", err)
+			}
+			user.Password = password
+			user.EmailVerified = true
+			user.EmailVerifiedAt = &now
+		}
+		identity = models.ExternalIdentity{UserID: user.ID, Issuer: claims.Issuer, Subject: claims.Subject, Email: claims.Email}
+		if err := tx.Create(&identity).Error; err != nil {
+			return fmt.Errorf("failed to link identity: %w", err)
+		}
+		return nil
+	})
+	return user, err
+}
+
+// unusablePassword hashes a random secret nobody knows. Unlike an empty
+// password it gives every account a different, unguessable reset
+// fingerprint.
+func unusablePassword() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword(secret, bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+func provisionedUsername(claims sso.Claims) string {
+	switch {
+	case claims.PreferredUsername != "":
+		return claims.PreferredUsername
+	case claims.Name != "":
+		return claims.Name
+	default:
+		name, _, _ := strings.Cut(claims.Email, "@")
+		return name
+	}
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"real-time-collab/models"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// DummyPasswordCheck spends as long as checking a real password, so a login
+// for an unknown or locked account takes as long as any other.
+func DummyPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// IsLocked reports whether an account is locked out after too many wrong
+// passwords.
+func IsLocked(user *models.User) bool {
+	return user.LockedUntil != nil && time.Now().Before(*user.LockedUntil)
+}
+
+// RecordFailedLogin counts a wrong password and locks the account for
+// lockout once maxFailures are reached in a row. The counter is increased
+// in the database so concurrent guesses all count.
+func RecordFailedLogin(DB *gorm.DB, user *models.User, maxFailures int, lockout time.Duration) error {
+	err := DB.Model(&models.User{}).Where("id = ?", user.ID).
+		Update("failed_login_attempts", gorm.Expr("failed_login_attempts + 1")).Error
+	if err != nil {
+		return err
+	}
+	var attempts int
+	if err := DB.Model(&models.User{}).Select("failed_login_attempts").Where("id = ?", user.ID).Scan(&attempts).Error; err != nil {
+		return err
+	}
+	user.FailedLoginAttempts = attempts
+	if attempts < maxFailures {
+		return nil
+	}
+	lockedUntil := time.Now().Add(lockout)
+	user.LockedUntil = &lockedUntil
+	user.FailedLoginAttempts = 0
+	return DB.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"failed_login_attempts": 0,
+		"locked_until":          lockedUntil,
+	}).Error
+}
+
+// ResetFailedLogins clears the count after a successful login.
+func ResetFailedLogins(DB *gorm.DB, user *models.User) error {
+	if user.FailedLoginAttempts == 0 && user.LockedUntil == nil {
+		return nil
+	}
+	user.FailedLoginAttempts = 0
+	user.LockedUntil = nil
+	return DB.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"failed_login_attempts": 0,
+		"locked_until":          nil,
+	}).Error
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxPasswordLength is the most bcrypt hashes; longer passwords would be
+// silently truncated.
+const MaxPasswordLength = 72
+
+// ErrWeakPassword is returned for passwords the policy refuses.
+var ErrWeakPassword = errors.New("password does not meet the policy")
+
+// commonPasswords are refused even without a blocklist file.
+var commonPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "123456", "1234567",
+	"12345678", "123456789", "1234567890", "12345678910", "qwerty", "qwerty123",
+	"qwertyuiop", "1q2w3e4r5t", "111111", "000000", "abc123", "iloveyou",
+	"letmein", "welcome", "welcome1", "admin", "admin123", "monkey", "dragon",
+	"football", "baseball", "sunshine", "princess", "trustno1", "changeme",
+}
+
+// PasswordPolicy decides which passwords are acceptable.
+type PasswordPolicy struct {
+	MinLength int
+	// breached holds upper-case hex SHA-1 hashes of refused passwords
+	breached map[string]struct{}
+}
+
+// NewPasswordPolicy builds a policy, loading the blocklist file when one
+// is given. A file that cannot be read is logged and skipped so a bad path
+// does not keep the server from starting.
+func NewPasswordPolicy(minLength int, blocklist string) *PasswordPolicy {
+	policy := &PasswordPolicy{MinLength: minLength, breached: make(map[string]struct{})}
+	for _, password := range commonPasswords {
+		policy.breached[hashPassword(password)] = struct{}{}
+	}
+	if blocklist != "" {
+		if err := policy.load(blocklist); err != nil {
+			slog.Error("failed to load password blocklist", "file", blocklist, "error", err)
+		}
+	}
+	return policy
+}
+
+func hashPassword(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// load reads one password per line, as plain text or as a SHA-1 hash with
+// an optional ":count" suffix.
+func (policy *PasswordPolicy) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		hash, _, _ := strings.Cut(line, ":")
+		if _, err := hex.DecodeString(hash); err == nil && len(hash) == 2*sha1.Size {
+			policy.breached[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		policy.breached[hashPassword(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// Check returns an error wrapping ErrWeakPassword that says what is wrong
+// with a password, also refusing ones that repeat the email or username.
+func (policy *PasswordPolicy) Check(password string, email string, username string) error {
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return fmt.Errorf("%w: use at least %d characters", ErrWeakPassword, policy.MinLength)
+	}
+	if len(password) > MaxPasswordLength {
+		return fmt.Errorf("%w: use at most %d bytes", ErrWeakPassword, MaxPasswordLength)
+	}
+	lower := strings.ToLower(password)
+	if (email != "" && lower == strings.ToLower(email)) || (username != "" && lower == strings.ToLower(username)) {
+		return fmt.Errorf("%w: it must not be your email or username", ErrWeakPassword)
+	}
+	if _, ok := policy.breached[hashPassword(password)]; ok {
+		return fmt.Errorf("%w: it appears in a list of breached or common passwords", ErrWeakPassword)
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package services
 
 import (
+	"os"
 	"real-time-collab/models"
+	"strings"
 	"gorm.io/gorm"
 )
 
@@ -31,4 +33,37 @@ func FindUserByEmailId(user *models.User, DB *gorm.DB, email string) (bool,error
     }
     
     return true, nil
-}
\ No newline at end of file
+}
+
+func FindUserById(user *models.User, DB *gorm.DB, userId string) (bool,error){
+	result := DB.Where("id = ?", userId).First(user)
+
+    if result.Error == gorm.ErrRecordNotFound {
+        return false, nil
+    }
+
+    if result.Error != nil {
+        return false, result.Error
+    }
+
+    return true, nil
+}
+
+// IsAdmin reports whether the user may use the admin endpoints, either
+// through the is_admin column or by being listed in ADMIN_EMAILS. An
+// address in ADMIN_EMAILS only counts once it has been verified, so signing
+// up with it is not enough.
+func IsAdmin(user *models.User) bool {
+	if user.IsAdmin {
+		return true
+	}
+	if !user.EmailVerified {
+		return false
+	}
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" && strings.EqualFold(email, user.Email) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"real-time-collab/models"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ShareLinkPrefix starts the token of every share link.
+const ShareLinkPrefix = "rtcs_"
+
+var (
+	// ErrInvalidShareLink is returned for unknown, expired or revoked links.
+	ErrInvalidShareLink = errors.New("invalid or expired share link")
+	ErrSharePassword    = errors.New("wrong share link password")
+)
+
+// NewShareLink generates a link to a document. The raw token is returned
+// once and never stored; neither is the password.
+func NewShareLink(docID string, createdBy string, permission string, password string, expiresAt *time.Time) (models.ShareLink, string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return models.ShareLink{}, "", err
+	}
+	raw := ShareLinkPrefix + base64.RawURLEncoding.EncodeToString(buffer)
+	// hashed like API tokens, the token carries as much randomness
+	link := models.ShareLink{
+		DocID:      docID,
+		Prefix:     raw[:len(ShareLinkPrefix)+6],
+		Hash:       HashAPIToken(raw),
+		Permission: permission,
+		CreatedBy:  createdBy,
+		ExpiresAt:  expiresAt,
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return models.ShareLink{}, "", err
+		}
+		link.PasswordHash = string(hash)
+		link.Protected = true
+	}
+	return link, raw, nil
+}
+
+// LookupShareLink returns the active link whose token is raw.
+func LookupShareLink(DB *gorm.DB, raw string) (models.ShareLink, error) {
+	var link models.ShareLink
+	err := DB.Where("hash = ?", HashAPIToken(raw)).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return link, ErrInvalidShareLink
+	}
+	if err != nil {
+		return link, fmt.Errorf("failed to fetch share link: %w", err)
+	}
+	if !link.Active(time.Now()) {
+		return link, ErrInvalidShareLink
+	}
+	return link, nil
+}
+
+// CheckSharePassword checks the password given for a link, if it has one.
+func CheckSharePassword(link models.ShareLink, password string) error {
+	if !link.Protected {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+		return ErrSharePassword
+	}
+	return nil
+}
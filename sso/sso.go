@@ -0,0 +1,175 @@
+// Package sso signs users in through an OpenID Connect identity provider
+// with the authorization code flow and PKCE.
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ErrDisabled is returned when no identity provider is configured.
+var ErrDisabled = errors.New("single sign-on is not configured")
+
+// Settings configure the identity provider, from OIDC_* variables.
+type Settings struct {
+	// Issuer is the provider's issuer URL, SSO is off when it is empty.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is this server's /auth/oidc/callback as the provider
+	// reaches the browser back.
+	RedirectURL string
+	Scopes      []string
+	// AutoProvision creates accounts for unknown users on their first login.
+	AutoProvision bool
+	// AllowedDomains, when set, limits logins to emails in these domains.
+	AllowedDomains []string
+	// SuccessRedirect, when set, receives the session token in the URL
+	// fragment instead of the callback answering with JSON.
+	SuccessRedirect string
+}
+
+func LoadSettings() Settings {
+	scopes := []string{oidc.ScopeOpenID, "email", "profile"}
+	if value := os.Getenv("OIDC_SCOPES"); value != "" {
+		scopes = strings.Fields(strings.ReplaceAll(value, ",", " "))
+	}
+	var domains []string
+	for _, domain := range strings.Split(os.Getenv("OIDC_ALLOWED_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(strings.ToLower(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return Settings{
+		Issuer:          os.Getenv("OIDC_ISSUER"),
+		ClientID:        os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:    os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:     os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:          scopes,
+		AutoProvision:   os.Getenv("OIDC_AUTO_PROVISION") != "false",
+		AllowedDomains:  domains,
+		SuccessRedirect: os.Getenv("OIDC_SUCCESS_REDIRECT"),
+	}
+}
+
+// Claims are what the server uses from a verified ID token.
+type Claims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+// Client talks to the provider. Discovery happens on first use and is
+// retried until it succeeds, so the server starts while the provider is
+// still down.
+type Client struct {
+	Settings Settings
+
+	mutex    sync.Mutex
+	provider *oidc.Provider
+}
+
+func NewClient(settings Settings) *Client {
+	return &Client{Settings: settings}
+}
+
+func (client *Client) Enabled() bool {
+	return client.Settings.Issuer != "" && client.Settings.ClientID != ""
+}
+
+func (client *Client) discover(ctx context.Context) (*oidc.Provider, error) {
+	if !client.Enabled() {
+		return nil, ErrDisabled
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.provider != nil {
+		return client.provider, nil
+	}
+	provider, err := oidc.NewProvider(ctx, client.Settings.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover identity provider: %w", err)
+	}
+	client.provider = provider
+	return provider, nil
+}
+
+func (client *Client) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     client.Settings.ClientID,
+		ClientSecret: client.Settings.ClientSecret,
+		RedirectURL:  client.Settings.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       client.Settings.Scopes,
+	}
+}
+
+// AuthCodeURL is where the browser is sent to sign in. state and nonce tie
+// the callback to this attempt and verifier is the PKCE secret whose S256
+// challenge goes to the provider.
+func (client *Client) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	provider, err := client.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange trades the code of the callback for tokens and returns the
+// claims of the verified ID token, checking it carries nonce.
+func (client *Client) Exchange(ctx context.Context, code string, verifier string, nonce string) (Claims, error) {
+	var claims Claims
+	provider, err := client.discover(ctx)
+	if err != nil {
+		return claims, err
+	}
+	token, err := client.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return claims, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return claims, errors.New("no id_token in token response")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: client.Settings.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return claims, fmt.Errorf("failed to verify id_token: %w", err)
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return claims, fmt.Errorf("failed to read id_token claims: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return claims, errors.New("id_token nonce does not match")
+	}
+	claims.Issuer = idToken.Issuer
+	claims.Subject = idToken.Subject
+	return claims, nil
+}
+
+// DomainAllowed reports whether an email may sign in under AllowedDomains.
+func (client *Client) DomainAllowed(email string) bool {
+	if len(client.Settings.AllowedDomains) == 0 {
+		return true
+	}
+	_, domain, ok := strings.Cut(strings.ToLower(email), "@")
+	if !ok {
+		return false
+	}
+	for _, allowed := range client.Settings.AllowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const gormSpanKey = "otel:span"
+
+// GormPlugin starts a span for every gorm query. Queries only join the
+// caller's trace when the *gorm.DB was bound to its context with WithContext.
+type GormPlugin struct{}
+
+func (GormPlugin) Name() string {
+	return "otel-tracing"
+}
+
+func (GormPlugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	registrations := []error{
+		callback.Create().Before("gorm:create").Register("otel:before_create", startGormSpan("create")),
+		callback.Create().After("gorm:create").Register("otel:after_create", endGormSpan),
+		callback.Query().Before("gorm:query").Register("otel:before_query", startGormSpan("query")),
+		callback.Query().After("gorm:query").Register("otel:after_query", endGormSpan),
+		callback.Update().Before("gorm:update").Register("otel:before_update", startGormSpan("update")),
+		callback.Update().After("gorm:update").Register("otel:after_update", endGormSpan),
+		callback.Delete().Before("gorm:delete").Register("otel:before_delete", startGormSpan("delete")),
+		callback.Delete().After("gorm:delete").Register("otel:after_delete", endGormSpan),
+		callback.Row().Before("gorm:row").Register("otel:before_row", startGormSpan("row")),
+		callback.Row().After("gorm:row").Register("otel:after_row", endGormSpan),
+		callback.Raw().Before("gorm:raw").Register("otel:before_raw", startGormSpan("raw")),
+		callback.Raw().After("gorm:raw").Register("otel:after_raw", endGormSpan),
+	}
+	for _, err := range registrations {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startGormSpan(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Statement == nil || db.Statement.Context == nil {
+			return
+		}
+		_, span := Tracer.Start(db.Statement.Context, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "postgresql"),
+				attribute.String("db.operation", operation),
+			),
+		)
+		db.InstanceSet(gormSpanKey, span)
+	}
+}
+
+func endGormSpan(db *gorm.DB) {
+	value, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	// the statement is logged without its bound variables so no document
+	// content or password hash ends up in a span
+	span.SetAttributes(
+		attribute.String("db.statement", db.Statement.SQL.String()),
+		attribute.String("db.sql.table", db.Statement.Table),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		// a lookup that finds nothing is an answer, not a failure
+		span.End()
+		return
+	}
+	EndSpan(span, db.Error)
+}
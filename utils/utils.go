@@ -1,7 +1,13 @@
 package utils
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
 	"real-time-collab/models"
 	"strconv"
 	"time"
@@ -10,18 +16,46 @@ import (
 	"gorm.io/gorm"
 )
 
-var jwtSecret = []byte("real_time_collab")
+// MinSecretLength is the shortest signing secret accepted, in bytes.
+const MinSecretLength = 32
 
+// jwtSecret signs session tokens and actionSecret the action tokens sent by
+// email; both are set by LoadSecrets
+var jwtSecret, actionSecret []byte
 
-func GenerateJWT(userID uint, email string) (string, error) {
+var errNoSecret = errors.New("signing secrets not loaded")
+
+// LoadSecrets reads the signing secrets from JWT_SECRET and
+// ACTION_TOKEN_SECRET. The server must not start without them.
+func LoadSecrets() error {
+	jwt := os.Getenv("JWT_SECRET")
+	action := os.Getenv("ACTION_TOKEN_SECRET")
+	if len(jwt) < MinSecretLength || len(action) < MinSecretLength {
+		return fmt.Errorf("JWT_SECRET and ACTION_TOKEN_SECRET must be set to at least %d bytes", MinSecretLength)
+	}
+	if jwt == action {
+		return errors.New("JWT_SECRET and ACTION_TOKEN_SECRET must differ")
+	}
+	jwtSecret, actionSecret = []byte(jwt), []byte(action)
+	return nil
+}
+
+// GenerateJWT signs a session token for a user. fingerprint is the
+// Fingerprint of the user's password hash, which ValidateJwtToken compares
+// against the current one so sessions end when the password changes.
+func GenerateJWT(userID uint, email string, fingerprint string) (string, error) {
 	// Define the token claims
 	claims := jwt.MapClaims{
 		"sub":  strconv.FormatUint(uint64(userID),10),                    // Subject (user ID)
 		"email": email,                    // User email
+		"fp":    fingerprint,              // Password fingerprint
 		"exp":   time.Now().Add(time.Hour * 24).Unix(), // Expiration time (24 hours)
 		"iat":   time.Now().Unix(),        // Issued at
 	}
 
+	if len(jwtSecret) == 0 {
+		return "", errNoSecret
+	}
 	// Create the token
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
@@ -42,6 +76,9 @@ func ExtractClaims(tokenString string) (map[string]interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
+		if len(jwtSecret) == 0 {
+			return nil, errNoSecret
+		}
 		return jwtSecret, nil
 	})
 
@@ -57,8 +94,129 @@ func ExtractClaims(tokenString string) (map[string]interface{}, error) {
 	return nil, fmt.Errorf("invalid token")
 }
 
+// Purposes of action tokens, the signed links sent by email.
+const (
+	VerifyEmailPurpose   = "verify_email"
+	ResetPasswordPurpose = "reset_password"
+	OIDCLoginPurpose     = "oidc_login"
+	// WorkspaceInvitePurpose tokens carry the id of the invite, not a user
+	WorkspaceInvitePurpose = "workspace_invite"
+	// ShareTicketPurpose tokens stand in for the password of a share link
+	// when opening its websocket
+	ShareTicketPurpose = "share_ticket"
+)
+
+// actionKey derives a signing key per purpose from the action secret, so an
+// action token is neither a session token nor valid for another purpose.
+func actionKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, actionSecret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Fingerprint is a short digest of a value an action token is bound to,
+// like the email it verifies or the password hash it replaces, so the token
+// stops working once that value changes.
+func Fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SignPurposeClaims signs claims for purpose with an expiry of ttl. Tokens
+// signed for one purpose do not verify for another or as session tokens.
+func SignPurposeClaims(purpose string, claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	if len(actionSecret) == 0 {
+		return "", errNoSecret
+	}
+	claims["purpose"] = purpose
+	claims["exp"] = time.Now().Add(ttl).Unix()
+	claims["iat"] = time.Now().Unix()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(actionKey(purpose))
+}
+
+// ParsePurposeClaims checks the signature, expiry and purpose of a token
+// signed with SignPurposeClaims and returns its claims.
+func ParsePurposeClaims(tokenString string, purpose string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		if len(actionSecret) == 0 {
+			return nil, errNoSecret
+		}
+		return actionKey(purpose), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["purpose"] != purpose {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("expiration claim missing from token")
+	}
+	return claims, nil
+}
+
+// GenerateActionToken signs a token for purpose on behalf of a user that
+// expires after ttl.
+func GenerateActionToken(userID uint, purpose string, fingerprint string, ttl time.Duration) (string, error) {
+	return SignPurposeClaims(purpose, jwt.MapClaims{
+		"sub": strconv.FormatUint(uint64(userID), 10),
+		"fp":  fingerprint,
+	}, ttl)
+}
+
+// ParseActionToken checks an action token and returns the user id and
+// fingerprint it carries.
+func ParseActionToken(tokenString string, purpose string) (string, string, error) {
+	claims, err := ParsePurposeClaims(tokenString, purpose)
+	if err != nil {
+		return "", "", err
+	}
+	userID, _ := claims["sub"].(string)
+	fingerprint, _ := claims["fp"].(string)
+	if userID == "" {
+		return "", "", fmt.Errorf("user id claim missing from token")
+	}
+	return userID, fingerprint, nil
+}
+
 func AutoMigrateModels(DB *gorm.DB){
 	DB.AutoMigrate(&models.DocumentEvent{})
 	DB.AutoMigrate(&models.Document{})
 	DB.AutoMigrate(&models.User{})
+	DB.AutoMigrate(&models.Thread{})
+	DB.AutoMigrate(&models.Comment{})
+	DB.AutoMigrate(&models.Suggestion{})
+	DB.AutoMigrate(&models.VersionTag{})
+	DB.AutoMigrate(&models.DocumentSnapshot{})
+	DB.AutoMigrate(&models.ExternalIdentity{})
+	DB.AutoMigrate(&models.APIToken{})
+	DB.AutoMigrate(&models.Workspace{})
+	DB.AutoMigrate(&models.Membership{})
+	DB.AutoMigrate(&models.WorkspaceInvite{})
+	DB.AutoMigrate(&models.Folder{})
+	DB.AutoMigrate(&models.ShareLink{})
+	DB.AutoMigrate(&models.AuditEvent{})
+	// the model's hooks only stop the ORM, the trigger stops raw SQL too
+	for _, statement := range auditAppendOnly {
+		if err := DB.Exec(statement).Error; err != nil {
+			slog.Warn("failed to make the audit log append-only", "error", err)
+			break
+		}
+	}
+}
+
+// auditAppendOnly makes postgres refuse updates and deletes of audit events.
+var auditAppendOnly = []string{
+	`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit events are append-only';
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events`,
+	`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
 }
\ No newline at end of file